@@ -0,0 +1,290 @@
+package pubsub
+
+import (
+	"context"
+	"maps"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/yurivish/toolkit/sublist"
+)
+
+// Headers added to messages published to the dead-letter subject of an AckPolicy.
+const (
+	HeaderSubject      = "Nats-Subject"       // The subject the message was originally published to
+	HeaderNumDelivered = "Nats-Num-Delivered" // The number of times the message was delivered
+)
+
+// AckPolicy configures acknowledged delivery, see SubAck.
+type AckPolicy struct {
+	AckWait    time.Duration // How long to wait for an ack before redelivering; 30 seconds by default
+	MaxDeliver int           // Maximum number of deliveries per message, or unlimited if not positive
+	DeadLetter string        // Subject to publish messages to once they reach MaxDeliver, if any
+}
+
+// AckMsg is a message delivered to a SubAck handler, which should acknowledge it once it has
+// been handled. Messages that are not acknowledged within the ack wait are redelivered.
+type AckMsg[M any] struct {
+	*Msg[M]
+	NumDelivered int // 1 for the first delivery, 2 for the first redelivery, and so on
+	p            *ackPending
+}
+
+// Ack acknowledges the message, so that it is not redelivered.
+func (m *AckMsg[M]) Ack() {
+	m.p.ack()
+}
+
+// Nak negatively acknowledges the message, so that it is redelivered right away.
+func (m *AckMsg[M]) Nak() {
+	m.p.redeliverAfter(0)
+}
+
+// NakWithDelay negatively acknowledges the message, so that it is redelivered after the delay.
+func (m *AckMsg[M]) NakWithDelay(delay time.Duration) {
+	m.p.redeliverAfter(delay)
+}
+
+// InProgress resets the ack wait, for handlers that need more time.
+func (m *AckMsg[M]) InProgress() {
+	m.p.redeliverAfter(m.p.group.policy.AckWait)
+}
+
+// SubAck subscribes a handler with at-least-once delivery. Messages that the handler does
+// not Ack within the policy's AckWait, including those for which it panics, are redelivered,
+// up to MaxDeliver times in all. Messages that reach MaxDeliver without being acknowledged
+// are published to the DeadLetter subject, if there is one, with headers recording their
+// original subject and number of deliveries.
+//
+// Subscribers in a queue group (see WithQueueGroup) with the same subject behave like a work
+// queue: each message is delivered to one member of the group, and redeliveries may go to any
+// member, chosen by the queue strategy. Members share the policy of the first to subscribe.
+//
+// Messages dropped before reaching the handler by an async overflow policy are not redelivered.
+func SubAck[M any](ps *PubSub, subj string, policy AckPolicy, handler func(*AckMsg[M]), options ...SubOption) context.CancelFunc {
+	if policy.AckWait <= 0 {
+		policy.AckWait = 30 * time.Second
+	}
+	opts := SubOptions{}
+	for _, opt := range options {
+		opt(&opts)
+	}
+	g := ps.ackGroup(subj, string(opts.Queue), policy)
+	m := &ackMember{}
+	options = append(options, WithSkip(1), func(s *SubOptions) {
+		s.onCancel = func() { g.leave(m) }
+	})
+	s := subscribe(ps, subj, func(msg *Msg[any]) {
+		if p, n := g.begin(msg); p != nil {
+			handler(&AckMsg[M]{Msg: msgAs[M](msg), NumDelivered: n, p: p})
+		}
+	}, options...)
+	g.join(m, s.sub)
+	return s.cancel
+}
+
+// ackGroup tracks the unacknowledged messages of a subscription, or of the members
+// of a queue group, which share them so that any member can handle redeliveries.
+type ackGroup struct {
+	ps     *PubSub
+	key    string // Key in ps.ackGroups, or empty if the group is not shared
+	policy AckPolicy
+
+	mu          sync.Mutex
+	refs        int                     // Members that joined or are about to, guarded by ps.mu
+	members     []*sublist.Subscription // Replaced rather than modified, so it can be used without the lock
+	pending     map[*ackPending]struct{}
+	redelivered map[*Msg[any]]*ackPending // Pending messages by the envelope of their latest redelivery
+}
+
+type ackMember struct {
+	sub  *sublist.Subscription
+	left bool
+}
+
+// ackPending is a message that has not been acknowledged. Guarded by the group's lock.
+type ackPending struct {
+	group     *ackGroup
+	msg       *Msg[any]
+	env       *Msg[any] // Envelope of the latest redelivery, or nil
+	delivered int
+	timer     ClockTimer
+	done      bool
+}
+
+// ackGroup returns the group for a new SubAck subscriber.
+func (ps *PubSub) ackGroup(subj, queue string, policy AckPolicy) *ackGroup {
+	g := &ackGroup{ps: ps, policy: policy, pending: make(map[*ackPending]struct{}), redelivered: make(map[*Msg[any]]*ackPending)}
+	if queue == _EMPTY_ {
+		g.refs = 1
+		return g
+	}
+	g.key = subj + " " + queue
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	if existing, ok := ps.ackGroups[g.key]; ok {
+		g = existing
+	} else {
+		if ps.ackGroups == nil {
+			ps.ackGroups = make(map[string]*ackGroup)
+		}
+		ps.ackGroups[g.key] = g
+	}
+	g.refs++
+	return g
+}
+
+func (g *ackGroup) join(m *ackMember, sub *sublist.Subscription) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if !m.left {
+		m.sub = sub
+		g.members = append(slices.Clip(g.members), sub)
+	}
+}
+
+// leave removes a member, and forgets the pending messages once the last member has left.
+func (g *ackGroup) leave(m *ackMember) {
+	g.mu.Lock()
+	if m.left {
+		g.mu.Unlock()
+		return
+	}
+	m.left = true
+	if m.sub != nil {
+		g.members = slices.DeleteFunc(slices.Clone(g.members), func(sub *sublist.Subscription) bool { return sub == m.sub })
+	}
+	g.mu.Unlock()
+
+	g.ps.mu.Lock()
+	g.refs--
+	last := g.refs == 0
+	if last && g.key != _EMPTY_ {
+		delete(g.ps.ackGroups, g.key)
+	}
+	g.ps.mu.Unlock()
+	if last {
+		g.mu.Lock()
+		for p := range g.pending {
+			p.finish()
+		}
+		g.mu.Unlock()
+	}
+}
+
+// begin records the delivery of a message to a member, returning its pending state and
+// the number of times it has been delivered, or nil if it has since been acknowledged.
+func (g *ackGroup) begin(msg *Msg[any]) (*ackPending, int) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	p, ok := g.redelivered[msg]
+	if ok {
+		delete(g.redelivered, msg)
+		p.env = nil
+	} else {
+		p = &ackPending{group: g, msg: msg}
+		g.pending[p] = struct{}{}
+	}
+	if p.done {
+		return nil, 0
+	}
+	p.delivered++
+	p.arm(g.policy.AckWait)
+	return p, p.delivered
+}
+
+// arm schedules a redelivery. Lock should be held.
+func (p *ackPending) arm(d time.Duration) {
+	if p.timer == nil {
+		p.timer = p.group.ps.clock.AfterFunc(d, p.group.redeliver(p))
+	} else {
+		p.timer.Reset(d)
+	}
+}
+
+// finish forgets the message. Lock should be held.
+func (p *ackPending) finish() {
+	p.done = true
+	if p.timer != nil {
+		p.timer.Stop()
+	}
+	delete(p.group.pending, p)
+	if p.env != nil {
+		delete(p.group.redelivered, p.env)
+	}
+}
+
+func (p *ackPending) ack() {
+	p.group.mu.Lock()
+	defer p.group.mu.Unlock()
+	if !p.done {
+		p.finish()
+	}
+}
+
+func (p *ackPending) redeliverAfter(d time.Duration) {
+	p.group.mu.Lock()
+	defer p.group.mu.Unlock()
+	if !p.done {
+		p.arm(d)
+	}
+}
+
+// redeliver returns a function that delivers the message to a member of the group,
+// or publishes it to the dead-letter subject once it has been delivered too many times.
+func (g *ackGroup) redeliver(p *ackPending) func() {
+	return func() {
+		g.mu.Lock()
+		if p.done {
+			g.mu.Unlock()
+			return
+		}
+		if g.ps.Closed() || len(g.members) == 0 {
+			p.finish()
+			g.mu.Unlock()
+			return
+		}
+		if g.policy.MaxDeliver > 0 && p.delivered >= g.policy.MaxDeliver {
+			p.finish()
+			s := g.members[0].Value.(*subscriber)
+			g.mu.Unlock()
+			g.deadLetter(p, s)
+			return
+		}
+		// Each redelivery has its own envelope, by which the member recognizes it.
+		// If it never reaches a member, the timer redelivers it again.
+		if p.env != nil {
+			delete(g.redelivered, p.env)
+		}
+		msg := *p.msg
+		p.env = &msg
+		g.redelivered[p.env] = p
+		p.arm(g.policy.AckWait)
+		members := g.members
+		g.mu.Unlock()
+
+		sub := members[0]
+		if len(members) > 1 {
+			sub = g.ps.queue(members, &msg)
+		}
+		g.ps.pub(&msg, sub, &sublist.SublistResult{Qsubs: [][]*sublist.Subscription{members}})
+	}
+}
+
+// deadLetter publishes a message that was delivered too many times to the dead-letter subject.
+// Since the message is already forgotten, failures are reported as errors of the subscriber s.
+func (g *ackGroup) deadLetter(p *ackPending, s *subscriber) {
+	if g.policy.DeadLetter == _EMPTY_ {
+		return
+	}
+	header := maps.Clone(p.msg.Header)
+	if header == nil {
+		header = Header{}
+	}
+	header.Set(HeaderSubject, p.msg.Subject)
+	header.Set(HeaderNumDelivered, strconv.Itoa(p.delivered))
+	msg := &Msg[any]{Subject: g.policy.DeadLetter, Reply: p.msg.Reply, Header: header, Data: p.msg.Data}
+	g.ps.publishError(s, msg, g.ps.publish(msg))
+}
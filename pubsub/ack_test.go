@@ -0,0 +1,126 @@
+package pubsub
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/yurivish/toolkit/assert"
+	"github.com/yurivish/toolkit/sublist"
+)
+
+func TestSubAckRedelivery(t *testing.T) {
+	ps := NewPubSub()
+	deliveries := make(chan int, 10)
+	SubAck(ps, "jobs", AckPolicy{AckWait: 10 * time.Millisecond}, func(msg *AckMsg[string]) {
+		deliveries <- msg.NumDelivered
+		assert.Equal(t, msg.Data, "job")
+		// Acknowledge only the third delivery
+		if msg.NumDelivered == 3 {
+			msg.Ack()
+		}
+	})
+	Pub(ps, "jobs", "job")
+	assert.Equal(t, <-deliveries, 1)
+	assert.Equal(t, <-deliveries, 2)
+	assert.Equal(t, <-deliveries, 3)
+	select {
+	case n := <-deliveries:
+		t.Fatalf("unexpected delivery %d after ack", n)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestSubAckNakAndInProgress(t *testing.T) {
+	ps := NewPubSub()
+	deliveries := make(chan time.Time, 10)
+	SubAck(ps, "jobs", AckPolicy{AckWait: time.Hour}, func(msg *AckMsg[int]) {
+		deliveries <- time.Now()
+		switch msg.NumDelivered {
+		case 1:
+			msg.Nak()
+		case 2:
+			msg.NakWithDelay(20 * time.Millisecond)
+		case 3:
+			msg.InProgress()
+			msg.Ack()
+		}
+	})
+	Pub(ps, "jobs", 1)
+	<-deliveries
+	second := <-deliveries
+	third := <-deliveries
+	assert.True(t, third.Sub(second) >= 20*time.Millisecond)
+}
+
+func TestSubAckDeadLetter(t *testing.T) {
+	ps := NewPubSub()
+	dead := make(chan *Msg[string], 1)
+	SubMsg(ps, "dead.jobs", func(msg *Msg[string]) { dead <- msg })
+	var mu sync.Mutex
+	var deliveries int
+	SubAck(ps, "jobs.*", AckPolicy{AckWait: time.Hour, MaxDeliver: 3, DeadLetter: "dead.jobs"}, func(msg *AckMsg[string]) {
+		mu.Lock()
+		deliveries++
+		mu.Unlock()
+		msg.Nak()
+	})
+	PubMsg(ps, &Msg[string]{Subject: "jobs.a", Header: Header{"k": {"v"}}, Data: "job"})
+	msg := <-dead
+	assert.Equal(t, msg.Data, "job")
+	assert.Equal(t, msg.Header.Get(HeaderSubject), "jobs.a")
+	assert.Equal(t, msg.Header.Get(HeaderNumDelivered), "3")
+	assert.Equal(t, msg.Header.Get("k"), "v")
+	mu.Lock()
+	assert.Equal(t, deliveries, 3)
+	mu.Unlock()
+}
+
+// chanObserver sends the errors reported to it on a channel, for errors reported from timers.
+type chanObserver struct {
+	errorObserver
+	errs chan error
+}
+
+func (o *chanObserver) Error(_ *sublist.Subscription, _ *Msg[any], err error) {
+	o.errs <- err
+}
+
+func TestSubAckDeadLetterError(t *testing.T) {
+	o := &chanObserver{errs: make(chan error, 1)}
+	ps := NewPubSub(WithObserver(o))
+	_, err := Register[int](ps, "dead.jobs")
+	assert.Nil(t, err)
+	SubAck(ps, "jobs", AckPolicy{AckWait: time.Hour, MaxDeliver: 1, DeadLetter: "dead.jobs"}, func(msg *AckMsg[string]) {
+		msg.Nak()
+	})
+	// The message doesn't match the dead-letter schema, which is reported rather than lost silently
+	Pub(ps, "jobs", "job")
+	assert.ErrorIs(t, <-o.errs, ErrSchemaMismatch)
+}
+
+func TestSubAckWorkQueue(t *testing.T) {
+	ps := NewPubSub(WithQueueStrategy(QueueRoundRobin()))
+	policy := AckPolicy{AckWait: time.Hour}
+	acked := make(chan int, 10)
+	// One worker gives up on everything, which the other picks up
+	SubAck(ps, "jobs", policy, func(msg *AckMsg[int]) { msg.Nak() }, WithQueueGroup("workers"))
+	cancel := SubAck(ps, "jobs", policy, func(msg *AckMsg[int]) {
+		msg.Ack()
+		acked <- msg.Data
+	}, WithQueueGroup("workers"))
+	for i := range 10 {
+		Pub(ps, "jobs", i)
+	}
+	seen := make(map[int]bool)
+	for range 10 {
+		seen[<-acked] = true
+	}
+	assert.Equal(t, len(seen), 10)
+
+	// Once the last member leaves, the group is forgotten
+	cancel()
+	assert.Equal(t, len(ps.ackGroups), 1)
+	ps.Close()
+	assert.Equal(t, len(ps.ackGroups), 0)
+}
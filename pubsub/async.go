@@ -0,0 +1,142 @@
+package pubsub
+
+import "sync"
+
+// OverflowPolicy determines what happens when a message is published
+// to an async subscriber whose mailbox is full.
+type OverflowPolicy int
+
+const (
+	Block      OverflowPolicy = iota // Block the publisher until there is room in the mailbox
+	DropNewest                       // Drop the message being published
+	DropOldest                       // Drop the oldest message in the mailbox to make room
+	Disconnect                       // Cancel the subscription, like a NATS slow consumer
+)
+
+func (p OverflowPolicy) String() string {
+	switch p {
+	case Block:
+		return "block"
+	case DropNewest:
+		return "drop-newest"
+	case DropOldest:
+		return "drop-oldest"
+	case Disconnect:
+		return "disconnect"
+	}
+	return "unknown"
+}
+
+// mailbox is a bounded queue of pending handler calls for an async subscription,
+// drained by a dedicated goroutine.
+type mailbox struct {
+	ch        chan func()
+	done      chan struct{} // Closed when the subscription is cancelled
+	closeOnce sync.Once
+	drain     chan struct{} // Closed to have the goroutine exit once the mailbox is empty
+	drainOnce sync.Once
+	finished  chan struct{} // Closed when the goroutine exits
+	policy    OverflowPolicy
+}
+
+func newMailbox(bufSize int, policy OverflowPolicy) *mailbox {
+	if policy != Block && bufSize < 1 {
+		// The drop policies need somewhere to put at least one message,
+		// otherwise every message published while the handler is busy is lost.
+		bufSize = 1
+	}
+	return &mailbox{
+		ch:       make(chan func(), bufSize),
+		done:     make(chan struct{}),
+		drain:    make(chan struct{}),
+		finished: make(chan struct{}),
+		policy:   policy,
+	}
+}
+
+// run calls handlers from the mailbox until it is closed, or until it is empty once drained.
+// Pending calls are discarded once the mailbox is closed.
+func (m *mailbox) run() {
+	defer close(m.finished)
+	for {
+		select {
+		case call := <-m.ch:
+			call()
+		case <-m.done:
+			return
+		case <-m.drain:
+			for {
+				select {
+				case call := <-m.ch:
+					call()
+				case <-m.done:
+					return
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+// stopWhenEmpty has the mailbox goroutine exit once it has handled the pending calls.
+// Calls offered after that are never handled, so it should be used once publishing has stopped.
+func (m *mailbox) stopWhenEmpty() {
+	m.drainOnce.Do(func() { close(m.drain) })
+}
+
+// close stops the mailbox goroutine. Safe to call more than once.
+func (m *mailbox) close() {
+	m.closeOnce.Do(func() { close(m.done) })
+}
+
+// offer places a call into the mailbox according to its overflow policy.
+func (m *mailbox) offer(call func()) (dropped int, disconnect bool) {
+	return offer(m.ch, call, m.policy, m.done)
+}
+
+// offer sends v on ch according to the overflow policy, returning the number
+// of messages dropped and whether the consumer should be disconnected.
+// Sends are abandoned once done is closed.
+func offer[T any](ch chan T, v T, policy OverflowPolicy, done <-chan struct{}) (dropped int, disconnect bool) {
+	select {
+	case <-done:
+		return 0, false
+	default:
+	}
+	switch policy {
+	case DropNewest:
+		select {
+		case ch <- v:
+		default:
+			dropped = 1
+		}
+	case DropOldest:
+		for {
+			select {
+			case ch <- v:
+				return dropped, false
+			default:
+			}
+			// Make room by discarding the oldest message. The consumer may have
+			// beaten us to it, in which case we simply retry the send.
+			select {
+			case <-ch:
+				dropped++
+			default:
+			}
+		}
+	case Disconnect:
+		select {
+		case ch <- v:
+		default:
+			dropped, disconnect = 1, true
+		}
+	default:
+		select {
+		case ch <- v:
+		case <-done:
+		}
+	}
+	return dropped, disconnect
+}
@@ -0,0 +1,218 @@
+package pubsub
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/yurivish/toolkit/sublist"
+)
+
+// WithCoalesce keeps only the newest message published to each subject, and delivers it
+// at the end of an interval that starts when the first message arrives. Each subject is
+// delivered at most once per interval, so that a handler subscribed with a wildcard
+// receives the latest message for every subject that changed. Messages replaced by newer
+// ones are discarded without being counted as dropped.
+func WithCoalesce(interval time.Duration) SubOption {
+	return func(s *SubOptions) {
+		s.Coalesce = interval
+	}
+}
+
+// WithBatch collects messages into batches of up to n, delivered once the batch is full,
+// or maxWait after its first message arrived if maxWait is positive. Batches combine the
+// messages of every subject matching the subscription. Only SubBatch and SubBatchMsg accept
+// batches; passing WithBatch to other subscribe functions panics.
+func WithBatch(n int, maxWait time.Duration) SubOption {
+	return func(s *SubOptions) {
+		s.BatchSize = n
+		s.BatchWait = maxWait
+	}
+}
+
+// SubBatch subscribes a handler that receives messages in batches, see WithBatch.
+// Without WithBatch, each batch holds a single message.
+func SubBatch[M any](ps *PubSub, subj string, handler func([]M), options ...SubOption) context.CancelFunc {
+	options = append(options, WithSkip(1)) // Skip this stack frame when recording the subscriber
+	return sub(ps, subj, func(msgs []*Msg[any]) {
+		batch := make([]M, len(msgs))
+		for i, msg := range msgs {
+			batch[i] = as[M](msg.Data)
+		}
+		handler(batch)
+	}, options...)
+}
+
+// SubBatchMsg is like SubBatch, but the handler receives the full message envelopes.
+func SubBatchMsg[M any](ps *PubSub, subj string, handler func([]*Msg[M]), options ...SubOption) context.CancelFunc {
+	options = append(options, WithSkip(1)) // Skip this stack frame when recording the subscriber
+	return sub(ps, subj, func(msgs []*Msg[any]) {
+		batch := make([]*Msg[M], len(msgs))
+		for i, msg := range msgs {
+			batch[i] = msgAs[M](msg)
+		}
+		handler(batch)
+	}, options...)
+}
+
+// coalescer holds the newest message per subject until the end of the interval.
+type coalescer struct {
+	ps       *PubSub
+	s        *subscriber
+	interval time.Duration
+
+	mu      sync.Mutex
+	latest  map[string]heldMsg
+	order   []string // Subjects in the order they first arrived during this interval
+	timer   ClockTimer
+	armed   bool
+	stopped bool
+}
+
+type heldMsg struct {
+	msg     *Msg[any]
+	matches *sublist.SublistResult
+}
+
+func (c *coalescer) add(msg *Msg[any], matches *sublist.SublistResult) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.stopped {
+		return
+	}
+	if _, ok := c.latest[msg.Subject]; !ok {
+		c.order = append(c.order, msg.Subject)
+	}
+	c.latest[msg.Subject] = heldMsg{msg, matches}
+	if !c.armed {
+		c.armed = true
+		if c.timer == nil {
+			c.timer = c.ps.clock.AfterFunc(c.interval, c.flush)
+		} else {
+			c.timer.Reset(c.interval)
+		}
+	}
+}
+
+// flush delivers the newest message for each subject, unless the subscription
+// has been cancelled, since the timer may fire after stop.
+func (c *coalescer) flush() {
+	c.mu.Lock()
+	if c.stopped {
+		c.mu.Unlock()
+		return
+	}
+	held := make([]heldMsg, len(c.order))
+	for i, subj := range c.order {
+		held[i] = c.latest[subj]
+	}
+	clear(c.latest)
+	c.order = c.order[:0]
+	c.armed = false
+	c.mu.Unlock()
+	for _, h := range held {
+		c.ps.pubBatch(c.s, h.msg, h.matches)
+	}
+}
+
+// stop discards the held messages.
+func (c *coalescer) stop() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.stopped = true
+	clear(c.latest)
+	c.order = nil
+	if c.timer != nil {
+		c.timer.Stop()
+	}
+}
+
+// batcher collects messages until the batch is full or has waited long enough.
+type batcher struct {
+	ps      *PubSub
+	s       *subscriber
+	size    int
+	maxWait time.Duration
+
+	mu      sync.Mutex
+	msgs    []*Msg[any]
+	first   time.Time // When the first message of the current batch arrived
+	timer   ClockTimer
+	stopped bool
+}
+
+func (b *batcher) add(msg *Msg[any]) {
+	b.mu.Lock()
+	if b.stopped {
+		b.mu.Unlock()
+		return
+	}
+	b.msgs = append(b.msgs, msg)
+	if len(b.msgs) >= b.size {
+		batch := b.take()
+		b.mu.Unlock()
+		b.deliver(batch)
+		return
+	}
+	if len(b.msgs) == 1 && b.maxWait > 0 {
+		b.first = b.ps.clock.Now()
+		if b.timer == nil {
+			b.timer = b.ps.clock.AfterFunc(b.maxWait, b.expire)
+		} else {
+			b.timer.Reset(b.maxWait)
+		}
+	}
+	b.mu.Unlock()
+}
+
+// take returns the current batch and starts a new one. Lock should be held.
+func (b *batcher) take() []*Msg[any] {
+	batch := b.msgs
+	b.msgs = nil
+	if b.timer != nil {
+		b.timer.Stop()
+	}
+	return batch
+}
+
+// expire delivers the current batch once it has waited for maxWait. The timer may belong
+// to a batch that has since been delivered, in which case it is set for the current one.
+func (b *batcher) expire() {
+	b.mu.Lock()
+	if len(b.msgs) == 0 {
+		b.mu.Unlock()
+		return
+	}
+	if wait := b.maxWait - b.ps.clock.Now().Sub(b.first); wait > 0 {
+		b.timer.Reset(wait)
+		b.mu.Unlock()
+		return
+	}
+	batch := b.take()
+	b.mu.Unlock()
+	b.deliver(batch)
+}
+
+// flush delivers the current batch, however small.
+func (b *batcher) flush() {
+	b.mu.Lock()
+	batch := b.take()
+	b.mu.Unlock()
+	if len(batch) > 0 {
+		b.deliver(batch)
+	}
+}
+
+// deliver passes the batch to the subscriber in an envelope of its own.
+func (b *batcher) deliver(batch []*Msg[any]) {
+	last := batch[len(batch)-1]
+	msg := &Msg[any]{Subject: last.Subject, Time: last.Time, Data: batch}
+	b.ps.dispatch(b.s, msg, &sublist.SublistResult{Psubs: []*sublist.Subscription{b.s.sub}})
+}
+
+func (b *batcher) stop() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.stopped = true
+	b.take()
+}
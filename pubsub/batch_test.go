@@ -0,0 +1,100 @@
+package pubsub
+
+import (
+	"context"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/yurivish/toolkit/assert"
+)
+
+func TestCoalesce(t *testing.T) {
+	clock := NewFakeClock(time.Now())
+	ps := NewPubSub(WithClock(clock))
+	var got []string
+	SubMsg(ps, "pos.*", func(msg *Msg[int]) {
+		got = append(got, msg.Subject+"="+strconv.Itoa(msg.Data))
+	}, WithCoalesce(time.Second))
+	for i := range 5 {
+		Pub(ps, "pos.a", i)
+		Pub(ps, "pos.b", 9-i)
+	}
+	Pub(ps, "pos.c", 0)
+	assert.Equal(t, len(got), 0)
+	clock.Advance(time.Second)
+	assert.Equal(t, got, []string{"pos.a=4", "pos.b=5", "pos.c=0"})
+
+	// Subjects that did not change are not redelivered
+	Pub(ps, "pos.b", 1)
+	clock.Advance(500 * time.Millisecond)
+	Pub(ps, "pos.b", 2)
+	clock.Advance(500 * time.Millisecond)
+	assert.Equal(t, got[3:], []string{"pos.b=2"})
+	clock.Advance(time.Hour)
+	assert.Equal(t, len(got), 4)
+	assert.Equal(t, ps.Subscriptions()[0].Delivered, uint64(4))
+}
+
+func TestCoalesceCancel(t *testing.T) {
+	clock := NewFakeClock(time.Now())
+	ps := NewPubSub(WithClock(clock))
+	got := 0
+	s := subscribe(ps, "pos", func(*Msg[any]) { got++ }, WithCoalesce(time.Second))
+	Pub(ps, "pos", 1)
+	s.cancel()
+	clock.Advance(time.Second)
+	// As would happen if the timer fired just as the subscription was cancelled
+	s.coalesce.flush()
+	assert.Equal(t, got, 0)
+}
+
+func TestBatch(t *testing.T) {
+	clock := NewFakeClock(time.Now())
+	ps := NewPubSub(WithClock(clock))
+	var batches [][]int
+	SubBatch(ps, "n.>", func(batch []int) { batches = append(batches, batch) }, WithBatch(3, time.Second))
+	for i := range 7 {
+		Pub(ps, "n."+strconv.Itoa(i%2), i)
+	}
+	assert.Equal(t, batches, [][]int{{0, 1, 2}, {3, 4, 5}})
+	clock.Advance(500 * time.Millisecond)
+	Pub(ps, "n.x", 7)
+	assert.Equal(t, len(batches), 2)
+	// The partial batch is delivered a second after its first message
+	clock.Advance(500 * time.Millisecond)
+	assert.Equal(t, batches[2:], [][]int{{6, 7}})
+
+	var subjects []string
+	SubBatchMsg(ps, "m.*", func(batch []*Msg[string]) {
+		for _, msg := range batch {
+			subjects = append(subjects, msg.Subject)
+		}
+	}, WithBatch(10, 0), WithAsync(1, Block))
+	Pub(ps, "m.a", "x")
+	Pub(ps, "m.b", "y")
+	assert.Nil(t, ps.Drain(context.Background()))
+	assert.Equal(t, subjects, []string{"m.a", "m.b"})
+}
+
+func TestBatchCoalesce(t *testing.T) {
+	clock := NewFakeClock(time.Now())
+	ps := NewPubSub(WithClock(clock))
+	var batches [][]string
+	SubBatchMsg(ps, "pos.*", func(batch []*Msg[int]) {
+		var subjects []string
+		for _, msg := range batch {
+			subjects = append(subjects, msg.Subject)
+		}
+		batches = append(batches, subjects)
+	}, WithCoalesce(time.Second), WithBatch(100, time.Millisecond))
+	for range 10 {
+		Pub(ps, "pos.a", 1)
+		Pub(ps, "pos.b", 1)
+	}
+	clock.Advance(2 * time.Second)
+	assert.Equal(t, batches, [][]string{{"pos.a", "pos.b"}})
+
+	defer func() { assert.NotNil(t, recover()) }()
+	Sub(ps, "pos.*", func(string, int) {}, WithBatch(2, 0))
+}
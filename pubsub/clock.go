@@ -0,0 +1,119 @@
+package pubsub
+
+import (
+	"sync"
+	"time"
+)
+
+// Clock is the source of time for a PubSub, see WithClock. It is used to timestamp
+// messages and to run the timers of scheduled publishes, acks and deduplication.
+type Clock interface {
+	Now() time.Time
+	// AfterFunc calls f in its own goroutine once the duration has elapsed, like time.AfterFunc.
+	AfterFunc(d time.Duration, f func()) ClockTimer
+}
+
+// ClockTimer is a timer created by a Clock. It is implemented by *time.Timer.
+type ClockTimer interface {
+	Stop() bool
+	Reset(d time.Duration) bool
+}
+
+// WithClock sets the clock used by the PubSub, eg. a FakeClock in tests.
+func WithClock(clock Clock) PubSubOption {
+	return func(o *PubSubOptions) {
+		o.Clock = clock
+	}
+}
+
+// systemClock is the real clock.
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+func (systemClock) AfterFunc(d time.Duration, f func()) ClockTimer {
+	return time.AfterFunc(d, f)
+}
+
+// FakeClock is a Clock for tests, whose time only moves when it is advanced.
+type FakeClock struct {
+	mu     sync.Mutex
+	now    time.Time
+	timers map[*fakeTimer]struct{} // Active timers
+	seq    uint64                  // Orders timers that expire at the same time
+}
+
+type fakeTimer struct {
+	clock *FakeClock
+	at    time.Time
+	seq   uint64
+	f     func()
+}
+
+// NewFakeClock returns a fake clock set to the given time.
+func NewFakeClock(now time.Time) *FakeClock {
+	return &FakeClock{now: now, timers: make(map[*fakeTimer]struct{})}
+}
+
+func (c *FakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *FakeClock) AfterFunc(d time.Duration, f func()) ClockTimer {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.seq++
+	t := &fakeTimer{clock: c, at: c.now.Add(d), seq: c.seq, f: f}
+	c.timers[t] = struct{}{}
+	return t
+}
+
+// Advance moves the clock forward, calling the functions of the timers that expire along the way
+// in order of expiry, on the calling goroutine. The clock reads the expiry time of each timer
+// while its function is called, and timers set by those functions also fire if they are due.
+func (c *FakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	target := c.now.Add(d)
+	for {
+		var next *fakeTimer
+		for t := range c.timers {
+			if !t.at.After(target) && (next == nil || t.at.Before(next.at) || t.at.Equal(next.at) && t.seq < next.seq) {
+				next = t
+			}
+		}
+		if next == nil {
+			break
+		}
+		delete(c.timers, next)
+		if next.at.After(c.now) {
+			c.now = next.at
+		}
+		c.mu.Unlock()
+		next.f()
+		c.mu.Lock()
+	}
+	c.now = target
+	c.mu.Unlock()
+}
+
+func (t *fakeTimer) Stop() bool {
+	t.clock.mu.Lock()
+	defer t.clock.mu.Unlock()
+	_, active := t.clock.timers[t]
+	delete(t.clock.timers, t)
+	return active
+}
+
+func (t *fakeTimer) Reset(d time.Duration) bool {
+	t.clock.mu.Lock()
+	defer t.clock.mu.Unlock()
+	_, active := t.clock.timers[t]
+	t.clock.seq++
+	t.at, t.seq = t.clock.now.Add(d), t.clock.seq
+	t.clock.timers[t] = struct{}{}
+	return active
+}
@@ -0,0 +1,113 @@
+package pubsub
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// HeaderMsgID is the header holding a message's deduplication key, as in NATS JetStream.
+const HeaderMsgID = "Nats-Msg-Id"
+
+// DedupKeyFunc returns the deduplication key of a message, or "" to never treat it as a duplicate.
+type DedupKeyFunc func(msg *Msg[any]) string
+
+// WithDedup drops messages whose deduplication key was already published within the window,
+// so that producers can safely retry publishes. By default the key is the message's subject
+// together with its Nats-Msg-Id header, and messages without the header are never dropped;
+// see WithDedupKey. At most maxKeys keys are remembered, forgetting the oldest ones first,
+// or 100,000 if maxKeys is not positive. Duplicates are counted, see Duplicates.
+func WithDedup(window time.Duration, maxKeys int) PubSubOption {
+	return func(o *PubSubOptions) {
+		o.DedupWindow = window
+		o.DedupMaxKeys = maxKeys
+	}
+}
+
+// WithDedupKey sets the function that computes the deduplication key of each message.
+// Has no effect unless WithDedup is also passed.
+func WithDedupKey(fn DedupKeyFunc) PubSubOption {
+	return func(o *PubSubOptions) {
+		o.DedupKey = fn
+	}
+}
+
+// defaultDedupKey combines the subject with the message ID, so that messages republished
+// to other subjects with the same headers, eg. by a transform, are not dropped.
+func defaultDedupKey(msg *Msg[any]) string {
+	if id := msg.Header.Get(HeaderMsgID); id != _EMPTY_ {
+		return msg.Subject + " " + id
+	}
+	return _EMPTY_
+}
+
+// Duplicates returns the number of messages dropped as duplicates, see WithDedup.
+func (ps *PubSub) Duplicates() uint64 {
+	if ps.dedup == nil {
+		return 0
+	}
+	return ps.dedup.duplicates.Load()
+}
+
+// dedupWindow remembers the keys seen within a time window. Keys are kept in a queue
+// in the order they were first seen, which is also the order in which they expire.
+type dedupWindow struct {
+	key        DedupKeyFunc
+	window     time.Duration
+	maxKeys    int
+	duplicates atomic.Uint64
+
+	mu    sync.Mutex
+	seen  map[string]struct{}
+	queue fifo[dedupEntry] // Keys in the order they were seen
+}
+
+type dedupEntry struct {
+	key  string
+	time time.Time
+}
+
+func newDedupWindow(opts PubSubOptions) *dedupWindow {
+	d := &dedupWindow{key: opts.DedupKey, window: opts.DedupWindow, maxKeys: opts.DedupMaxKeys, seen: make(map[string]struct{})}
+	if d.key == nil {
+		d.key = defaultDedupKey
+	}
+	if d.maxKeys <= 0 {
+		d.maxKeys = 100_000
+	}
+	return d
+}
+
+// duplicate returns whether the message's key was seen within the window, and remembers it if not.
+func (d *dedupWindow) duplicate(msg *Msg[any], now time.Time) bool {
+	key := d.key(msg)
+	if key == _EMPTY_ {
+		return false
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.expire(now)
+	if _, ok := d.seen[key]; ok {
+		d.duplicates.Add(1)
+		return true
+	}
+	if len(d.seen) >= d.maxKeys {
+		d.pop()
+	}
+	d.seen[key] = struct{}{}
+	d.queue.push(dedupEntry{key, now})
+	return false
+}
+
+// expire forgets the keys that were seen before the window. Lock should be held.
+func (d *dedupWindow) expire(now time.Time) {
+	cutoff := now.Add(-d.window)
+	for d.queue.len() > 0 && !d.queue.front().time.After(cutoff) {
+		d.pop()
+	}
+}
+
+// pop forgets the oldest key. Lock should be held.
+func (d *dedupWindow) pop() {
+	delete(d.seen, d.queue.pop().key)
+}
@@ -0,0 +1,63 @@
+package pubsub
+
+import (
+	"testing"
+	"time"
+
+	"github.com/yurivish/toolkit/assert"
+)
+
+func TestDedup(t *testing.T) {
+	ps := NewPubSub(WithDedup(time.Hour, 0))
+	var got []int
+	Sub(ps, "orders.*", func(_ string, msg int) { got = append(got, msg) })
+	pub := func(subj, id string, msg int) {
+		PubMsg(ps, &Msg[int]{Subject: subj, Header: Header{HeaderMsgID: {id}}, Data: msg})
+	}
+	pub("orders.new", "a", 1)
+	pub("orders.new", "a", 2) // Duplicate
+	pub("orders.new", "b", 3)
+	pub("orders.old", "a", 4) // Same ID on another subject
+	Pub(ps, "orders.new", 5)  // No ID
+	Pub(ps, "orders.new", 6)
+	assert.Equal(t, got, []int{1, 3, 4, 5, 6})
+	assert.Equal(t, ps.Duplicates(), uint64(1))
+}
+
+func TestDedupKey(t *testing.T) {
+	ps := NewPubSub(WithDedup(time.Hour, 0), WithDedupKey(func(msg *Msg[any]) string {
+		return msg.Data.(string)
+	}))
+	var got []string
+	Sub(ps, ">", func(_ string, msg string) { got = append(got, msg) })
+	for _, msg := range []string{"x", "y", "x", "z", "y"} {
+		Pub(ps, "a", msg)
+	}
+	Pub(ps, "b", "x")
+	assert.Equal(t, got, []string{"x", "y", "z"})
+	assert.Equal(t, ps.Duplicates(), uint64(3))
+}
+
+func TestDedupWindow(t *testing.T) {
+	d := newDedupWindow(PubSubOptions{DedupWindow: time.Minute, DedupMaxKeys: 3})
+	now := time.Now()
+	msg := func(id string) *Msg[any] {
+		return &Msg[any]{Subject: "a", Header: Header{HeaderMsgID: {id}}}
+	}
+	assert.False(t, d.duplicate(msg("1"), now))
+	assert.False(t, d.duplicate(msg("2"), now.Add(30*time.Second)))
+	assert.True(t, d.duplicate(msg("1"), now.Add(59*time.Second)))
+
+	// Keys expire once they fall out of the window
+	assert.False(t, d.duplicate(msg("1"), now.Add(61*time.Second)))
+	assert.True(t, d.duplicate(msg("2"), now.Add(61*time.Second)))
+
+	// The oldest keys are forgotten beyond the maximum
+	later := now.Add(62 * time.Second)
+	assert.False(t, d.duplicate(msg("3"), later))
+	assert.False(t, d.duplicate(msg("4"), later))
+	assert.Equal(t, len(d.seen), 3)
+	assert.False(t, d.duplicate(msg("2"), later))
+	assert.True(t, d.duplicate(msg("4"), later))
+	assert.Equal(t, d.duplicates.Load(), uint64(3))
+}
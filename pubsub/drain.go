@@ -0,0 +1,149 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"maps"
+	"slices"
+
+	"github.com/yurivish/toolkit/sublist"
+)
+
+// ErrClosed is returned when publishing to a PubSub that has been closed or is draining.
+var ErrClosed = errors.New("pubsub: closed")
+
+// closedBit is set in PubSub.state once the PubSub is closed. The bits below it count
+// the publishes in progress, so that Drain can wait for them to return.
+const closedBit = 1 << 62
+
+// beginPublish registers a publish in progress, or returns false if the PubSub is closed.
+func (ps *PubSub) beginPublish() bool {
+	if ps.state.Add(1)&closedBit != 0 {
+		ps.endPublish()
+		return false
+	}
+	return true
+}
+
+func (ps *PubSub) endPublish() {
+	if ps.state.Add(-1) == closedBit {
+		ps.idleOnce.Do(func() { close(ps.idle) })
+	}
+}
+
+// stopPublishing rejects new publishes. Once those in progress return, ps.idle is closed.
+func (ps *PubSub) stopPublishing() {
+	if ps.state.Or(closedBit) == 0 {
+		ps.idleOnce.Do(func() { close(ps.idle) })
+	}
+}
+
+// Closed returns whether the PubSub has been closed or is draining.
+func (ps *PubSub) Closed() bool {
+	return ps.state.Load()&closedBit != 0
+}
+
+// Drain gracefully shuts down the PubSub. It stops accepting new publishes, waits for the
+// publishes in progress to return, delivers messages held by WithCoalesce and WithBatch,
+// and lets async subscribers handle the messages waiting in their mailboxes. Then it
+// closes the PubSub like Close, and waits for the channels of SubChan and SubSeq
+// subscribers to be closed. Messages buffered in those channels can still be received
+// after they are closed.
+//
+// Handlers that publish while the PubSub is draining get ErrClosed, so responses to
+// requests in flight are not delivered. If ctx is done before draining completes, the
+// PubSub is closed immediately and the context's error is returned.
+func (ps *PubSub) Drain(ctx context.Context) error {
+	ps.stopPublishing()
+	if err := waitDone(ctx, ps.idle); err != nil {
+		ps.Close()
+		return err
+	}
+	async := ps.subscribers()
+	for _, s := range async {
+		// Deliver held messages without waiting for their intervals to end
+		if s.coalesce != nil {
+			s.coalesce.flush()
+		}
+		if s.batch != nil {
+			s.batch.flush()
+		}
+		if s.mailbox != nil {
+			s.mailbox.stopWhenEmpty()
+		}
+	}
+	for _, s := range async {
+		if s.mailbox == nil {
+			continue
+		}
+		if err := waitDone(ctx, s.stopped); err != nil {
+			ps.Close()
+			return err
+		}
+	}
+	for _, s := range ps.shutdown() {
+		if s.stopped == nil {
+			continue
+		}
+		if err := waitDone(ctx, s.stopped); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close shuts down the PubSub immediately. New publishes return ErrClosed, every
+// subscription is cancelled, discarding messages waiting in the mailboxes of async
+// subscribers, every stream is deleted, closing its file store, and scheduled publishes
+// are discarded. The channels of SubChan and SubSeq subscribers are closed shortly
+// afterwards, and handlers that are running may still be running when Close returns.
+//
+// Subscribing to a closed PubSub returns a subscription that is already cancelled.
+// Close is safe to call more than once, and after Drain.
+func (ps *PubSub) Close() {
+	ps.stopPublishing()
+	ps.shutdown()
+}
+
+// shutdown cancels all subscriptions and deletes all streams,
+// returning the subscribers that were cancelled.
+func (ps *PubSub) shutdown() []*subscriber {
+	ps.stopScheduler()
+	ps.mu.Lock()
+	names := slices.Collect(maps.Keys(ps.streams))
+	ps.mu.Unlock()
+	for _, name := range names {
+		ps.DeleteStream(name)
+	}
+	subs := ps.subscribers()
+	for _, s := range subs {
+		s.cancel()
+	}
+	return subs
+}
+
+// subscribers returns the subscribers of all current subscriptions, including detached ones.
+func (ps *PubSub) subscribers() []*subscriber {
+	var subs []*sublist.Subscription
+	ps.subs.All(&subs)
+	ps.interestMu.Lock()
+	result := make([]*subscriber, len(subs), len(subs)+len(ps.detached))
+	for i, sub := range subs {
+		result[i] = sub.Value.(*subscriber)
+	}
+	for s := range ps.detached {
+		result = append(result, s)
+	}
+	ps.interestMu.Unlock()
+	return result
+}
+
+// waitDone waits for done to be closed, or returns the context's error if it is done first.
+func waitDone(ctx context.Context, done <-chan struct{}) error {
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,78 @@
+package pubsub
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/yurivish/toolkit/assert"
+)
+
+func TestDrain(t *testing.T) {
+	ps := NewPubSub()
+	var handled []int
+	Sub(ps, "nums", func(_ string, msg int) {
+		time.Sleep(time.Millisecond)
+		handled = append(handled, msg)
+	}, WithAsync(10, Block))
+	ch := SubChan[int](ps, context.Background(), "nums", 10)
+	for i := range 5 {
+		assert.Nil(t, Pub(ps, "nums", i))
+	}
+
+	assert.Nil(t, ps.Drain(context.Background()))
+	assert.Equal(t, handled, []int{0, 1, 2, 3, 4})
+	assert.True(t, ps.Closed())
+	assert.Equal(t, len(ps.Subscriptions()), 0)
+	assert.ErrorIs(t, Pub(ps, "nums", 5), ErrClosed)
+
+	// Buffered messages can be received after the channel is closed
+	var received []int
+	for msg := range ch {
+		received = append(received, msg)
+	}
+	assert.Equal(t, received, []int{0, 1, 2, 3, 4})
+}
+
+func TestDrainTimeout(t *testing.T) {
+	ps := NewPubSub()
+	release := make(chan struct{})
+	defer close(release)
+	Sub(ps, "a", func(string, int) { <-release }, WithAsync(10, Block))
+	Pub(ps, "a", 1)
+	Pub(ps, "a", 2)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	assert.ErrorIs(t, ps.Drain(ctx), context.DeadlineExceeded)
+	// The PubSub is closed regardless
+	assert.Equal(t, len(ps.Subscriptions()), 0)
+}
+
+func TestClose(t *testing.T) {
+	ps := NewPubSub()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	// A full channel whose publisher is blocked, unless it was too slow to publish
+	ch := SubChan[int](ps, ctx, "a", 1)
+	Pub(ps, "a", 1)
+	published := make(chan struct{})
+	go func() {
+		Pub(ps, "a", 2)
+		close(published)
+	}()
+
+	ps.Close()
+	<-published
+	for range ch {
+	}
+	assert.ErrorIs(t, Pub(ps, "a", 3), ErrClosed)
+	assert.ErrorIs(t, PubMsg(ps, &Msg[int]{Subject: "a"}), ErrClosed)
+
+	// Subscriptions created after closing are cancelled right away
+	Sub(ps, "a", func(string, int) {})
+	assert.Equal(t, len(ps.Subscriptions()), 0)
+	for range SubChan[int](ps, ctx, "a", 0) {
+	}
+	ps.Close()
+}
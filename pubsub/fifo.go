@@ -0,0 +1,41 @@
+package pubsub
+
+// fifo is a slice-backed queue. Popped items are cleared so that they can be garbage
+// collected, and the space they took up is reclaimed once it makes up most of the slice.
+type fifo[T any] struct {
+	items []T // Queued items from head onwards
+	head  int
+}
+
+// len returns the number of queued items.
+func (q *fifo[T]) len() int {
+	return len(q.items) - q.head
+}
+
+// all returns the queued items, oldest first. The slice is only valid until the next push or pop.
+func (q *fifo[T]) all() []T {
+	return q.items[q.head:]
+}
+
+// front returns the oldest item, which must exist.
+func (q *fifo[T]) front() T {
+	return q.items[q.head]
+}
+
+func (q *fifo[T]) push(v T) {
+	q.items = append(q.items, v)
+}
+
+// pop removes and returns the oldest item, which must exist.
+func (q *fifo[T]) pop() T {
+	var zero T
+	v := q.items[q.head]
+	q.items[q.head] = zero
+	q.head++
+	if q.head > 32 && q.head > len(q.items)/2 {
+		n := copy(q.items, q.items[q.head:])
+		clear(q.items[n:])
+		q.items, q.head = q.items[:n], 0
+	}
+	return v
+}
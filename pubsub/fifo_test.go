@@ -0,0 +1,29 @@
+package pubsub
+
+import (
+	"testing"
+
+	"github.com/yurivish/toolkit/assert"
+)
+
+func TestFifo(t *testing.T) {
+	var q fifo[int]
+	next := 0
+	// Interleave pushes and pops so that the front of the queue is reclaimed along the way
+	for i := range 1000 {
+		q.push(i)
+		if i%3 != 0 {
+			assert.Equal(t, q.pop(), next)
+			next++
+		}
+		assert.Equal(t, q.front(), next)
+		assert.Equal(t, q.len(), i+1-next)
+	}
+	assert.Equal(t, q.all()[0], next)
+	assert.True(t, len(q.items) < 2*q.len()+34)
+	for q.len() > 0 {
+		assert.Equal(t, q.pop(), next)
+		next++
+	}
+	assert.Equal(t, next, 1000)
+}
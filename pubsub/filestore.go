@@ -0,0 +1,400 @@
+package pubsub
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/yurivish/toolkit"
+)
+
+// Codec converts message data to and from bytes for persistence.
+type Codec interface {
+	Encode(data any) ([]byte, error)
+	Decode(b []byte) (any, error)
+}
+
+// JSONCodec encodes message data as JSON, decoding it into values of type M.
+func JSONCodec[M any]() Codec {
+	return jsonCodec[M]{}
+}
+
+type jsonCodec[M any] struct{}
+
+func (jsonCodec[M]) Encode(data any) ([]byte, error) { return toolkit.ToJSON(data) }
+func (jsonCodec[M]) Decode(b []byte) (any, error)    { return toolkit.FromJSON[M](b) }
+
+const (
+	segmentExt             = ".seg"
+	defaultMaxSegmentBytes = 8 << 20
+	recordHeaderSize       = 8 // uint32 body length followed by the uint32 CRC of the body
+)
+
+var (
+	crcTable         = crc32.MakeTable(crc32.Castagnoli)
+	errCorruptRecord = errors.New("pubsub: corrupt record") // The framing or checksum is wrong
+	errInvalidRecord = errors.New("pubsub: invalid record") // The checksum is right but the fields are not
+)
+
+// fileStore persists the messages of a stream as records appended to segment files
+// in a local directory. Each record is checksummed, so that a torn write at the end
+// of the newest segment is detected and discarded on recovery.
+//
+// Segments are numbered in the order they were created, and the newest is the one
+// being appended to. Older segments are deleted once all of their messages have
+// been discarded from the stream.
+type fileStore struct {
+	dir             string
+	codec           Codec
+	maxSegmentBytes int64
+	sync            bool
+	segs            []*segment // Oldest first; the last is the active segment
+	active          *os.File
+}
+
+type segment struct {
+	index             uint64
+	firstSeq, lastSeq uint64 // Zero if the segment is empty
+	size              int64
+}
+
+// openFileStore opens or creates the store in dir and returns the messages recovered from it.
+func openFileStore(opts StreamOptions) (*fileStore, []storedMsg, error) {
+	store := &fileStore{dir: opts.Dir, codec: opts.Codec, maxSegmentBytes: opts.MaxSegmentBytes, sync: opts.Sync}
+	if store.codec == nil {
+		store.codec = JSONCodec[any]()
+	}
+	if store.maxSegmentBytes <= 0 {
+		store.maxSegmentBytes = defaultMaxSegmentBytes
+	}
+	if err := os.MkdirAll(store.dir, 0o755); err != nil {
+		return nil, nil, err
+	}
+	recovered, err := store.recover()
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(store.segs) == 0 {
+		store.segs = append(store.segs, &segment{index: 1})
+	}
+	active := store.segs[len(store.segs)-1]
+	store.active, err = os.OpenFile(store.path(active.index), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, nil, err
+	}
+	return store, recovered, nil
+}
+
+func (store *fileStore) path(index uint64) string {
+	return filepath.Join(store.dir, fmt.Sprintf("%016d%s", index, segmentExt))
+}
+
+// recover reads every segment in order. A torn write at the end of the newest segment is
+// truncated, but any other unreadable record is returned as an error rather than deleted,
+// since it may hold valid data that the codec can't decode, eg. after a type has changed.
+// Records with sequence numbers at or below one already recovered are skipped, which can
+// happen if we crashed during compaction before the old segments were removed.
+func (store *fileStore) recover() ([]storedMsg, error) {
+	entries, err := os.ReadDir(store.dir)
+	if err != nil {
+		return nil, err
+	}
+	var indexes []uint64
+	for _, entry := range entries { // ReadDir returns entries sorted by name, and so by index
+		name := entry.Name()
+		if strings.HasSuffix(name, ".tmp") {
+			// An incomplete compaction
+			if err := os.Remove(filepath.Join(store.dir, name)); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		index, err := strconv.ParseUint(strings.TrimSuffix(name, segmentExt), 10, 64)
+		if err != nil || !strings.HasSuffix(name, segmentExt) {
+			continue
+		}
+		indexes = append(indexes, index)
+	}
+	var recovered []storedMsg
+	var lastSeq uint64
+	for i, index := range indexes {
+		b, err := os.ReadFile(store.path(index))
+		if err != nil {
+			return nil, err
+		}
+		seg := &segment{index: index}
+		for len(b) > 0 {
+			sm, n, err := store.decode(b)
+			if err != nil {
+				if i < len(indexes)-1 || !tornTail(b, err) {
+					return nil, fmt.Errorf("pubsub: recovering %s at offset %d: %w", store.path(index), seg.size, err)
+				}
+				// Discard the partial record
+				if err := os.Truncate(store.path(index), seg.size); err != nil {
+					return nil, err
+				}
+				break
+			}
+			b = b[n:]
+			seg.size += int64(n)
+			if seg.firstSeq == 0 {
+				seg.firstSeq = sm.seq
+			}
+			seg.lastSeq = max(seg.lastSeq, sm.seq)
+			if sm.seq > lastSeq {
+				recovered = append(recovered, sm)
+				lastSeq = sm.seq
+			}
+		}
+		store.segs = append(store.segs, seg)
+	}
+	return recovered, nil
+}
+
+// tornTail reports whether the remaining bytes of the newest segment, which failed to decode
+// with err, look like an interrupted write: a record cut short or failing its checksum that
+// runs to the end of the file, or zeros left by a file system that extended the file first.
+func tornTail(b []byte, err error) bool {
+	if !slices.ContainsFunc(b, func(c byte) bool { return c != 0 }) {
+		return true
+	}
+	if !errors.Is(err, errCorruptRecord) {
+		return false
+	}
+	return len(b) < recordHeaderSize || recordHeaderSize+int(binary.LittleEndian.Uint32(b)) >= len(b)
+}
+
+// append writes a message to the active segment, starting a new segment if it is full.
+func (store *fileStore) append(sm storedMsg) error {
+	rec, err := store.encode(sm)
+	if err != nil {
+		return err
+	}
+	seg := store.segs[len(store.segs)-1]
+	if seg.size > 0 && seg.size+int64(len(rec)) > store.maxSegmentBytes {
+		if seg, err = store.roll(); err != nil {
+			return err
+		}
+	}
+	n, err := store.active.Write(rec)
+	seg.size += int64(n)
+	if err != nil {
+		return err
+	}
+	if seg.firstSeq == 0 {
+		seg.firstSeq = sm.seq
+	}
+	seg.lastSeq = sm.seq
+	if store.sync {
+		return store.active.Sync()
+	}
+	return nil
+}
+
+// roll closes the active segment and starts a new one.
+func (store *fileStore) roll() (*segment, error) {
+	if err := store.active.Close(); err != nil {
+		return nil, err
+	}
+	seg := &segment{index: store.segs[len(store.segs)-1].index + 1}
+	f, err := os.OpenFile(store.path(seg.index), os.O_CREATE|os.O_EXCL|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	store.active = f
+	store.segs = append(store.segs, seg)
+	return seg, nil
+}
+
+// removeBefore deletes the segments whose messages all precede firstSeq.
+// The active segment is never deleted.
+func (store *fileStore) removeBefore(firstSeq uint64) error {
+	for len(store.segs) > 1 && store.segs[0].lastSeq < firstSeq {
+		if err := os.Remove(store.path(store.segs[0].index)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		store.segs = store.segs[1:]
+	}
+	return nil
+}
+
+// compact replaces all segments with a single segment holding only the given messages.
+// The new segment is written to a temporary file and renamed into place before the
+// old segments are removed, so a crash at any point leaves a recoverable store.
+func (store *fileStore) compact(msgs []storedMsg) error {
+	seg := &segment{index: store.segs[len(store.segs)-1].index + 1}
+	tmp := store.path(seg.index) + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+	for _, sm := range msgs {
+		rec, err := store.encode(sm)
+		if err == nil {
+			_, err = f.Write(rec)
+		}
+		if err != nil {
+			f.Close()
+			os.Remove(tmp)
+			return err
+		}
+		seg.size += int64(len(rec))
+		if seg.firstSeq == 0 {
+			seg.firstSeq = sm.seq
+		}
+		seg.lastSeq = sm.seq
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, store.path(seg.index)); err != nil {
+		return err
+	}
+	if err := store.active.Close(); err != nil {
+		return err
+	}
+	for _, old := range store.segs {
+		if err := os.Remove(store.path(old.index)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+	}
+	store.segs = []*segment{seg}
+	store.active, err = os.OpenFile(store.path(seg.index), os.O_WRONLY|os.O_APPEND, 0o644)
+	return err
+}
+
+func (store *fileStore) close() error {
+	return store.active.Close()
+}
+
+// encode returns the record for a message:
+//
+//	uint32 body length | uint32 CRC-32C of body | body
+//
+// where the body is made up of varint-encoded fields followed by the encoded data:
+//
+//	seq | time | subject | reply | header count | (key | value count | values...)... | data
+func (store *fileStore) encode(sm storedMsg) ([]byte, error) {
+	data, err := store.codec.Encode(sm.msg.Data)
+	if err != nil {
+		return nil, err
+	}
+	msg := sm.msg
+	rec := make([]byte, recordHeaderSize, recordHeaderSize+64+len(msg.Subject)+len(data))
+	rec = binary.AppendUvarint(rec, sm.seq)
+	rec = binary.AppendVarint(rec, msg.Time.UnixNano())
+	rec = appendString(rec, msg.Subject)
+	rec = appendString(rec, msg.Reply)
+	rec = binary.AppendUvarint(rec, uint64(len(msg.Header)))
+	for key, values := range msg.Header {
+		rec = appendString(rec, key)
+		rec = binary.AppendUvarint(rec, uint64(len(values)))
+		for _, v := range values {
+			rec = appendString(rec, v)
+		}
+	}
+	rec = append(rec, data...)
+	body := rec[recordHeaderSize:]
+	binary.LittleEndian.PutUint32(rec[0:], uint32(len(body)))
+	binary.LittleEndian.PutUint32(rec[4:], crc32.Checksum(body, crcTable))
+	return rec, nil
+}
+
+func appendString(b []byte, s string) []byte {
+	b = binary.AppendUvarint(b, uint64(len(s)))
+	return append(b, s...)
+}
+
+// decode parses the record at the start of b, returning the message and the record length.
+func (store *fileStore) decode(b []byte) (storedMsg, int, error) {
+	if len(b) < recordHeaderSize {
+		return storedMsg{}, 0, errCorruptRecord
+	}
+	n := int(binary.LittleEndian.Uint32(b[0:]))
+	if len(b)-recordHeaderSize < n {
+		return storedMsg{}, 0, errCorruptRecord
+	}
+	body := b[recordHeaderSize : recordHeaderSize+n]
+	if crc32.Checksum(body, crcTable) != binary.LittleEndian.Uint32(b[4:]) {
+		return storedMsg{}, 0, errCorruptRecord
+	}
+
+	r := recordReader{b: body}
+	sm := storedMsg{seq: r.uvarint()}
+	msg := &Msg[any]{Time: time.Unix(0, r.varint())}
+	msg.Subject = r.string()
+	msg.Reply = r.string()
+	if nkeys := r.uvarint(); nkeys > 0 {
+		msg.Header = Header{}
+		for range nkeys {
+			key := r.string()
+			for range r.uvarint() {
+				msg.Header.Add(key, r.string())
+			}
+			if r.err != nil {
+				break
+			}
+		}
+	}
+	if r.err != nil {
+		return storedMsg{}, 0, r.err
+	}
+	data, err := store.codec.Decode(r.b)
+	if err != nil {
+		return storedMsg{}, 0, err
+	}
+	msg.Data = data
+	sm.msg = msg
+	return sm, recordHeaderSize + n, nil
+}
+
+// recordReader reads varint-encoded fields from a record body,
+// remembering the first error so that it can be checked once at the end.
+type recordReader struct {
+	b   []byte
+	err error
+}
+
+func (r *recordReader) uvarint() uint64 {
+	v, n := binary.Uvarint(r.b)
+	if n <= 0 {
+		r.err, r.b = errInvalidRecord, nil
+		return 0
+	}
+	r.b = r.b[n:]
+	return v
+}
+
+func (r *recordReader) varint() int64 {
+	v, n := binary.Varint(r.b)
+	if n <= 0 {
+		r.err, r.b = errInvalidRecord, nil
+		return 0
+	}
+	r.b = r.b[n:]
+	return v
+}
+
+func (r *recordReader) string() string {
+	n := r.uvarint()
+	if n > uint64(len(r.b)) {
+		r.err, r.b = errInvalidRecord, nil
+		return _EMPTY_
+	}
+	s := string(r.b[:n])
+	r.b = r.b[n:]
+	return s
+}
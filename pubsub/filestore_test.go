@@ -0,0 +1,180 @@
+package pubsub
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/yurivish/toolkit/assert"
+)
+
+func segments(t *testing.T, dir string) []string {
+	t.Helper()
+	names, err := filepath.Glob(filepath.Join(dir, "*"+segmentExt))
+	assert.Nil(t, err)
+	return names
+}
+
+func TestFileStoreRecover(t *testing.T) {
+	dir := t.TempDir()
+	ps := NewPubSub()
+	st, err := ps.AddStream("s", []string{"s.>"}, StreamLimits{}, WithFileStore(dir, JSONCodec[string]()))
+	assert.Nil(t, err)
+	PubMsg(ps, &Msg[string]{Subject: "s.a", Header: Header{"k": {"v1", "v2"}}, Data: "one"})
+	Pub(ps, "s.b", "two")
+	Pub(ps, "s.a", "three")
+	assert.True(t, ps.DeleteStream("s"))
+
+	ps = NewPubSub()
+	st, err = ps.AddStream("s", []string{"s.>"}, StreamLimits{}, WithFileStore(dir, JSONCodec[string]()))
+	assert.Nil(t, err)
+	info := st.Info()
+	assert.Equal(t, info.Msgs, 3)
+	assert.Equal(t, info.LastSeq, uint64(3))
+	assert.Equal(t, st.NumPending("s.a"), uint64(2))
+	msg, ok := st.Get(1)
+	assert.True(t, ok)
+	assert.Equal(t, msg.Subject, "s.a")
+	assert.Equal(t, msg.Data, any("one"))
+	assert.Equal(t, msg.Header.Values("k"), []string{"v1", "v2"})
+	assert.False(t, msg.Time.IsZero())
+
+	// Sequence numbers carry on from where they left off
+	Pub(ps, "s.c", "four")
+	seqs, data, cancel := streamMsgs[string](st, ">", DeliverAll())
+	defer cancel()
+	assert.Equal(t, *seqs, []uint64{1, 2, 3, 4})
+	assert.Equal(t, *data, []string{"one", "two", "three", "four"})
+	assert.Nil(t, st.Err())
+}
+
+func TestFileStoreCorruptTail(t *testing.T) {
+	dir := t.TempDir()
+	ps := NewPubSub()
+	_, err := ps.AddStream("s", []string{"s"}, StreamLimits{}, WithFileStore(dir, nil))
+	assert.Nil(t, err)
+	for i := range 5 {
+		Pub(ps, "s", i)
+	}
+	ps.DeleteStream("s")
+
+	// Simulate a torn write by chopping the last record in half
+	names := segments(t, dir)
+	assert.Equal(t, len(names), 1)
+	b, err := os.ReadFile(names[0])
+	assert.Nil(t, err)
+	assert.Nil(t, os.WriteFile(names[0], b[:len(b)-3], 0o644))
+
+	ps = NewPubSub()
+	st, err := ps.AddStream("s", []string{"s"}, StreamLimits{}, WithFileStore(dir, nil))
+	assert.Nil(t, err)
+	assert.Equal(t, st.Info().LastSeq, uint64(4))
+	msg, _ := st.Get(4)
+	assert.Equal(t, msg.Data, any(float64(3))) // The default codec decodes into generic JSON values
+
+	// New records are appended after the truncated tail
+	Pub(ps, "s", 5)
+	ps.DeleteStream("s")
+	ps = NewPubSub()
+	st, _ = ps.AddStream("s", []string{"s"}, StreamLimits{}, WithFileStore(dir, nil))
+	assert.Equal(t, st.Info().Msgs, 5)
+
+	// A flipped bit fails the checksum
+	b, _ = os.ReadFile(names[0])
+	b[len(b)-1] ^= 1
+	assert.Nil(t, os.WriteFile(names[0], b, 0o644))
+	ps.DeleteStream("s")
+	ps = NewPubSub()
+	st, _ = ps.AddStream("s", []string{"s"}, StreamLimits{}, WithFileStore(dir, nil))
+	assert.Equal(t, st.Info().Msgs, 4)
+}
+
+func TestFileStoreDecodeError(t *testing.T) {
+	dir := t.TempDir()
+	ps := NewPubSub()
+	_, err := ps.AddStream("s", []string{"s"}, StreamLimits{}, WithFileStore(dir, JSONCodec[string]()), WithSegmentSize(100))
+	assert.Nil(t, err)
+	for _, s := range []string{"one", "two", "three", "four", "five"} {
+		Pub(ps, "s", s)
+	}
+	ps.DeleteStream("s")
+	names := segments(t, dir)
+	assert.True(t, len(names) > 1)
+	before := make([][]byte, len(names))
+	for i, name := range names {
+		before[i], err = os.ReadFile(name)
+		assert.Nil(t, err)
+	}
+
+	// Records that the codec can't decode are reported rather than discarded
+	ps = NewPubSub()
+	_, err = ps.AddStream("s", []string{"s"}, StreamLimits{}, WithFileStore(dir, JSONCodec[int]()))
+	assert.NotNil(t, err)
+	for i, name := range names {
+		b, err := os.ReadFile(name)
+		assert.Nil(t, err)
+		assert.Equal(t, b, before[i])
+	}
+
+	// So are corrupt records in older segments, which can't be torn writes
+	corrupted := slices.Clone(before[0])
+	corrupted[len(corrupted)-1] ^= 1
+	assert.Nil(t, os.WriteFile(names[0], corrupted, 0o644))
+	_, err = ps.AddStream("s", []string{"s"}, StreamLimits{}, WithFileStore(dir, JSONCodec[string]()))
+	assert.ErrorIs(t, err, errCorruptRecord)
+	b, _ := os.ReadFile(names[0])
+	assert.Equal(t, b, corrupted)
+
+	// The data is intact once the right codec is used
+	assert.Nil(t, os.WriteFile(names[0], before[0], 0o644))
+	st, err := ps.AddStream("s", []string{"s"}, StreamLimits{}, WithFileStore(dir, JSONCodec[string]()))
+	assert.Nil(t, err)
+	assert.Equal(t, st.Info().Msgs, 5)
+}
+
+func TestFileStoreSegments(t *testing.T) {
+	dir := t.TempDir()
+	ps := NewPubSub()
+	st, err := ps.AddStream("s", []string{"s"}, StreamLimits{MaxMsgs: 10}, WithFileStore(dir, nil), WithSegmentSize(100))
+	assert.Nil(t, err)
+	for i := range 100 {
+		Pub(ps, "s", i)
+	}
+	// Segments holding only discarded messages are removed
+	n := len(segments(t, dir))
+	assert.True(t, n > 1 && n <= 10)
+	ps.DeleteStream("s")
+
+	ps = NewPubSub()
+	st, _ = ps.AddStream("s", []string{"s"}, StreamLimits{MaxMsgs: 10}, WithFileStore(dir, nil), WithSegmentSize(100))
+	info := st.Info()
+	assert.Equal(t, info.Msgs, 10)
+	assert.Equal(t, info.FirstSeq, uint64(91))
+	assert.Equal(t, info.LastSeq, uint64(100))
+}
+
+func TestFileStoreCompact(t *testing.T) {
+	dir := t.TempDir()
+	ps := NewPubSub()
+	st, err := ps.AddStream("s", []string{"s.*"}, StreamLimits{}, WithFileStore(dir, JSONCodec[int]()), WithSegmentSize(100))
+	assert.Nil(t, err)
+	for i := range 30 {
+		Pub(ps, []string{"s.a", "s.b", "s.c"}[i%3], i)
+	}
+	assert.Nil(t, st.Compact())
+	assert.Equal(t, len(segments(t, dir)), 1)
+	seqs, data, cancel := streamMsgs[int](st, ">", DeliverAll())
+	cancel()
+	assert.Equal(t, *seqs, []uint64{28, 29, 30})
+	assert.Equal(t, *data, []int{27, 28, 29})
+
+	Pub(ps, "s.a", 30)
+	ps.DeleteStream("s")
+	ps = NewPubSub()
+	st, _ = ps.AddStream("s", []string{"s.*"}, StreamLimits{}, WithFileStore(dir, JSONCodec[int]()))
+	seqs, data, cancel = streamMsgs[int](st, ">", DeliverAll())
+	cancel()
+	assert.Equal(t, *seqs, []uint64{28, 29, 30, 31})
+	assert.Equal(t, *data, []int{27, 28, 29, 30})
+}
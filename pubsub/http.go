@@ -0,0 +1,107 @@
+package pubsub
+
+import (
+	"cmp"
+	"html/template"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/yurivish/toolkit/req"
+	"github.com/yurivish/toolkit/sublist"
+)
+
+// Introspection is the response body of the Handler endpoint.
+type Introspection struct {
+	Filter        string
+	Stats         *sublist.SublistStats
+	Dropped       uint64
+	Duplicates    uint64
+	Subscriptions []SubInfo
+	Schemas       []SchemaInfo
+}
+
+// Handler returns an http.Handler that lists the active subscriptions along with their
+// call sites and delivery counters, as well as the statistics of the underlying sublist.
+//
+// The ?filter= query parameter restricts the list to subscriptions that could receive
+// messages matching a subject wildcard, so ?filter=orders.eu.> includes subscriptions
+// to both orders.eu.* and orders.>. The response is JSON, or an HTML table for browsers.
+func (ps *PubSub) Handler() http.Handler {
+	return req.Handle(func(r *req.Req, in struct {
+		Filter *string `query:"filter"`
+	}) error {
+		filter := ">"
+		if in.Filter != nil && *in.Filter != _EMPTY_ {
+			filter = *in.Filter
+		}
+		if !sublist.IsValidSubject(filter) {
+			return req.HTTPError(http.StatusBadRequest, "invalid filter subject")
+		}
+		var subs []SubInfo
+		for _, info := range ps.Subscriptions() {
+			if sublist.SubjectsCollide(info.Subject, filter) {
+				subs = append(subs, info)
+			}
+		}
+		slices.SortFunc(subs, func(a, b SubInfo) int {
+			return cmp.Or(cmp.Compare(a.Subject, b.Subject), cmp.Compare(a.File, b.File), cmp.Compare(a.Line, b.Line))
+		})
+		page := Introspection{Filter: filter, Stats: ps.subs.Stats(), Dropped: ps.Dropped(), Duplicates: ps.Duplicates(), Subscriptions: subs}
+		for _, schema := range ps.Schemas() {
+			if sublist.SubjectsCollide(schema.Pattern, filter) {
+				page.Schemas = append(page.Schemas, schema)
+			}
+		}
+		if !strings.Contains(r.R.Header.Get("Accept"), "text/html") {
+			return r.JSON(page)
+		}
+		var b strings.Builder
+		if err := introspectionPage.Execute(&b, page); err != nil {
+			return err
+		}
+		return r.HTML(b.String())
+	})
+}
+
+var introspectionPage = template.Must(template.New("subscriptions").Parse(`<!doctype html>
+<title>Subscriptions</title>
+<style>
+body { font: 14px system-ui, sans-serif; margin: 1em; }
+table { border-collapse: collapse; }
+th, td { padding: 2px 8px; text-align: left; border-bottom: 1px solid #ddd; }
+td.n { text-align: right; font-variant-numeric: tabular-nums; }
+code { font-size: 12px; }
+</style>
+<form><input name="filter" value="{{.Filter}}"> <button>Filter</button></form>
+{{with .Stats}}
+<p>{{.NumSubs}} subscriptions, {{.NumInserts}} inserts, {{.NumRemoves}} removes, {{.NumMatches}} matches,
+{{.NumCache}} cached results with a {{printf "%.1f" .CacheHitRate}} hit rate, fanout {{printf "%.1f" .AvgFanout}} average and {{.MaxFanout}} max.
+{{end}}
+{{.Dropped}} messages dropped in total{{with .Duplicates}}, and {{.}} duplicates{{end}}.</p>
+<table>
+<tr><th>Subject</th><th>Queue</th><th>ID</th><th>Subscribed at</th><th>Delivered</th><th>Dropped</th><th>In flight</th><th>Panics</th><th>Last delivery</th></tr>
+{{range .Subscriptions}}
+<tr>
+<td>{{.Subject}}{{if .Debug}} (debug){{end}}{{if .Async}} (async){{end}}</td>
+<td>{{.Queue}}</td>
+<td>{{.ID}}</td>
+<td><code>{{.FuncName}}<br>{{.File}}:{{.Line}}</code></td>
+<td class="n">{{.Delivered}}</td>
+<td class="n">{{.Dropped}}</td>
+<td class="n">{{.InFlight}}</td>
+<td class="n">{{.Panics}}</td>
+<td>{{if not .LastDelivery.IsZero}}{{.LastDelivery.Format "2006-01-02 15:04:05.000"}}{{end}}</td>
+</tr>
+{{end}}
+</table>
+{{with .Schemas}}
+<h3>Schemas</h3>
+<table>
+<tr><th>Pattern</th><th>Type</th><th>Registered at</th></tr>
+{{range .}}
+<tr><td>{{.Pattern}}</td><td><code>{{.Type}}</code></td><td><code>{{.File}}:{{.Line}}</code></td></tr>
+{{end}}
+</table>
+{{end}}
+`))
@@ -0,0 +1,103 @@
+package pubsub
+
+import (
+	"bufio"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/yurivish/toolkit"
+	"github.com/yurivish/toolkit/assert"
+)
+
+func TestHandler(t *testing.T) {
+	ps := NewPubSub()
+	Sub(ps, "orders.>", func(string, int) {}, WithID("all-orders"))
+	Sub(ps, "orders.eu.*", func(string, int) {}, WithQueueGroup("workers"))
+	Sub(ps, "users.*", func(string, int) {})
+	Pub(ps, "orders.eu.1", 1)
+
+	get := func(url, accept string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", url, nil)
+		r.Header.Set("Accept", accept)
+		w := httptest.NewRecorder()
+		ps.Handler().ServeHTTP(w, r)
+		return w
+	}
+
+	w := get("/?filter=orders.eu.>", "application/json")
+	assert.Equal(t, w.Code, http.StatusOK)
+	page, err := toolkit.FromJSON[Introspection](w.Body.Bytes())
+	assert.Nil(t, err)
+	assert.Equal(t, len(page.Subscriptions), 2)
+	assert.Equal(t, page.Stats.NumSubs, uint32(3))
+	info := page.Subscriptions[0]
+	assert.Equal(t, info.Subject, "orders.>")
+	assert.Equal(t, info.ID, "all-orders")
+	assert.Equal(t, info.Delivered, uint64(1))
+	assert.False(t, info.LastDelivery.IsZero())
+	assert.MatchesRegexp(t, info.File, `http_test\.go$`)
+	assert.MatchesRegexp(t, info.FuncName, `TestHandler$`)
+	assert.Equal(t, page.Subscriptions[1].Queue, "workers")
+
+	w = get("/", "text/html")
+	assert.MatchesRegexp(t, w.Body.String(), `users\.\*`)
+	assert.Equal(t, get("/?filter=a..b", "").Code, http.StatusBadRequest)
+}
+
+func TestTapHandler(t *testing.T) {
+	ps := NewPubSub()
+	Sub(ps, "orders.*", func(string, map[string]int) {}, WithID("orders"))
+	srv := httptest.NewServer(ps.TapHandler())
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + "?filter=orders.>")
+	assert.Nil(t, err)
+	resp.Body.Close()
+	assert.MatchesRegexp(t, resp.Header.Get("Content-Type"), "text/html")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	r, _ := http.NewRequestWithContext(ctx, "GET", srv.URL+"?filter=orders.>", nil)
+	r.Header.Set("Datastar-Request", "true")
+	resp, err = http.DefaultClient.Do(r)
+	assert.Nil(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, resp.Header.Get("Content-Type"), "text/event-stream")
+
+	// Wait for the tap to subscribe
+	for len(ps.Subscriptions()) < 2 {
+		time.Sleep(time.Millisecond)
+	}
+	Pub(ps, "users.1", map[string]int{"id": 0})
+	Pub(ps, "orders.1", map[string]int{"id": 1})
+	var event strings.Builder
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() && scanner.Text() != _EMPTY_ {
+		event.WriteString(scanner.Text() + "\n")
+	}
+	assert.MatchesRegexp(t, event.String(), `event: datastar-patch-elements`)
+	assert.MatchesRegexp(t, event.String(), `<td>orders\.1</td>`)
+	assert.MatchesRegexp(t, event.String(), `\{&#34;id&#34;:1\}`)
+	assert.MatchesRegexp(t, event.String(), `orders\.\* \[orders\]`)
+	assert.False(t, strings.Contains(event.String(), "$TAP"))
+}
+
+func TestRateLimiter(t *testing.T) {
+	l := newRateLimiter(2)
+	now := time.Now()
+	assert.True(t, l.allow(now))
+	assert.True(t, l.allow(now))
+	assert.False(t, l.allow(now))
+	assert.False(t, l.allow(now.Add(time.Second/4)))
+	assert.True(t, l.allow(now.Add(time.Second/2)))
+	assert.False(t, l.allow(now.Add(time.Second/2)))
+	// Tokens accumulate up to one second's worth
+	now = now.Add(time.Hour)
+	assert.True(t, l.allow(now))
+	assert.True(t, l.allow(now))
+	assert.False(t, l.allow(now))
+}
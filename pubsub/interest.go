@@ -0,0 +1,87 @@
+package pubsub
+
+import (
+	"context"
+
+	"github.com/yurivish/toolkit/sublist"
+)
+
+// interestWatcher tracks the number of subscriptions that overlap a subject.
+type interestWatcher struct {
+	subject string
+	count   int
+	ch      chan bool
+}
+
+// WatchInterest returns a channel that receives true when the first subscription that would
+// receive messages published to subject is added, and false when the last one is removed.
+// Unlike sublist notifications, wildcard subscriptions count, so a subscription to orders.>
+// expresses interest in orders.eu.created. The current state is sent immediately.
+//
+// The channel holds only the latest state, so slow readers skip intermediate changes
+// rather than blocking subscribers. It is closed once ctx is done.
+//
+// This lets producers avoid computing expensive messages that no one is listening to.
+func (ps *PubSub) WatchInterest(ctx context.Context, subject string) <-chan bool {
+	if !IsValidPubSubject(subject) {
+		panic(sublist.ErrInvalidSubject) // invalid subjects are programmer error, as with Sub.
+	}
+	return ps.watchInterest(ctx, subject)
+}
+
+// WatchInterestOverlap is like WatchInterest, but the subject may contain wildcards,
+// and there is interest whenever any subscription overlaps it (see sublist.SubjectsCollide).
+// For example, a subscription to orders.*.created overlaps orders.eu.>.
+func (ps *PubSub) WatchInterestOverlap(ctx context.Context, subject string) <-chan bool {
+	if !sublist.IsValidSubject(subject) {
+		panic(sublist.ErrInvalidSubject)
+	}
+	return ps.watchInterest(ctx, subject)
+}
+
+func (ps *PubSub) watchInterest(ctx context.Context, subject string) <-chan bool {
+	w := &interestWatcher{subject: subject, ch: make(chan bool, 1)}
+	ps.interestMu.Lock()
+	var subs []*sublist.Subscription
+	ps.subs.All(&subs)
+	for _, sub := range subs {
+		if sublist.SubjectsCollide(subject, string(sub.Subject)) {
+			w.count++
+		}
+	}
+	w.ch <- w.count > 0
+	if ps.watchers == nil {
+		ps.watchers = make(map[*interestWatcher]struct{})
+	}
+	ps.watchers[w] = struct{}{}
+	ps.interestMu.Unlock()
+
+	go func() {
+		<-ctx.Done()
+		ps.interestMu.Lock()
+		delete(ps.watchers, w)
+		close(w.ch)
+		ps.interestMu.Unlock()
+	}()
+	return w.ch
+}
+
+// interestChanged updates the watchers whose subjects overlap that of an inserted (delta = 1)
+// or removed (delta = -1) subscription. interestMu should be held.
+func (ps *PubSub) interestChanged(subject string, delta int) {
+	for w := range ps.watchers {
+		if !sublist.SubjectsCollide(w.subject, subject) {
+			continue
+		}
+		before := w.count > 0
+		w.count += delta
+		if after := w.count > 0; after != before {
+			// Replace any state the reader has yet to receive
+			select {
+			case <-w.ch:
+			default:
+			}
+			w.ch <- after
+		}
+	}
+}
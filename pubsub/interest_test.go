@@ -0,0 +1,51 @@
+package pubsub
+
+import (
+	"context"
+	"testing"
+
+	"github.com/yurivish/toolkit/assert"
+)
+
+func TestWatchInterest(t *testing.T) {
+	ps := NewPubSub()
+	ctx, cancel := context.WithCancel(context.Background())
+	ch := ps.WatchInterest(ctx, "orders.eu.created")
+	assert.False(t, <-ch)
+
+	unsub1 := Sub(ps, "orders.>", func(string, int) {})
+	assert.True(t, <-ch)
+	unsub2 := Sub(ps, "orders.*.created", func(string, int) {})
+	Sub(ps, "orders.us.created", func(string, int) {})
+	unsub1()
+	unsub1()
+	assert.Equal(t, len(ch), 0) // Still interested
+	unsub2()
+	assert.False(t, <-ch)
+
+	// Only the latest state is kept
+	unsub1 = Sub(ps, "orders.eu.created", func(string, int) {})
+	unsub1()
+	assert.False(t, <-ch)
+	assert.Equal(t, len(ch), 0)
+
+	cancel()
+	_, ok := <-ch
+	assert.False(t, ok)
+}
+
+func TestWatchInterestOverlap(t *testing.T) {
+	ps := NewPubSub()
+	Sub(ps, "users.*", func(string, int) {})
+	ch := ps.WatchInterestOverlap(context.Background(), "orders.eu.>")
+	assert.False(t, <-ch)
+	unsub := Sub(ps, "orders.*.created", func(string, int) {})
+	assert.True(t, <-ch)
+	unsub()
+	assert.False(t, <-ch)
+
+	ch = ps.WatchInterestOverlap(context.Background(), "users.1.>")
+	assert.False(t, <-ch) // users.* does not overlap users.1.>
+	ch = ps.WatchInterestOverlap(context.Background(), "*.1")
+	assert.True(t, <-ch)
+}
@@ -0,0 +1,87 @@
+package pubsub
+
+import (
+	"context"
+	"time"
+)
+
+// Msg is a message envelope carrying metadata alongside the message itself.
+// Handlers registered with SubMsg receive the full envelope, while handlers
+// registered with Sub receive only the subject and data.
+type Msg[M any] struct {
+	Subject string    // Subject the message was published to
+	Reply   string    // Optional reply subject for request/reply (see Request)
+	Header  Header    // Optional headers, eg. trace IDs or a content type
+	Time    time.Time // Publish time, filled in by the publisher if zero
+	Data    M
+}
+
+// Header holds message headers. Like NATS headers (and unlike HTTP headers),
+// keys are case-sensitive.
+//
+// Headers are shared between all subscribers that receive a message, so
+// handlers should treat them as read-only.
+type Header map[string][]string
+
+// Get returns the first value associated with key, or "" if there are none.
+func (h Header) Get(key string) string {
+	if vs := h[key]; len(vs) > 0 {
+		return vs[0]
+	}
+	return _EMPTY_
+}
+
+// Values returns all values associated with key.
+func (h Header) Values(key string) []string {
+	return h[key]
+}
+
+// Set replaces any existing values associated with key with the single value.
+func (h Header) Set(key, value string) {
+	h[key] = []string{value}
+}
+
+// Add appends a value to those associated with key.
+func (h Header) Add(key, value string) {
+	h[key] = append(h[key], value)
+}
+
+// Del deletes the values associated with key.
+func (h Header) Del(key string) {
+	delete(h, key)
+}
+
+// PubMsg publishes a message envelope. The envelope's subject is used as the publish subject,
+// and its time is set to the current time if it is zero.
+func PubMsg[M any](ps *PubSub, msg *Msg[M]) error {
+	return ps.publish(&Msg[any]{Subject: msg.Subject, Reply: msg.Reply, Header: msg.Header, Time: msg.Time, Data: msg.Data})
+}
+
+// SubMsg is like Sub, but the handler receives the full message envelope.
+// Each handler call receives its own envelope, though the header map is shared.
+func SubMsg[M any](ps *PubSub, subj string, handler func(*Msg[M]), options ...SubOption) context.CancelFunc {
+	options = append(options, WithSkip(1)) // Skip this stack frame when recording the subscriber
+	return sub(ps, subj, func(msg *Msg[any]) {
+		handler(msgAs[M](msg))
+	}, options...)
+}
+
+// PubMsgCtx is like PubMsg, but propagates the trace context of ctx to subscribers
+// in the traceparent header (see ContextWithTrace and SubMsgCtx).
+func PubMsgCtx[M any](ctx context.Context, ps *PubSub, msg *Msg[M]) error {
+	return ps.publishCtx(ctx, &Msg[any]{Subject: msg.Subject, Reply: msg.Reply, Header: msg.Header, Time: msg.Time, Data: msg.Data})
+}
+
+// SubMsgCtx is like SubMsg, but the handler also receives a context carrying the trace
+// context propagated from the publisher, as extended by the PubSub's Observer, if any.
+func SubMsgCtx[M any](ps *PubSub, subj string, handler func(context.Context, *Msg[M]), options ...SubOption) context.CancelFunc {
+	options = append(options, WithSkip(1))
+	return sub(ps, subj, func(ctx context.Context, msg *Msg[any]) {
+		handler(ctx, msgAs[M](msg))
+	}, options...)
+}
+
+// msgAs converts an envelope back to the subscriber's message type.
+func msgAs[M any](msg *Msg[any]) *Msg[M] {
+	return &Msg[M]{Subject: msg.Subject, Reply: msg.Reply, Header: msg.Header, Time: msg.Time, Data: as[M](msg.Data)}
+}
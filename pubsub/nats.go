@@ -0,0 +1,590 @@
+package pubsub
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/yurivish/toolkit/sublist"
+)
+
+// NATSServerOptions configure a NATSServer.
+type NATSServerOptions struct {
+	Name       string // Reported to clients in the INFO message
+	MaxPayload int    // Largest message clients may publish, 1MB by default
+	MaxPending int    // Bytes buffered for a client before it is disconnected as a slow consumer, 64MB by default
+	Codec      Codec  // Encodes data published in-process that is not a []byte or string; JSONCodec[any]() by default
+}
+
+type NATSServerOption func(*NATSServerOptions)
+
+// WithNATSName sets the server name reported to clients.
+func WithNATSName(name string) NATSServerOption {
+	return func(o *NATSServerOptions) {
+		o.Name = name
+	}
+}
+
+// WithNATSMaxPayload sets the largest message clients may publish.
+func WithNATSMaxPayload(n int) NATSServerOption {
+	return func(o *NATSServerOptions) {
+		o.MaxPayload = n
+	}
+}
+
+// WithNATSMaxPending sets the number of bytes buffered for a client
+// before it is disconnected as a slow consumer.
+func WithNATSMaxPending(n int) NATSServerOption {
+	return func(o *NATSServerOptions) {
+		o.MaxPending = n
+	}
+}
+
+// WithNATSCodec sets the codec used to encode in-process messages for clients.
+func WithNATSCodec(codec Codec) NATSServerOption {
+	return func(o *NATSServerOptions) {
+		o.Codec = codec
+	}
+}
+
+// NATSServer bridges a PubSub to other processes by speaking the core NATS text protocol
+// (CONNECT, PUB, HPUB, SUB, UNSUB, MSG, HMSG, PING and PONG), so that stock NATS clients
+// can publish to and subscribe from the in-process bus.
+//
+// Messages published by clients are delivered in-process with []byte data. Messages
+// published in-process are sent to clients as is if their data is a []byte or string,
+// and encoded with the server's codec otherwise. Headers are passed through in both
+// directions for clients that support them.
+//
+// Each client subscription is an ordinary subscription to the PubSub, which shows up
+// in Subscriptions with an ID of the form "nats:<client>:<sid>".
+type NATSServer struct {
+	ps   *PubSub
+	opts NATSServerOptions
+	info []byte // The INFO line sent to each client
+	ids  atomic.Uint64
+
+	mu        sync.Mutex // Guards the fields below
+	closed    bool
+	listeners map[net.Listener]struct{}
+	conns     map[*natsConn]struct{}
+}
+
+// NewNATSServer creates a server for the given PubSub. Call Serve to accept connections.
+func NewNATSServer(ps *PubSub, options ...NATSServerOption) *NATSServer {
+	opts := NATSServerOptions{MaxPayload: 1 << 20, MaxPending: 64 << 20}
+	for _, opt := range options {
+		opt(&opts)
+	}
+	if opts.Codec == nil {
+		opts.Codec = JSONCodec[any]()
+	}
+	info, err := json.Marshal(map[string]any{
+		"server_id":   rand.Text(),
+		"server_name": opts.Name,
+		"version":     "2.10.0", // The protocol features we support; clients use this to enable them
+		"proto":       1,
+		"headers":     true,
+		"max_payload": opts.MaxPayload,
+	})
+	if err != nil {
+		panic(err)
+	}
+	return &NATSServer{
+		ps:        ps,
+		opts:      opts,
+		info:      fmt.Appendf(nil, "INFO %s\r\n", info),
+		listeners: make(map[net.Listener]struct{}),
+		conns:     make(map[*natsConn]struct{}),
+	}
+}
+
+// ListenAndServe listens on the given network ("tcp" or "unix") and address and calls Serve.
+func (s *NATSServer) ListenAndServe(network, address string) error {
+	l, err := net.Listen(network, address)
+	if err != nil {
+		return err
+	}
+	return s.Serve(l)
+}
+
+// Serve accepts connections on the listener until it fails or the server is closed,
+// in which case it returns net.ErrClosed. The listener is closed when Serve returns.
+func (s *NATSServer) Serve(l net.Listener) error {
+	defer l.Close()
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return net.ErrClosed
+	}
+	s.listeners[l] = struct{}{}
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.listeners, l)
+		s.mu.Unlock()
+	}()
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			s.mu.Lock()
+			closed := s.closed
+			s.mu.Unlock()
+			if closed {
+				return net.ErrClosed
+			}
+			return err
+		}
+		c := &natsConn{
+			srv:   s,
+			conn:  conn,
+			id:    s.ids.Add(1),
+			flush: make(chan struct{}, 1),
+			done:  make(chan struct{}),
+			subs:  make(map[string]*natsSub),
+		}
+		c.echo.Store(true)
+		s.mu.Lock()
+		if s.closed {
+			s.mu.Unlock()
+			conn.Close()
+			return net.ErrClosed
+		}
+		s.conns[c] = struct{}{}
+		s.mu.Unlock()
+		go c.run()
+	}
+}
+
+// Close stops all listeners and disconnects all clients, cancelling their subscriptions.
+func (s *NATSServer) Close() error {
+	s.mu.Lock()
+	s.closed = true
+	for l := range s.listeners {
+		l.Close()
+	}
+	conns := make([]*natsConn, 0, len(s.conns))
+	for c := range s.conns {
+		conns = append(conns, c)
+	}
+	s.mu.Unlock()
+	for _, c := range conns {
+		c.close()
+	}
+	return nil
+}
+
+// NumClients returns the number of connected clients.
+func (s *NATSServer) NumClients() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.conns)
+}
+
+// Protocol errors. Those marked as fatal close the connection after being sent.
+var (
+	errNATSUnknownOp     = errors.New("Unknown Protocol Operation") // fatal
+	errNATSParse         = errors.New("Protocol Parse Error")       // fatal
+	errNATSMaxPayload    = errors.New("Maximum Payload Violation")  // fatal
+	errNATSSlowConsumer  = errors.New("Slow Consumer")              // fatal
+	errNATSPubSubject    = errors.New("Invalid Publish Subject")
+	errNATSSubject       = errors.New("Invalid Subject")
+	errNATSNoHeaders     = errors.New("Headers Not Supported")
+	errNATSHeaderParsing = errors.New("Header Parse Error")
+	errNATSClosed        = errors.New("Server Shutting Down")
+)
+
+const maxControlLine = 4096
+
+// natsConn is a single client connection.
+type natsConn struct {
+	srv  *NATSServer
+	conn net.Conn
+	id   uint64
+
+	// Set by CONNECT. Headers and echo are atomic since they are read during delivery.
+	verbose bool
+	headers atomic.Bool
+	echo    atomic.Bool
+
+	publishing atomic.Pointer[Msg[any]] // The message this client is publishing, to suppress echoes
+
+	mu     sync.Mutex // Guards the fields below
+	out    []byte     // Pending output, written by the writer goroutine
+	closed bool
+	subs   map[string]*natsSub // By sid
+
+	flush     chan struct{} // Signals the writer goroutine that there is output
+	done      chan struct{} // Closed when the connection is closed
+	closeOnce sync.Once
+}
+
+type natsSub struct {
+	cancel    context.CancelFunc
+	max       atomic.Uint64 // Number of messages after which to unsubscribe, or zero
+	delivered atomic.Uint64
+}
+
+func (c *natsConn) run() {
+	defer c.close()
+	go c.write()
+	c.send(c.srv.info)
+	r := bufio.NewReaderSize(c.conn, maxControlLine)
+	for {
+		line, err := r.ReadSlice('\n')
+		if err != nil {
+			if errors.Is(err, bufio.ErrBufferFull) {
+				c.sendErr(errNATSParse)
+			}
+			return
+		}
+		op, args, _ := strings.Cut(string(bytes.TrimRight(line, "\r\n")), " ")
+		op = strings.ToUpper(op)
+		if err := c.process(r, op, args); err != nil {
+			c.sendErr(err)
+			switch err {
+			case errNATSUnknownOp, errNATSParse, errNATSMaxPayload:
+				return
+			}
+		} else if c.verbose && op != "PING" && op != "PONG" {
+			c.send([]byte("+OK\r\n"))
+		}
+	}
+}
+
+// process handles a single protocol operation, reading its payload if it has one.
+func (c *natsConn) process(r *bufio.Reader, op, args string) error {
+	fields := strings.Fields(args)
+	switch op {
+	case "PING":
+		c.send([]byte("PONG\r\n"))
+	case "PONG":
+	case "CONNECT":
+		var opts struct {
+			Verbose bool  `json:"verbose"`
+			Headers bool  `json:"headers"`
+			Echo    *bool `json:"echo"`
+		}
+		if err := json.Unmarshal([]byte(args), &opts); err != nil {
+			return errNATSParse
+		}
+		c.verbose = opts.Verbose
+		c.headers.Store(opts.Headers)
+		c.echo.Store(opts.Echo == nil || *opts.Echo)
+	case "PUB":
+		// PUB <subject> [reply] <#bytes>
+		if len(fields) < 2 || len(fields) > 3 {
+			return errNATSParse
+		}
+		size, err := c.payloadSize(fields[len(fields)-1])
+		if err != nil {
+			return err
+		}
+		payload, err := readPayload(r, size)
+		if err != nil {
+			return err
+		}
+		return c.publish(fields[0], fields[1:len(fields)-1], nil, payload)
+	case "HPUB":
+		// HPUB <subject> [reply] <#header bytes> <#total bytes>
+		if len(fields) < 3 || len(fields) > 4 {
+			return errNATSParse
+		}
+		hdrSize, err := strconv.Atoi(fields[len(fields)-2])
+		if err != nil {
+			return errNATSParse
+		}
+		size, err := c.payloadSize(fields[len(fields)-1])
+		if err != nil {
+			return err
+		}
+		if hdrSize < 0 || hdrSize > size {
+			return errNATSParse
+		}
+		payload, err := readPayload(r, size)
+		if err != nil {
+			return err
+		}
+		if !c.headers.Load() {
+			return errNATSNoHeaders
+		}
+		header, err := parseNATSHeader(payload[:hdrSize])
+		if err != nil {
+			return err
+		}
+		return c.publish(fields[0], fields[1:len(fields)-2], header, payload[hdrSize:])
+	case "SUB":
+		// SUB <subject> [queue] <sid>
+		if len(fields) < 2 || len(fields) > 3 {
+			return errNATSParse
+		}
+		return c.subscribe(fields[0], fields[1:len(fields)-1], fields[len(fields)-1])
+	case "UNSUB":
+		// UNSUB <sid> [max_msgs]
+		if len(fields) < 1 || len(fields) > 2 {
+			return errNATSParse
+		}
+		var max uint64
+		if len(fields) == 2 {
+			var err error
+			if max, err = strconv.ParseUint(fields[1], 10, 64); err != nil {
+				return errNATSParse
+			}
+		}
+		c.unsubscribe(fields[0], max)
+	default:
+		return errNATSUnknownOp
+	}
+	return nil
+}
+
+func (c *natsConn) payloadSize(s string) (int, error) {
+	size, err := strconv.Atoi(s)
+	if err != nil || size < 0 {
+		return 0, errNATSParse
+	}
+	if size > c.srv.opts.MaxPayload {
+		return 0, errNATSMaxPayload
+	}
+	return size, nil
+}
+
+// readPayload reads a payload of the given size followed by CRLF.
+func readPayload(r *bufio.Reader, size int) ([]byte, error) {
+	payload := make([]byte, size+2)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, errNATSParse
+	}
+	if !bytes.HasSuffix(payload, []byte("\r\n")) {
+		return nil, errNATSParse
+	}
+	return payload[:size], nil
+}
+
+func (c *natsConn) publish(subj string, reply []string, header Header, data []byte) error {
+	if !IsValidPubSubject(subj) {
+		return errNATSPubSubject
+	}
+	msg := &Msg[any]{Subject: subj, Header: header, Data: data}
+	if len(reply) > 0 {
+		msg.Reply = reply[0]
+	}
+	c.publishing.Store(msg)
+	err := c.srv.ps.publish(msg)
+	c.publishing.Store(nil)
+	if errors.Is(err, ErrClosed) {
+		return errNATSClosed
+	}
+	return err
+}
+
+func (c *natsConn) subscribe(subj string, queue []string, sid string) error {
+	if !sublist.IsValidSubject(subj) {
+		return errNATSSubject
+	}
+	options := []SubOption{WithID(fmt.Sprintf("nats:%d:%s", c.id, sid))}
+	if len(queue) > 0 {
+		options = append(options, WithQueueGroup(queue[0]))
+	}
+	ns := &natsSub{}
+	prefix := " " + sid + " "
+	s := subscribe(c.srv.ps, subj, func(msg *Msg[any]) {
+		if !c.echo.Load() && c.publishing.Load() == msg {
+			return
+		}
+		n := ns.delivered.Add(1)
+		max := ns.max.Load()
+		if max > 0 && n > max {
+			return
+		}
+		c.deliver(msg, prefix)
+		if max > 0 && n == max {
+			c.unsubscribe(sid, 0)
+		}
+	}, options...)
+	ns.cancel = s.cancel
+
+	c.mu.Lock()
+	old, closed := c.subs[sid], c.closed
+	if !closed {
+		c.subs[sid] = ns
+	}
+	c.mu.Unlock()
+	if old != nil {
+		old.cancel()
+	}
+	if closed {
+		ns.cancel()
+	}
+	return nil
+}
+
+// unsubscribe cancels a subscription, or arranges for it to be cancelled after max messages.
+func (c *natsConn) unsubscribe(sid string, max uint64) {
+	c.mu.Lock()
+	ns := c.subs[sid]
+	if ns != nil && (max == 0 || ns.delivered.Load() >= max) {
+		delete(c.subs, sid)
+	} else if ns != nil {
+		ns.max.Store(max)
+		ns = nil
+	}
+	c.mu.Unlock()
+	if ns != nil {
+		ns.cancel()
+	}
+}
+
+// deliver sends a message to the client as MSG, or HMSG if it has headers and the client supports them.
+func (c *natsConn) deliver(msg *Msg[any], sidArgs string) {
+	var data []byte
+	switch d := msg.Data.(type) {
+	case nil:
+	case []byte:
+		data = d
+	case string:
+		data = []byte(d)
+	default:
+		var err error
+		if data, err = c.srv.opts.Codec.Encode(d); err != nil {
+			return
+		}
+	}
+	var hdr []byte
+	if len(msg.Header) > 0 && c.headers.Load() {
+		hdr = appendNATSHeader(nil, msg.Header)
+	}
+
+	out := make([]byte, 0, len(msg.Subject)+len(sidArgs)+len(msg.Reply)+len(hdr)+len(data)+32)
+	if hdr != nil {
+		out = append(out, "HMSG "...)
+	} else {
+		out = append(out, "MSG "...)
+	}
+	out = append(out, msg.Subject...)
+	out = append(out, sidArgs...)
+	if msg.Reply != _EMPTY_ {
+		out = append(out, msg.Reply...)
+		out = append(out, ' ')
+	}
+	if hdr != nil {
+		out = strconv.AppendInt(out, int64(len(hdr)), 10)
+		out = append(out, ' ')
+	}
+	out = strconv.AppendInt(out, int64(len(hdr)+len(data)), 10)
+	out = append(out, "\r\n"...)
+	out = append(out, hdr...)
+	out = append(out, data...)
+	out = append(out, "\r\n"...)
+	c.send(out)
+}
+
+func (c *natsConn) sendErr(err error) {
+	c.send(fmt.Appendf(nil, "-ERR '%s'\r\n", err))
+}
+
+// send queues output for the writer goroutine. Clients that fall too far behind are disconnected.
+func (c *natsConn) send(b []byte) {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return
+	}
+	if len(c.out)+len(b) > c.srv.opts.MaxPending {
+		c.out = fmt.Appendf(c.out, "-ERR '%s'\r\n", errNATSSlowConsumer)
+		c.mu.Unlock()
+		c.close()
+		return
+	}
+	c.out = append(c.out, b...)
+	c.mu.Unlock()
+	select {
+	case c.flush <- struct{}{}:
+	default:
+	}
+}
+
+// write sends queued output to the client until the connection is closed,
+// at which point it makes a final attempt to send what remains (eg. an -ERR)
+// before closing the underlying connection.
+func (c *natsConn) write() {
+	defer c.conn.Close()
+	var buf []byte
+	for {
+		done := false
+		select {
+		case <-c.flush:
+		case <-c.done:
+			done = true
+		}
+		c.mu.Lock()
+		buf, c.out = c.out, buf[:0]
+		c.mu.Unlock()
+		if _, err := c.conn.Write(buf); err != nil || done {
+			c.close()
+			return
+		}
+	}
+}
+
+// close cancels the client's subscriptions and stops the writer,
+// which closes the connection once its final write completes or times out.
+func (c *natsConn) close() {
+	c.closeOnce.Do(func() {
+		c.mu.Lock()
+		c.closed = true
+		subs := c.subs
+		c.subs = nil
+		c.mu.Unlock()
+		for _, ns := range subs {
+			ns.cancel()
+		}
+		c.conn.SetWriteDeadline(time.Now().Add(time.Second))
+		close(c.done)
+		c.srv.mu.Lock()
+		delete(c.srv.conns, c)
+		c.srv.mu.Unlock()
+	})
+}
+
+// parseNATSHeader parses a header block of the form "NATS/1.0\r\nKey: Value\r\n...\r\n\r\n".
+func parseNATSHeader(b []byte) (Header, error) {
+	lines := strings.Split(string(b), "\r\n")
+	if len(lines) < 3 || !strings.HasPrefix(lines[0], "NATS/1.0") || lines[len(lines)-1] != _EMPTY_ || lines[len(lines)-2] != _EMPTY_ {
+		return nil, errNATSHeaderParsing
+	}
+	header := Header{}
+	for _, line := range lines[1 : len(lines)-2] {
+		key, value, ok := strings.Cut(line, ":")
+		if !ok || key == _EMPTY_ {
+			return nil, errNATSHeaderParsing
+		}
+		header.Add(key, strings.TrimSpace(value))
+	}
+	return header, nil
+}
+
+func appendNATSHeader(b []byte, header Header) []byte {
+	b = append(b, "NATS/1.0\r\n"...)
+	for key, values := range header {
+		for _, v := range values {
+			b = append(b, key...)
+			b = append(b, ": "...)
+			b = append(b, v...)
+			b = append(b, "\r\n"...)
+		}
+	}
+	return append(b, "\r\n"...)
+}
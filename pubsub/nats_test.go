@@ -0,0 +1,176 @@
+package pubsub
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/yurivish/toolkit/assert"
+)
+
+// natsClient is a minimal client that speaks the text protocol directly.
+type natsClient struct {
+	t    *testing.T
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+func startNATSServer(t *testing.T, ps *PubSub, network, address string) (*NATSServer, string) {
+	t.Helper()
+	srv := NewNATSServer(ps, WithNATSName("test"), WithNATSMaxPayload(1024))
+	l, err := net.Listen(network, address)
+	assert.Nil(t, err)
+	go srv.Serve(l)
+	t.Cleanup(func() { srv.Close() })
+	return srv, l.Addr().String()
+}
+
+func dialNATS(t *testing.T, network, address, connect string) *natsClient {
+	t.Helper()
+	conn, err := net.Dial(network, address)
+	assert.Nil(t, err)
+	t.Cleanup(func() { conn.Close() })
+	c := &natsClient{t: t, conn: conn, r: bufio.NewReader(conn)}
+	assert.MatchesRegexp(t, c.line(), `^INFO \{.*"headers":true.*\}$`)
+	c.send("CONNECT " + connect + "\r\n")
+	if strings.Contains(connect, `"verbose":true`) {
+		assert.Equal(t, c.line(), "+OK")
+	}
+	c.sync()
+	return c
+}
+
+func (c *natsClient) send(s string) {
+	_, err := io.WriteString(c.conn, s)
+	assert.Nil(c.t, err)
+}
+
+func (c *natsClient) line() string {
+	c.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	line, err := c.r.ReadString('\n')
+	assert.Nil(c.t, err)
+	return strings.TrimSuffix(line, "\r\n")
+}
+
+// sync waits for the server to process everything sent so far.
+func (c *natsClient) sync() {
+	c.send("PING\r\n")
+	assert.Equal(c.t, c.line(), "PONG")
+}
+
+// msg reads a MSG or HMSG, returning its control line and payload.
+func (c *natsClient) msg() (string, string) {
+	line := c.line()
+	fields := strings.Fields(line)
+	n, err := strconv.Atoi(fields[len(fields)-1])
+	assert.Nil(c.t, err)
+	payload := make([]byte, n+2)
+	_, err = io.ReadFull(c.r, payload)
+	assert.Nil(c.t, err)
+	return line, string(payload[:n])
+}
+
+func TestNATSServer(t *testing.T) {
+	ps := NewPubSub()
+	_, addr := startNATSServer(t, ps, "tcp", "127.0.0.1:0")
+	c := dialNATS(t, "tcp", addr, `{"verbose":false,"headers":true}`)
+
+	// Client to in-process
+	var got []string
+	SubMsg(ps, "in.*", func(msg *Msg[[]byte]) {
+		got = append(got, msg.Subject+" "+msg.Reply+" "+string(msg.Data)+" "+msg.Header.Get("K"))
+	})
+	c.send("PUB in.a 5\r\nhello\r\nPUB in.b reply.x 0\r\n\r\n")
+	c.send("HPUB in.c 19 21\r\nNATS/1.0\r\nK: v1\r\n\r\nhi\r\n")
+	c.sync()
+	assert.Equal(t, got, []string{"in.a  hello ", "in.b reply.x  ", "in.c  hi v1"})
+
+	// In-process to client
+	c.send("SUB out.> 1\r\n")
+	c.sync()
+	Pub(ps, "out.a", "text")
+	Pub(ps, "out.b", map[string]int{"n": 1})
+	PubMsg(ps, &Msg[[]byte]{Subject: "out.c", Reply: "r", Header: Header{"K": {"v"}}, Data: []byte("x")})
+	line, payload := c.msg()
+	assert.Equal(t, line, "MSG out.a 1 4")
+	assert.Equal(t, payload, "text")
+	line, payload = c.msg()
+	assert.Equal(t, line, "MSG out.b 1 7")
+	assert.Equal(t, payload, `{"n":1}`)
+	line, payload = c.msg()
+	assert.Equal(t, line, "HMSG out.c 1 r 18 19")
+	assert.Equal(t, payload, "NATS/1.0\r\nK: v\r\n\r\nx")
+
+	// Subscriptions are visible in-process
+	var ids []string
+	for _, info := range ps.Subscriptions() {
+		ids = append(ids, info.ID)
+	}
+	assert.True(t, strings.Contains(strings.Join(ids, ","), "nats:1:1"))
+
+	// Auto-unsubscribe after two more messages
+	c.send("UNSUB 1 5\r\n")
+	c.sync()
+	for i := range 3 {
+		Pub(ps, "out.x", strconv.Itoa(i))
+	}
+	c.send("PING\r\n")
+	_, payload = c.msg()
+	assert.Equal(t, payload, "0")
+	_, payload = c.msg()
+	assert.Equal(t, payload, "1")
+	assert.Equal(t, c.line(), "PONG")
+
+	// Errors
+	c.send("SUB a..b 2\r\n")
+	assert.Equal(t, c.line(), "-ERR 'Invalid Subject'")
+	c.send("PUB a.* 0\r\n\r\n")
+	assert.Equal(t, c.line(), "-ERR 'Invalid Publish Subject'")
+	c.send("PUB a 2000\r\n")
+	assert.Equal(t, c.line(), "-ERR 'Maximum Payload Violation'")
+	_, err := c.r.ReadString('\n')
+	assert.ErrorIs(t, err, io.EOF)
+}
+
+func TestNATSServerClients(t *testing.T) {
+	ps := NewPubSub()
+	srv, addr := startNATSServer(t, ps, "unix", filepath.Join(t.TempDir(), "nats.sock"))
+	a := dialNATS(t, "unix", addr, `{"echo":false}`)
+	b := dialNATS(t, "unix", addr, `{"verbose":true}`)
+	assert.Equal(t, srv.NumClients(), 2)
+
+	// Queue groups span clients, and echo can be disabled
+	a.send("SUB q a-q 1\r\nSUB q 2\r\n")
+	a.sync()
+	b.send("SUB q b-q 1\r\n")
+	assert.Equal(t, b.line(), "+OK")
+	a.send("PUB q 1\r\na\r\n")
+	a.sync()
+	b.send("PUB q 1\r\nb\r\n")
+	for line := b.line(); line != "+OK"; line = b.line() {
+		b.line() // The payload of a queue delivery, which precedes the +OK
+	}
+
+	// a receives b's message on its plain subscription, but not its own
+	line, payload := a.msg()
+	for strings.HasPrefix(line, "MSG q 1 ") { // Queue deliveries may land on a
+		line, payload = a.msg()
+	}
+	assert.Equal(t, line, "MSG q 2 1")
+	assert.Equal(t, payload, "b")
+
+	srv.Close()
+	_, err := a.r.ReadString('\n')
+	for err == nil {
+		_, err = a.r.ReadString('\n')
+	}
+	for len(ps.Subscriptions()) > 0 {
+		time.Sleep(time.Millisecond)
+	}
+	assert.Equal(t, srv.NumClients(), 0)
+}
@@ -0,0 +1,446 @@
+package pubsub
+
+import (
+	"bufio"
+	"cmp"
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"math/rand/v2"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/yurivish/toolkit/h2"
+	"github.com/yurivish/toolkit/sublist"
+)
+
+// Observer is notified of the activity of a PubSub, for metrics and tracing (see WithObserver).
+// Its methods are called synchronously, on the publishing goroutine or the goroutine of an
+// async subscriber, so they should be fast and safe for concurrent use.
+type Observer interface {
+	// Publish is called once the subscribers that will receive a message are known.
+	// The context is the one passed to PubMsgCtx, or context.Background().
+	Publish(ctx context.Context, msg *Msg[any], recipients int)
+
+	// Deliver is called before a handler is invoked, with a context carrying the trace context
+	// propagated from the publisher, if any. It returns the context passed on to the handler
+	// (see SubMsgCtx) and a function that is called once the handler returns or panics.
+	Deliver(ctx context.Context, sub *sublist.Subscription, msg *Msg[any]) (context.Context, func())
+
+	// Error is called when a handler panics, with a *PanicError, or when a message is dropped
+	// by a slow subscriber, with ErrDropped. For dropped messages, msg is the message whose
+	// delivery caused the drop, which under DropOldest is not the one that was dropped.
+	// It is also called when a publish made on behalf of a subscription fails, such as the
+	// reply of a responder, with the failed message and the error from publishing, and when
+	// a scheduled publish fails, in which case sub is nil.
+	Error(sub *sublist.Subscription, msg *Msg[any], err error)
+}
+
+// UnsubscribeObserver can be implemented by an Observer to be told when a subscription is
+// cancelled, so that it can discard any state it keeps for the subscription.
+type UnsubscribeObserver interface {
+	Unsubscribe(sub *sublist.Subscription)
+}
+
+// ErrDropped is reported to observers when a message is dropped due to mailbox overflow.
+var ErrDropped = errors.New("pubsub: message dropped")
+
+// PanicError is reported to observers when a handler panics.
+type PanicError struct {
+	Value any
+	Stack []byte
+}
+
+func (e *PanicError) Error() string {
+	return fmt.Sprintf("pubsub: handler panicked: %v", e.Value)
+}
+
+// --- Trace context ---
+
+// HeaderTraceparent carries the trace context of a message in the W3C Trace Context format.
+const HeaderTraceparent = "traceparent"
+
+// TraceContext identifies a span within a distributed trace.
+type TraceContext struct {
+	TraceID      [16]byte
+	SpanID       [8]byte
+	ParentSpanID [8]byte // Zero for the root span, or when unknown
+	Sampled      bool
+}
+
+type traceKeyType struct{}
+
+var traceKey traceKeyType
+
+// ContextWithTrace returns a context carrying the trace context, which PubMsgCtx and Request
+// propagate to subscribers in the traceparent header.
+func ContextWithTrace(ctx context.Context, tc TraceContext) context.Context {
+	return context.WithValue(ctx, traceKey, tc)
+}
+
+// TraceFromContext returns the trace context carried by ctx, if any.
+func TraceFromContext(ctx context.Context) (TraceContext, bool) {
+	tc, ok := ctx.Value(traceKey).(TraceContext)
+	return tc, ok
+}
+
+// NewTrace starts a new trace with a random trace and span ID.
+func NewTrace() TraceContext {
+	var tc TraceContext
+	for i := range tc.TraceID {
+		tc.TraceID[i] = byte(rand.Uint32())
+	}
+	tc.SpanID = newSpanID()
+	tc.Sampled = true
+	return tc
+}
+
+func newSpanID() [8]byte {
+	var id [8]byte
+	for i := range id {
+		id[i] = byte(rand.Uint32())
+	}
+	return id
+}
+
+// String formats the trace context as a traceparent header value.
+func (tc TraceContext) String() string {
+	flags := "00"
+	if tc.Sampled {
+		flags = "01"
+	}
+	return "00-" + hex.EncodeToString(tc.TraceID[:]) + "-" + hex.EncodeToString(tc.SpanID[:]) + "-" + flags
+}
+
+// ParseTraceparent parses a traceparent header value.
+func ParseTraceparent(s string) (TraceContext, bool) {
+	var tc TraceContext
+	parts := strings.Split(s, "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" || len(parts[3]) != 2 {
+		return tc, false
+	}
+	if n, err := hex.Decode(tc.TraceID[:], []byte(parts[1])); err != nil || n != len(tc.TraceID) || len(parts[1]) != 32 {
+		return tc, false
+	}
+	if n, err := hex.Decode(tc.SpanID[:], []byte(parts[2])); err != nil || n != len(tc.SpanID) || len(parts[2]) != 16 {
+		return tc, false
+	}
+	flags, err := strconv.ParseUint(parts[3], 16, 8)
+	if err != nil {
+		return tc, false
+	}
+	tc.Sampled = flags&1 == 1
+	return tc, tc.TraceID != [16]byte{} && tc.SpanID != [8]byte{}
+}
+
+// injectTrace adds the trace context of ctx to the message headers, unless it already has one.
+func injectTrace(ctx context.Context, msg *Msg[any]) {
+	tc, ok := TraceFromContext(ctx)
+	if !ok || msg.Header.Get(HeaderTraceparent) != _EMPTY_ {
+		return
+	}
+	// The header may belong to the caller, so we add to a copy
+	msg.Header = maps.Clone(msg.Header)
+	if msg.Header == nil {
+		msg.Header = Header{}
+	}
+	msg.Header.Set(HeaderTraceparent, tc.String())
+}
+
+// extractTrace returns a context for delivering the message, carrying a child
+// of the publisher's span if the message has a trace context.
+func extractTrace(msg *Msg[any]) context.Context {
+	ctx := context.Background()
+	if tc, ok := ParseTraceparent(msg.Header.Get(HeaderTraceparent)); ok {
+		tc.ParentSpanID, tc.SpanID = tc.SpanID, newSpanID()
+		ctx = ContextWithTrace(ctx, tc)
+	}
+	return ctx
+}
+
+// --- Metrics ---
+
+// Metrics is an Observer that counts messages per subject and per subscription, and records
+// handler latency in log-linear histograms. It exports them in the Prometheus text format.
+//
+// Subscriptions are identified by their subject, queue group, ID and call site, so that
+// subscriptions that are recreated by the same code share their metrics. The metrics of a
+// subscription are discarded once every subscription sharing them has been cancelled.
+// Inbox subjects (see NewInbox), which are unique to each request, are counted together
+// as "_INBOX.>", both as subjects and as subscriptions.
+type Metrics struct {
+	enc         h2.Encoding
+	maxSubjects int
+	maxSubs     int
+
+	mu       sync.Mutex
+	subjects map[string]*subjectMetrics
+	subs     map[subKey]*subMetrics
+}
+
+type subjectMetrics struct {
+	published, delivered, dropped, panics, errors uint64
+}
+
+type subKey struct {
+	subject, queue, id, site string
+}
+
+type subMetrics struct {
+	live                               map[*sublist.Subscription]struct{} // Subscriptions sharing these metrics
+	delivered, dropped, panics, errors uint64
+	bins                               []uint64 // Handler latency histogram in nanoseconds, indexed by h2 bin
+	count                              uint64
+	sum                                time.Duration
+}
+
+// MetricsOptions configure Metrics.
+type MetricsOptions struct {
+	MaxSubjects      int         // Subjects beyond this many are counted together as "_other"; 10000 by default
+	MaxSubscriptions int         // Subscriptions beyond this many are counted together as "_other"; 10000 by default
+	Encoding         h2.Encoding // Histogram bins for handler latency in nanoseconds; {A: 10, B: 2} by default
+}
+
+type MetricsOption func(*MetricsOptions)
+
+// WithMaxSubjects limits the number of subjects tracked individually.
+func WithMaxSubjects(n int) MetricsOption {
+	return func(o *MetricsOptions) {
+		o.MaxSubjects = n
+	}
+}
+
+// WithMaxSubscriptions limits the number of subscriptions tracked individually.
+func WithMaxSubscriptions(n int) MetricsOption {
+	return func(o *MetricsOptions) {
+		o.MaxSubscriptions = n
+	}
+}
+
+// WithLatencyEncoding sets the histogram bins for handler latency. The smallest bin is
+// 2^A nanoseconds wide, and each power of two above that is divided into 2^B bins.
+func WithLatencyEncoding(e h2.Encoding) MetricsOption {
+	return func(o *MetricsOptions) {
+		o.Encoding = e
+	}
+}
+
+// NewMetrics returns an Observer that collects metrics, for use with WithObserver.
+func NewMetrics(options ...MetricsOption) *Metrics {
+	// The default bins start at about a microsecond with a relative error of at most 25%
+	opts := MetricsOptions{MaxSubjects: 10000, MaxSubscriptions: 10000, Encoding: h2.Encoding{A: 10, B: 2}}
+	for _, opt := range options {
+		opt(&opts)
+	}
+	return &Metrics{
+		enc:         opts.Encoding,
+		maxSubjects: opts.MaxSubjects,
+		maxSubs:     opts.MaxSubscriptions,
+		subjects:    make(map[string]*subjectMetrics),
+		subs:        make(map[subKey]*subMetrics),
+	}
+}
+
+// metricSubject folds inbox subjects into one, since each is only used for one request.
+func metricSubject(subj string) string {
+	if strings.HasPrefix(subj, "_INBOX.") {
+		return "_INBOX.>"
+	}
+	return subj
+}
+
+// subject returns the metrics for a subject. Lock should be held.
+func (m *Metrics) subject(subj string) *subjectMetrics {
+	subj = metricSubject(subj)
+	sm := m.subjects[subj]
+	if sm == nil {
+		if len(m.subjects) >= m.maxSubjects {
+			subj = "_other"
+			if sm = m.subjects[subj]; sm != nil {
+				return sm
+			}
+		}
+		sm = &subjectMetrics{}
+		m.subjects[subj] = sm
+	}
+	return sm
+}
+
+// otherSubs is the key of the subscriptions beyond the limit, see WithMaxSubscriptions.
+var otherSubs = subKey{subject: "_other"}
+
+func newSubKey(sub *sublist.Subscription) subKey {
+	key := subKey{subject: metricSubject(string(sub.Subject)), queue: string(sub.Queue), id: sub.ID}
+	if sub.File != _EMPTY_ {
+		key.site = sub.File + ":" + strconv.Itoa(sub.Line)
+	}
+	return key
+}
+
+// sub returns the metrics for a subscription, which is recorded as live until it
+// is cancelled (see Unsubscribe). Lock should be held.
+func (m *Metrics) sub(sub *sublist.Subscription) *subMetrics {
+	key := newSubKey(sub)
+	sm := m.subs[key]
+	if sm == nil && len(m.subs) >= m.maxSubs {
+		key = otherSubs
+		sm = m.subs[key]
+	}
+	if sm == nil {
+		sm = &subMetrics{live: make(map[*sublist.Subscription]struct{})}
+		m.subs[key] = sm
+	}
+	sm.live[sub] = struct{}{}
+	return sm
+}
+
+func (m *Metrics) Publish(ctx context.Context, msg *Msg[any], recipients int) {
+	m.mu.Lock()
+	m.subject(msg.Subject).published++
+	m.mu.Unlock()
+}
+
+func (m *Metrics) Deliver(ctx context.Context, sub *sublist.Subscription, msg *Msg[any]) (context.Context, func()) {
+	// Look up the subscription before calling the handler, since it may be cancelled by the
+	// time the handler returns, as with the inbox of a request. Recording into a discarded
+	// entry is harmless, whereas looking it up again afterwards would bring it back.
+	m.mu.Lock()
+	sm := m.sub(sub)
+	m.mu.Unlock()
+	start := time.Now()
+	return ctx, func() {
+		latency := time.Since(start)
+		bin := m.enc.Encode64(uint64(max(latency, 0)))
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		m.subject(msg.Subject).delivered++
+		sm.delivered++
+		if bin >= uint64(len(sm.bins)) {
+			sm.bins = append(sm.bins, make([]uint64, bin+1-uint64(len(sm.bins)))...)
+		}
+		sm.bins[bin]++
+		sm.count++
+		sm.sum += latency
+	}
+}
+
+func (m *Metrics) Error(sub *sublist.Subscription, msg *Msg[any], err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var panicErr *PanicError
+	switch {
+	case errors.Is(err, ErrDropped):
+		m.subject(msg.Subject).dropped++
+		m.sub(sub).dropped++
+	case errors.As(err, &panicErr):
+		m.subject(msg.Subject).panics++
+		m.sub(sub).panics++
+	default:
+		m.subject(msg.Subject).errors++
+		if sub != nil {
+			m.sub(sub).errors++
+		}
+	}
+}
+
+// Unsubscribe discards the metrics of the subscription once no live subscription shares them.
+func (m *Metrics) Unsubscribe(sub *sublist.Subscription) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, key := range []subKey{newSubKey(sub), otherSubs} {
+		if sm := m.subs[key]; sm != nil {
+			if _, ok := sm.live[sub]; ok {
+				delete(sm.live, sub)
+				if len(sm.live) == 0 {
+					delete(m.subs, key)
+				}
+				return
+			}
+		}
+	}
+}
+
+// ServeHTTP serves the metrics in the Prometheus text format.
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	m.WritePrometheus(w)
+}
+
+// WritePrometheus writes a snapshot of the metrics in the Prometheus text format.
+func (m *Metrics) WritePrometheus(w io.Writer) error {
+	m.mu.Lock()
+	subjects := make(map[string]subjectMetrics, len(m.subjects))
+	for subj, sm := range m.subjects {
+		subjects[subj] = *sm
+	}
+	subs := make(map[subKey]subMetrics, len(m.subs))
+	for key, sm := range m.subs {
+		copied := *sm
+		copied.bins = slices.Clone(sm.bins)
+		subs[key] = copied
+	}
+	m.mu.Unlock()
+
+	bw := bufio.NewWriter(w)
+	subjectKeys := slices.Sorted(maps.Keys(subjects))
+	counter := func(name, help string, value func(subjectMetrics) uint64) {
+		fmt.Fprintf(bw, "# HELP %s %s\n# TYPE %s counter\n", name, help, name)
+		for _, subj := range subjectKeys {
+			fmt.Fprintf(bw, "%s{subject=%s} %d\n", name, promLabel(subj), value(subjects[subj]))
+		}
+	}
+	counter("pubsub_published_total", "Messages published, by subject.", func(sm subjectMetrics) uint64 { return sm.published })
+	counter("pubsub_delivered_total", "Messages delivered to handlers, by subject.", func(sm subjectMetrics) uint64 { return sm.delivered })
+	counter("pubsub_dropped_total", "Messages dropped by slow subscribers, by subject.", func(sm subjectMetrics) uint64 { return sm.dropped })
+	counter("pubsub_panics_total", "Handler panics, by subject.", func(sm subjectMetrics) uint64 { return sm.panics })
+	counter("pubsub_errors_total", "Failed publishes made by handlers, by subject.", func(sm subjectMetrics) uint64 { return sm.errors })
+
+	subKeys := slices.SortedFunc(maps.Keys(subs), func(a, b subKey) int {
+		return cmp.Or(cmp.Compare(a.subject, b.subject), cmp.Compare(a.queue, b.queue), cmp.Compare(a.id, b.id), cmp.Compare(a.site, b.site))
+	})
+	labels := func(key subKey) string {
+		return "subscription=" + promLabel(key.subject) + ",queue=" + promLabel(key.queue) + ",id=" + promLabel(key.id) + ",site=" + promLabel(key.site)
+	}
+	subCounter := func(name, help string, value func(subMetrics) uint64) {
+		fmt.Fprintf(bw, "# HELP %s %s\n# TYPE %s counter\n", name, help, name)
+		for _, key := range subKeys {
+			fmt.Fprintf(bw, "%s{%s} %d\n", name, labels(key), value(subs[key]))
+		}
+	}
+	subCounter("pubsub_subscription_delivered_total", "Messages delivered, by subscription.", func(sm subMetrics) uint64 { return sm.delivered })
+	subCounter("pubsub_subscription_dropped_total", "Messages dropped, by subscription.", func(sm subMetrics) uint64 { return sm.dropped })
+	subCounter("pubsub_subscription_panics_total", "Handler panics, by subscription.", func(sm subMetrics) uint64 { return sm.panics })
+	subCounter("pubsub_subscription_errors_total", "Failed publishes made by the handler, by subscription.", func(sm subMetrics) uint64 { return sm.errors })
+
+	const name = "pubsub_handler_duration_seconds"
+	fmt.Fprintf(bw, "# HELP %s Handler latency, by subscription.\n# TYPE %s histogram\n", name, name)
+	for _, key := range subKeys {
+		sm := subs[key]
+		var cumulative uint64
+		for bin, n := range sm.bins {
+			if n == 0 {
+				continue
+			}
+			cumulative += n
+			lower, width := m.enc.Decode64(uint64(bin))
+			le := strconv.FormatFloat(float64(lower+width)/1e9, 'g', -1, 64)
+			fmt.Fprintf(bw, "%s_bucket{%s,le=%q} %d\n", name, labels(key), le, cumulative)
+		}
+		fmt.Fprintf(bw, "%s_bucket{%s,le=\"+Inf\"} %d\n", name, labels(key), sm.count)
+		fmt.Fprintf(bw, "%s_sum{%s} %s\n", name, labels(key), strconv.FormatFloat(sm.sum.Seconds(), 'g', -1, 64))
+		fmt.Fprintf(bw, "%s_count{%s} %d\n", name, labels(key), sm.count)
+	}
+	return bw.Flush()
+}
+
+// promLabel quotes a label value for the Prometheus text format.
+func promLabel(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(s) + `"`
+}
@@ -0,0 +1,132 @@
+package pubsub
+
+import (
+	"context"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/yurivish/toolkit/assert"
+	"github.com/yurivish/toolkit/sublist"
+)
+
+func TestMetrics(t *testing.T) {
+	m := NewMetrics()
+	ps := NewPubSub(WithObserver(m), WithOnHandlerError(func(*sublist.Subscription, string, any, []byte) {}))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ch := SubChan[int](ps, ctx, "nums.*", 1, WithID("chan"), WithAsync(0, DropNewest))
+	Sub(ps, "nums.bad", func(string, int) { panic("boom") })
+	for i := range 3 {
+		Pub(ps, "nums.ok", i)
+	}
+	Pub(ps, "nums.bad", 3)
+	Pub(ps, `odd"subject`, 4)
+	assert.Equal(t, <-ch, 0)
+
+	w := httptest.NewRecorder()
+	m.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	out := w.Body.String()
+	has := func(line string) {
+		t.Helper()
+		assert.True(t, strings.Contains(out, line+"\n"))
+	}
+	has(`pubsub_published_total{subject="nums.ok"} 3`)
+	has(`pubsub_published_total{subject="odd\"subject"} 1`)
+	has(`pubsub_delivered_total{subject="nums.ok"} 3`)
+	has(`pubsub_dropped_total{subject="nums.ok"} 2`)
+	has(`pubsub_dropped_total{subject="nums.bad"} 1`)
+	has(`pubsub_panics_total{subject="nums.bad"} 1`)
+	// Subscriptions are labeled with their call site
+	chanSub := `\{subscription="nums\.\*",queue="",id="chan",site="[^"]*observe_test\.go:\d+"`
+	assert.MatchesRegexp(t, out, `pubsub_subscription_delivered_total`+chanSub+`\} 4\n`)
+	assert.MatchesRegexp(t, out, `pubsub_subscription_dropped_total`+chanSub+`\} 3\n`)
+	assert.MatchesRegexp(t, out, `pubsub_subscription_panics_total\{subscription="nums.bad",queue="",id="",site="[^"]*"\} 1\n`)
+	assert.MatchesRegexp(t, out, `pubsub_handler_duration_seconds_bucket`+chanSub+`,le="[0-9.e-]+"\} [1-4]\n`)
+	assert.MatchesRegexp(t, out, `pubsub_handler_duration_seconds_bucket`+chanSub+`,le="\+Inf"\} 4\n`)
+	assert.MatchesRegexp(t, out, `pubsub_handler_duration_seconds_count`+chanSub+`\} 4\n`)
+}
+
+func TestMetricsMaxSubjects(t *testing.T) {
+	m := NewMetrics(WithMaxSubjects(2))
+	ps := NewPubSub(WithObserver(m))
+	for _, subj := range []string{"a", "b", "c", "d", "a"} {
+		Pub(ps, subj, 0)
+	}
+	var b strings.Builder
+	assert.Nil(t, m.WritePrometheus(&b))
+	assert.True(t, strings.Contains(b.String(), `pubsub_published_total{subject="a"} 2`))
+	assert.True(t, strings.Contains(b.String(), `pubsub_published_total{subject="_other"} 2`))
+	assert.False(t, strings.Contains(b.String(), `subject="c"`))
+}
+
+func TestMetricsSubscriptions(t *testing.T) {
+	m := NewMetrics(WithMaxSubscriptions(2))
+	ps := NewPubSub(WithObserver(m))
+	defer Respond(ps, "double", func(_ string, n int) int { return 2 * n })()
+	for i := range 10 {
+		_, err := Request[int, int](context.Background(), ps, "double", i)
+		assert.Nil(t, err)
+	}
+	// Each request's inbox is discarded once the request completes, and inboxes share one subject
+	assert.Equal(t, len(m.subs), 1)
+	assert.Equal(t, m.subjects["_INBOX.>"].published, uint64(10))
+	assert.Equal(t, len(m.subjects), 2)
+
+	// Subscriptions beyond the limit are counted together until they are cancelled
+	var cancels []context.CancelFunc
+	for _, subj := range []string{"a", "b", "c"} {
+		cancels = append(cancels, Sub(ps, subj, func(string, int) {}))
+		Pub(ps, subj, 0)
+	}
+	var b strings.Builder
+	assert.Nil(t, m.WritePrometheus(&b))
+	assert.True(t, strings.Contains(b.String(), `pubsub_subscription_delivered_total{subscription="_other",queue="",id="",site=""} 2`))
+	for _, cancel := range cancels {
+		cancel()
+	}
+	assert.Equal(t, len(m.subs), 1)
+}
+
+func TestTracePropagation(t *testing.T) {
+	ps := NewPubSub()
+	type traced struct {
+		tc TraceContext
+		ok bool
+	}
+	got := make(chan traced, 1)
+	SubMsgCtx(ps, "traced", func(ctx context.Context, msg *Msg[int]) {
+		tc, ok := TraceFromContext(ctx)
+		got <- traced{tc, ok}
+	}, WithAsync(1, Block))
+
+	root := NewTrace()
+	header := Header{}
+	PubMsgCtx(ContextWithTrace(context.Background(), root), ps, &Msg[int]{Subject: "traced", Header: header, Data: 1})
+	res := <-got
+	assert.True(t, res.ok)
+	tc := res.tc
+	assert.Equal(t, tc.TraceID, root.TraceID)
+	assert.Equal(t, tc.ParentSpanID, root.SpanID)
+	assert.NotEqual(t, tc.SpanID, root.SpanID)
+	assert.True(t, tc.Sampled)
+	// The caller's header is left alone
+	assert.Equal(t, len(header), 0)
+
+	// Without a trace, handlers get a plain context
+	PubMsg(ps, &Msg[int]{Subject: "traced", Data: 2})
+	assert.False(t, (<-got).ok)
+}
+
+func TestParseTraceparent(t *testing.T) {
+	const s = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	tc, ok := ParseTraceparent(s)
+	assert.True(t, ok)
+	assert.True(t, tc.Sampled)
+	assert.Equal(t, tc.String(), s)
+	for _, bad := range []string{"", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7", "ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902-01"} {
+		_, ok := ParseTraceparent(bad)
+		assert.False(t, ok)
+	}
+}
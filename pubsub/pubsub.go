@@ -2,21 +2,140 @@ package pubsub
 
 import (
 	"context"
-	"math/rand/v2"
+	"errors"
+	"log"
 	"runtime"
+	"runtime/debug"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/yurivish/toolkit/sublist"
 )
 
+const _EMPTY_ = ""
+
 // Simple pub-sub system, optimized for observability and ease of use.
 // Based on the same subject structure as NATS's subject-based messaging system.
 type PubSub struct {
-	subs *sublist.Sublist
+	subs      *sublist.Sublist
+	queue     QueueStrategy // Picks the recipient within each queue group
+	retained  *retained     // Non-nil if messages are retained, see WithRetained
+	dropped   atomic.Uint64 // Total messages dropped by async and channel subscribers
+	onError   HandlerErrorFunc
+	maxPanics int
+	observer  Observer     // Nil if there is none
+	dedup     *dedupWindow // Non-nil if duplicates are dropped, see WithDedup
+	schemas   schemas      // Message types registered for subjects, see Register
+	clock     Clock
+	scheduler scheduler // Scheduled publishes, see PubAt
+
+	state    atomic.Int64  // Number of publishes in progress, plus closedBit once closed
+	idle     chan struct{} // Closed once the PubSub is closed and no publishes are in progress
+	idleOnce sync.Once
+
+	mu        sync.Mutex // Guards the fields below
+	streams   map[string]*Stream
+	ackGroups map[string]*ackGroup // Shared by the members of queue groups, see SubAck
+
+	interestMu  sync.Mutex // Held while inserting and removing subscriptions, see WatchInterest
+	watchers    map[*interestWatcher]struct{}
+	queueGroups map[string]*queueGroup   // Keyed by subject and queue, see joinQueueGroup
+	detached    map[*subscriber]struct{} // Subscribers that aren't in the sublist, see SubStream
+}
+
+// PubSubOptions represents options for a PubSub.
+type PubSubOptions struct {
+	QueueStrategy QueueStrategy // Defaults to QueueRandom
+	Retain        bool          // Whether to retain the last message per subject
+	RetainFilters []string      // Retain only subjects matching these filters, or all if empty
+
+	OnHandlerError HandlerErrorFunc // Called when a handler panics; logs the panic by default
+	MaxPanics      int              // Cancel subscriptions after this many consecutive panics, if positive
+
+	Observer Observer // Notified of every publish, delivery and error, see Metrics
+
+	DedupWindow  time.Duration // Drop duplicate messages published within this window, see WithDedup
+	DedupMaxKeys int           // Maximum number of deduplication keys remembered
+	DedupKey     DedupKeyFunc  // Defaults to the subject and the Nats-Msg-Id header
+
+	Clock Clock // Defaults to the system clock
+}
+
+// HandlerErrorFunc is called with the value recovered from a panicking handler, along with
+// the subscription, which records where it was created, and the subject being delivered.
+type HandlerErrorFunc func(sub *sublist.Subscription, subject string, err any, stack []byte)
+
+// Represents an individual PubSub option using the "functional options" pattern
+type PubSubOption func(*PubSubOptions)
+
+func NewPubSub(options ...PubSubOption) *PubSub {
+	opts := PubSubOptions{}
+	for _, opt := range options {
+		opt(&opts)
+	}
+	if opts.QueueStrategy == nil {
+		opts.QueueStrategy = QueueRandom()
+	}
+	if opts.OnHandlerError == nil {
+		opts.OnHandlerError = logHandlerError
+	}
+	if opts.Clock == nil {
+		opts.Clock = systemClock{}
+	}
+	ps := &PubSub{
+		subs:      sublist.NewSublistWithCache(),
+		queue:     opts.QueueStrategy,
+		onError:   opts.OnHandlerError,
+		maxPanics: opts.MaxPanics,
+		observer:  opts.Observer,
+		idle:      make(chan struct{}),
+		schemas:   schemas{list: sublist.NewSublistWithCache()},
+		clock:     opts.Clock,
+	}
+	if opts.Retain {
+		ps.retained = newRetained(opts.RetainFilters)
+	}
+	if opts.DedupWindow > 0 {
+		ps.dedup = newDedupWindow(opts)
+	}
+	return ps
+}
+
+// WithQueueStrategy sets the strategy used to pick which member of a queue group receives each message.
+func WithQueueStrategy(strategy QueueStrategy) PubSubOption {
+	return func(o *PubSubOptions) {
+		o.QueueStrategy = strategy
+	}
+}
+
+// WithOnHandlerError sets the function called when a handler panics.
+// Panics are recovered per subscription, so that one misbehaving handler
+// does not crash the publisher or prevent delivery to other subscribers.
+func WithOnHandlerError(fn HandlerErrorFunc) PubSubOption {
+	return func(o *PubSubOptions) {
+		o.OnHandlerError = fn
+	}
+}
+
+// WithObserver sets an observer to be notified of every publish, delivery and error.
+func WithObserver(observer Observer) PubSubOption {
+	return func(o *PubSubOptions) {
+		o.Observer = observer
+	}
+}
+
+// WithMaxPanics cancels subscriptions whose handlers panic n times in a row.
+func WithMaxPanics(n int) PubSubOption {
+	return func(o *PubSubOptions) {
+		o.MaxPanics = n
+	}
 }
 
-func NewPubSub() *PubSub {
-	return &PubSub{subs: sublist.NewSublistWithCache()}
+func logHandlerError(sub *sublist.Subscription, subject string, err any, stack []byte) {
+	log.Printf("pubsub: panic in handler for %q subscribed to %q at %s:%d (%s): %v\n%s",
+		subject, sub.Subject, sub.File, sub.Line, sub.FuncName, err, stack)
 }
 
 // SubOptions represents subscriber options.
@@ -25,16 +144,98 @@ type SubOptions struct {
 	Queue       []byte // Queue name for the sublist queue group
 	Debug       bool   // Whether or not this is a debug subscription
 	ID          string // An identifier for this subscription.
+
+	// Async delivery settings, configured with WithAsync
+	Async    bool
+	BufSize  int
+	Overflow OverflowPolicy
+
+	Replay bool // Whether to first receive matching retained messages, see WithReplayRetained
+
+	Coalesce  time.Duration // Deliver only the newest message per subject per interval, see WithCoalesce
+	BatchSize int           // Deliver messages in batches of up to this many, see WithBatch
+	BatchWait time.Duration // Deliver partial batches after this long
+
+	onCancel    func()            // Called when the subscription is cancelled, see subChan
+	onSubscribe func(*subscriber) // Called before the subscriber can receive messages, see Respond
+	detached    bool              // Not added to the sublist, for subscribers delivered to directly, see SubStream
+	stopped     chan struct{}     // Closed once a channel subscriber has closed its channel, see subChan
+
+	internal bool                        // Not counted as a responder by Request, see Tap
+	forward  func(string) (string, bool) // Subject that messages are republished to, see AddTransform
+}
+
+// subscriber is the per-subscription state stored in the Value field of each
+// sublist.Subscription created by this package.
+type subscriber struct {
+	sub       *sublist.Subscription
+	handler   any         // One of the handler types accepted by sub
+	mailbox   *mailbox    // Non-nil for async subscriptions
+	replay    *replayGate // Non-nil for subscriptions with WithReplayRetained
+	coalesce  *coalescer  // Non-nil for subscriptions with WithCoalesce
+	group     *queueGroup // Non-nil for queue subscriptions
+	batch     *batcher    // Non-nil for batch subscriptions
+	cancel    context.CancelFunc
+	stopped   <-chan struct{} // For async and channel subscribers, closed once their goroutine exits
+	seq       uint64          // Unique per subscriber, used for consistent hashing
+	delivered atomic.Uint64   // Number of messages passed to the handler
+	dropped   atomic.Uint64   // Number of messages dropped due to mailbox overflow
+	inFlight  atomic.Int64    // Number of messages pending in the mailbox or being handled
+	panics    atomic.Uint64   // Number of times the handler panicked
+	failing   atomic.Int64    // Number of consecutive panics, for WithMaxPanics
+	lastCall  atomic.Int64    // Unix nanoseconds of the most recent delivery, or zero
+
+	internal bool                        // Set for subscriptions made by the PubSub itself, see Request
+	forward  func(string) (string, bool) // Non-nil for transforms, mapping a subject to its destination
+}
+
+// subscriberSeq is used to give each subscriber a unique sequence number
+var subscriberSeq atomic.Uint64
+
+// call invokes the handler with the given message.
+func (s *subscriber) call(ctx context.Context, msg *Msg[any], matches *sublist.SublistResult) (dropped int, disconnect bool) {
+	s.delivered.Add(1)
+	s.lastCall.Store(time.Now().UnixNano())
+	defer s.inFlight.Add(-1)
+	switch handler := s.handler.(type) {
+	case func(string, any, *sublist.SublistResult):
+		// DebugSub handlers are passed the subscriptions that matched this pub subject.
+		handler(msg.Subject, msg.Data, matches)
+	case func(*Msg[any]):
+		// Regular handlers are invoked with the message envelope.
+		handler(msg)
+	case func(context.Context, *Msg[any]):
+		// Context handlers (see SubMsgCtx) also receive the trace context of the message.
+		handler(ctx, msg)
+	case func(*Msg[any]) (int, bool):
+		// Channel handlers (see SubChan and SubSeq) report their own overflow.
+		return handler(msg)
+	case func([]*Msg[any]):
+		// Batch handlers (see SubBatch) receive envelopes holding the batched messages.
+		handler(msg.Data.([]*Msg[any]))
+	}
+	return 0, false
 }
 
 // Core subscribe function.
 // The handler code will be invoked synchronously on the goroutine which calls Pub.
-// The handler can be one of two types:
-// - func(subject string, message M) (see [Sub])
+// The handler can be one of these types:
+// - func(msg *Msg[any]) (see [Sub], [SubMsg] and [Respond])
+// - func(ctx context.Context, msg *Msg[any]) (see [SubMsgCtx])
 // - func(subject string, message any, *sublist.SublistResult) (see [DebugSub])
-// Messages will be delivered to all regular subscribers, and a random subscriber per queue group.
+// - func(msg *Msg[any]) (dropped int, disconnect bool) (see [SubChan] and [SubSeq])
+// - func(msgs []*Msg[any]) (see [SubBatch])
+// Messages will be delivered to all regular subscribers, and one subscriber per queue group.
 // A handler can be part of zero or one queue groups. To register a handler with a queue group, use WithQueue().
+// If WithAsync is passed, the handler is instead invoked on a dedicated goroutine for this subscription.
+// Handler panics are recovered and reported, see WithOnHandlerError.
 func sub(ps *PubSub, subj string, handler any, options ...SubOption) context.CancelFunc {
+	options = append(options, WithSkip(1)) // Skip this stack frame when recording the subscriber
+	return subscribe(ps, subj, handler, options...).cancel
+}
+
+// subscribe is like sub, but returns the subscriber for internal use.
+func subscribe(ps *PubSub, subj string, handler any, options ...SubOption) *subscriber {
 	// Determine the options for this subscription using the "functional options" pattern
 	opts := SubOptions{SkipCallers: 1}
 	for _, opt := range options {
@@ -42,7 +243,12 @@ func sub(ps *PubSub, subj string, handler any, options ...SubOption) context.Can
 	}
 
 	// Create the underlying Subscription object
-	sub := sublist.Subscription{Subject: []byte(subj), Value: handler, ID: opts.ID, Queue: opts.Queue, Debug: opts.Debug}
+	s := &subscriber{handler: handler, seq: subscriberSeq.Add(1), internal: opts.internal || opts.forward != nil, forward: opts.forward}
+	sub := &sublist.Subscription{Subject: []byte(subj), Value: s, ID: opts.ID, Queue: opts.Queue, Debug: opts.Debug}
+	s.sub = sub
+	if opts.onSubscribe != nil {
+		opts.onSubscribe(s)
+	}
 
 	// Gather file and line information for subscription and include them
 	// in the Subscription struct for debugging purposes if available
@@ -53,35 +259,129 @@ func sub(ps *PubSub, subj string, handler any, options ...SubOption) context.Can
 			sub.FuncName = fn.Name()
 		}
 	}
-	err := ps.subs.Insert(&sub)
+	if opts.Async {
+		s.mailbox = newMailbox(opts.BufSize, opts.Overflow)
+		s.stopped = s.mailbox.finished
+	} else {
+		s.stopped = opts.stopped
+	}
+	if opts.Coalesce > 0 {
+		s.coalesce = &coalescer{ps: ps, s: s, interval: opts.Coalesce, latest: make(map[string]heldMsg)}
+	}
+	if _, ok := handler.(func([]*Msg[any])); ok {
+		s.batch = &batcher{ps: ps, s: s, size: max(opts.BatchSize, 1), maxWait: opts.BatchWait}
+	} else if opts.BatchSize > 0 {
+		panic("pubsub: WithBatch requires a batch handler, see SubBatch")
+	}
+	var replay []*Msg[any]
+	var err error
+	if opts.Replay && ps.retained != nil {
+		s.replay = &replayGate{}
+		s.replay.replaying.Store(true)
+	}
+	ps.interestMu.Lock()
+	if opts.Queue != nil {
+		s.group = ps.joinQueueGroup(subj, opts.Queue)
+	}
+	switch {
+	case opts.detached:
+		if ps.detached == nil {
+			ps.detached = make(map[*subscriber]struct{})
+		}
+		ps.detached[s] = struct{}{}
+	case s.replay != nil:
+		replay, err = ps.retained.insert(ps.subs, sub)
+	default:
+		err = ps.subs.Insert(sub)
+	}
+	if err == nil && !opts.detached {
+		ps.interestChanged(subj, 1)
+	} else if err != nil && s.group != nil {
+		ps.leaveQueueGroup(s.group)
+	}
+	ps.interestMu.Unlock()
 	if err != nil {
 		panic(err) // only possible error is "invalid subject", which is programmer error.
 	}
-	return func() {
-		err := ps.subs.Remove(&sub)
+	s.cancel = func() {
+		ps.interestMu.Lock()
+		var err error
+		if opts.detached {
+			if _, ok := ps.detached[s]; ok {
+				delete(ps.detached, s)
+			} else {
+				err = sublist.ErrNotFound
+			}
+		} else if err = ps.subs.Remove(sub); err == nil {
+			ps.interestChanged(subj, -1)
+		}
+		if err == nil && s.group != nil {
+			ps.leaveQueueGroup(s.group)
+		}
+		ps.interestMu.Unlock()
+		if err == nil {
+			if o, ok := ps.observer.(UnsubscribeObserver); ok {
+				o.Unsubscribe(sub)
+			}
+		}
 		// `CancelFunc`s are required to be idempotent, so ignore not-found errors
 		if err != nil && err != sublist.ErrNotFound {
 			panic(err) // only possible error is "invalid subject" which is programmer error.
 		}
+		if s.mailbox != nil {
+			s.mailbox.close()
+		}
+		if s.coalesce != nil {
+			s.coalesce.stop()
+		}
+		if s.batch != nil {
+			s.batch.stop()
+		}
+		if opts.onCancel != nil {
+			opts.onCancel()
+		}
+	}
+	if s.mailbox != nil {
+		go s.mailbox.run()
+	}
+	if ps.Closed() {
+		// Drain and Close cancel the subscriptions that exist when they are called,
+		// so subscriptions that race with them are cancelled here instead.
+		s.cancel()
+		return s
 	}
+	if s.replay != nil {
+		if _, ok := handler.(func(*Msg[any]) (int, bool)); ok {
+			// Channel subscriptions are read by the goroutine that is subscribing,
+			// so replay in the background lest we block on a full channel.
+			go s.replay.run(ps, s, replay)
+		} else {
+			s.replay.run(ps, s, replay)
+		}
+	}
+	return s
 }
 
 // The handler code will be run synchronously on the goroutine which calls Pub.
 // The handler takes the subject as a first argument, and message as the second.
 func Sub[M any](ps *PubSub, subj string, handler func(string, M), options ...SubOption) context.CancelFunc {
 	options = append(options, WithSkip(1)) // Skip this stack frame when recording the subscriber for debug subs
-	return sub(ps, subj, func(subj string, message any) {
-		// The message might be nil, which we need to handle specially.
-		// Or, later, we might mandate non-nil messages. But for now do this.
-		if message == nil {
-			var zero M
-			handler(subj, zero)
-		} else {
-			handler(subj, message.(M))
-		}
+	return sub(ps, subj, func(msg *Msg[any]) {
+		handler(msg.Subject, as[M](msg.Data))
 	}, options...)
 }
 
+// as converts a published message back to the subscriber's message type.
+func as[M any](message any) M {
+	// The message might be nil, which we need to handle specially.
+	// Or, later, we might mandate non-nil messages. But for now do this.
+	if message == nil {
+		var zero M
+		return zero
+	}
+	return message.(M)
+}
+
 // Debug subscriptions are marked as such in the Subscription object,
 // and receive the full match result as a third argument.
 // This might be highly useful for tracing.
@@ -93,65 +393,297 @@ func DebugSub(ps *PubSub, subj string, handler func(string, any, *sublist.Sublis
 // SubChan returns a channel onto which messages are placed.
 // The user is NOT responsible for closing the channel.
 // Both the subscription and channel will be closed once the context completes.
+// By default publishers block until there is room in the channel; pass WithAsync
+// to choose a different overflow policy. The bufSize argument takes precedence
+// over the buffer size given to WithAsync.
 func SubChan[M any](ps *PubSub, ctx context.Context, subj string, bufSize int, options ...SubOption) <-chan M {
-	options = append(options, WithSkip(1)) // Skip this stack frame when recording the subscriber
-	ch := make(chan M, bufSize)
-	cancel := Sub(ps, subj, func(subj string, message M) {
-		select {
-		case ch <- message:
-		case <-ctx.Done():
+	options = append(options, WithSkip(1), func(s *SubOptions) { s.BufSize = bufSize })
+	return subChan(ps, ctx, subj, func(msg *Msg[any]) M { return as[M](msg.Data) }, options...)
+}
+
+// subChan subscribes a handler that places converted messages onto a channel, which is
+// closed along with the subscription once ctx is done or the subscriber is disconnected
+// for being too slow. The channel itself serves as the mailbox, so its buffer size and
+// overflow policy are taken from WithAsync while the subscription remains synchronous.
+func subChan[T any](ps *PubSub, ctx context.Context, subj string, convert func(*Msg[any]) T, options ...SubOption) <-chan T {
+	opts := SubOptions{}
+	for _, opt := range options {
+		opt(&opts)
+	}
+	// Cancelling the subscription, whether by disconnecting a slow consumer or by closing
+	// the PubSub, also cancels the context, which closes the channel.
+	ctx, stop := context.WithCancel(ctx)
+	stopped := make(chan struct{})
+	options = append(options, WithSkip(1), func(s *SubOptions) {
+		s.Async = false
+		s.onCancel = stop
+		s.stopped = stopped
+	})
+	ch := make(chan T, opts.BufSize)
+
+	// Handlers hold the read lock while sending so that the channel is never closed mid-send,
+	// since a concurrent Pub may still be delivering to us after the subscription is cancelled.
+	var mu sync.RWMutex
+	var closed bool
+
+	cancel := sub(ps, subj, func(msg *Msg[any]) (int, bool) {
+		mu.RLock()
+		defer mu.RUnlock()
+		if closed {
+			return 0, false
 		}
+		return offer(ch, convert(msg), opts.Overflow, ctx.Done())
 	}, options...)
 
 	go func() {
 		<-ctx.Done()
 		cancel()
+		mu.Lock()
+		closed = true
 		close(ch)
+		mu.Unlock()
+		close(stopped)
 	}()
 
 	return ch
 }
 
 // Publish a message onto the given subject.
-func Pub[M any](ps *PubSub, subj string, message M) {
+// Returns ErrClosed if the PubSub has been closed or is draining,
+// and ErrSchemaMismatch if the message does not have the type registered for the subject.
+func Pub[M any](ps *PubSub, subj string, message M) error {
+	return ps.publish(&Msg[any]{Subject: subj, Data: message})
+}
+
+// PubReply publishes a message onto the given subject with a reply subject attached,
+// which responders (see [Respond]) will publish their response to.
+func PubReply[M any](ps *PubSub, subj, reply string, message M) error {
+	return ps.publish(&Msg[any]{Subject: subj, Reply: reply, Data: message})
+}
+
+// publish delivers the message to all matching subscribers.
+// The same message is shared between all of its subscribers.
+func (ps *PubSub) publish(msg *Msg[any]) error {
+	return ps.publishCtx(context.Background(), msg)
+}
+
+// publishCtx is like publish, but propagates the trace context of ctx, if any.
+func (ps *PubSub) publishCtx(ctx context.Context, msg *Msg[any]) error {
+	if !ps.beginPublish() {
+		return ErrClosed
+	}
+	defer ps.endPublish()
+	if err := ps.schemas.check(msg); err != nil {
+		return err
+	}
+	now := ps.clock.Now()
+	if msg.Time.IsZero() {
+		msg.Time = now
+	}
+	if ps.dedup != nil && ps.dedup.duplicate(msg, now) {
+		return nil
+	}
+	injectTrace(ctx, msg)
 	// Matches is a *sublist.SublistResult type from the NATS server.
 	// - Psubs are plain subscribers
 	// - Qsubs are queue group subscribers
-	matches := ps.subs.Match(subj)
+	var matches *sublist.SublistResult
+	if ps.retained != nil && ps.retained.retains(msg.Subject) {
+		matches = ps.retained.match(ps.subs, msg)
+	} else {
+		matches = ps.subs.Match(msg.Subject)
+	}
+	if ps.observer != nil {
+		ps.observer.Publish(ctx, msg, len(matches.Psubs)+len(matches.Qsubs))
+	}
 	for _, sub := range matches.Psubs {
-		pub(subj, message, sub, matches)
-	}
-
-	// TODO: Explore the "least loaded of 2 random options" idea, for which
-	// I think we would need to track total messages sent for each sub:
-	// > From https://danluu.com/2choices-eviction/ (yao mentioned it too):
-	// > The Power of Two Random Choices: A Survey of Techniques and Results by Mitzenmacher, Richa, and Sitaraman
-	// > (https://www.eecs.harvard.edu/~michaelm/postscripts/handbook2001.pdf)
-	// > has a great explanation. The mathematical intuition is that if we (randomly) throw n balls into n bins,
-	// > the maximum number of balls in any bin is O(log n / log log n) with high probability, which is pretty much
-	// > just O(log n). But if (instead of choosing randomly) we choose the least loaded of k random bins, the maximum
-	// > is O(log log n / log k) with high probability, i.e., even with two random choices, it's basically O(log log n)
-	// > and each additional choice only reduces the load by a constant factor.
+		ps.pub(msg, sub, matches)
+	}
 	for _, subs := range matches.Qsubs {
-		// Publish to a random subscriber from each queue group
-		sub := subs[rand.IntN(len(subs))]
-		pub(subj, message, sub, matches)
+		// Publish to one subscriber from each queue group, chosen by the queue strategy
+		ps.pub(msg, ps.queue(subs, msg), matches)
 	}
+	return nil
 }
 
 // Publish a message onto the given subject for the given subscriber.
-func pub[M any](subj string, message M, sub *sublist.Subscription, matches *sublist.SublistResult) {
-	if sub.Debug {
-		// DebugSub handlers are passed the subscriptions that matched this pub subject.
-		handler := sub.Value.(func(string, any, *sublist.SublistResult))
-		handler(subj, message, matches)
-	} else {
-		// Regular handlers are invoked with the subject and message.
-		handler := sub.Value.(func(string, any))
-		handler(subj, message)
+// Messages to subscribers that are replaying retained messages are held until the replay
+// is complete, and coalescing and batching subscribers hold onto the message first (see
+// WithReplayRetained, WithCoalesce and WithBatch). Synchronous subscribers are called
+// directly, while async subscribers have the call placed into their mailbox.
+func (ps *PubSub) pub(msg *Msg[any], sub *sublist.Subscription, matches *sublist.SublistResult) {
+	s := sub.Value.(*subscriber)
+	if s.replay != nil && s.replay.hold(msg, matches) {
+		return
+	}
+	ps.pubCoalesce(s, msg, matches)
+}
+
+// pubCoalesce adds the message to the subscriber's coalescer, if it has one, or passes it on.
+func (ps *PubSub) pubCoalesce(s *subscriber, msg *Msg[any], matches *sublist.SublistResult) {
+	if s.coalesce != nil {
+		s.coalesce.add(msg, matches)
+		return
+	}
+	ps.pubBatch(s, msg, matches)
+}
+
+// pubBatch adds the message to the subscriber's batch, if it has one, or dispatches it.
+func (ps *PubSub) pubBatch(s *subscriber, msg *Msg[any], matches *sublist.SublistResult) {
+	if s.batch != nil {
+		s.batch.add(msg)
+		return
+	}
+	ps.dispatch(s, msg, matches)
+}
+
+// dispatch calls the subscriber's handler, or places the call into its mailbox.
+func (ps *PubSub) dispatch(s *subscriber, msg *Msg[any], matches *sublist.SublistResult) {
+	s.inFlight.Add(1)
+	if s.mailbox == nil {
+		ps.deliver(s, msg, matches)
+		return
+	}
+	dropped, disconnect := s.mailbox.offer(func() { ps.deliver(s, msg, matches) })
+	// Each message dropped from the mailbox was counted as in flight when it was offered
+	s.inFlight.Add(-int64(dropped))
+	ps.overflow(s, msg, dropped, disconnect)
+}
+
+// deliver calls the subscriber's handler and records any overflow it reports.
+func (ps *PubSub) deliver(s *subscriber, msg *Msg[any], matches *sublist.SublistResult) {
+	defer func() {
+		if err := recover(); err != nil {
+			ps.handlerPanic(s, msg, err)
+		}
+	}()
+	ctx := extractTrace(msg)
+	if ps.observer != nil {
+		var done func()
+		ctx, done = ps.observer.Deliver(ctx, s.sub, msg)
+		defer done()
+	}
+	dropped, disconnect := s.call(ctx, msg, matches)
+	s.failing.Store(0)
+	ps.overflow(s, msg, dropped, disconnect)
+}
+
+// handlerPanic reports a recovered panic and cancels subscriptions that keep panicking.
+func (ps *PubSub) handlerPanic(s *subscriber, msg *Msg[any], err any) {
+	s.panics.Add(1)
+	stack := debug.Stack()
+	ps.onError(s.sub, msg.Subject, err, stack)
+	if ps.observer != nil {
+		ps.observer.Error(s.sub, msg, &PanicError{Value: err, Stack: stack})
+	}
+	if ps.maxPanics > 0 && s.failing.Add(1) >= int64(ps.maxPanics) {
+		s.cancel()
+	}
+}
+
+// publishError reports the error from a publish made on behalf of a subscriber, such as
+// the reply of a responder, or by the PubSub itself, such as a scheduled publish, in which
+// case s is nil. Since there is no caller to return the error to, it's passed to the observer
+// if there is one, and logged otherwise. Publishes are expected to fail once the PubSub is
+// closed, so ErrClosed is not reported.
+func (ps *PubSub) publishError(s *subscriber, msg *Msg[any], err error) {
+	if err == nil || errors.Is(err, ErrClosed) {
+		return
+	}
+	var sub *sublist.Subscription
+	if s != nil {
+		sub = s.sub
+	}
+	if ps.observer != nil {
+		ps.observer.Error(sub, msg, err)
+		return
+	}
+	if sub == nil {
+		log.Printf("pubsub: scheduled publish to %q failed: %v", msg.Subject, err)
+		return
+	}
+	log.Printf("pubsub: publish to %q by handler subscribed to %q at %s:%d (%s) failed: %v",
+		msg.Subject, sub.Subject, sub.File, sub.Line, sub.FuncName, err)
+}
+
+// overflow records dropped messages and disconnects slow consumers.
+func (ps *PubSub) overflow(s *subscriber, msg *Msg[any], dropped int, disconnect bool) {
+	if dropped > 0 {
+		s.dropped.Add(uint64(dropped))
+		ps.dropped.Add(uint64(dropped))
+		if ps.observer != nil {
+			for range dropped {
+				ps.observer.Error(s.sub, msg, ErrDropped)
+			}
+		}
+	}
+	if disconnect {
+		s.cancel()
 	}
 }
 
+// Dropped returns the total number of messages dropped by async and channel subscribers
+// across the lifetime of this PubSub.
+func (ps *PubSub) Dropped() uint64 {
+	return ps.dropped.Load()
+}
+
+// SubInfo describes a subscription along with its delivery counters.
+type SubInfo struct {
+	ID       string
+	Subject  string
+	Queue    string
+	File     string
+	Line     int
+	FuncName string
+	Debug    bool
+	Async    bool
+
+	Delivered uint64 // Messages passed to the handler
+	Dropped   uint64 // Messages dropped due to mailbox overflow
+	Pending   int    // Messages waiting in the mailbox of an async subscriber
+	InFlight  int64  // Messages waiting in the mailbox or being handled
+	Panics    uint64 // Times the handler panicked
+
+	LastDelivery time.Time // When the handler was last called, or zero if never
+}
+
+// Subscriptions returns information about all active subscriptions.
+// Stream consumers (see SubStream) are included, with their filter as the subject.
+func (ps *PubSub) Subscriptions() []SubInfo {
+	subs := ps.subscribers()
+	infos := make([]SubInfo, 0, len(subs))
+	for _, s := range subs {
+		infos = append(infos, subInfo(s.sub))
+	}
+	return infos
+}
+
+func subInfo(sub *sublist.Subscription) SubInfo {
+	s := sub.Value.(*subscriber)
+	info := SubInfo{
+		ID:        sub.ID,
+		Subject:   string(sub.Subject),
+		Queue:     string(sub.Queue),
+		File:      sub.File,
+		Line:      sub.Line,
+		FuncName:  sub.FuncName,
+		Debug:     sub.Debug,
+		Async:     s.mailbox != nil,
+		Delivered: s.delivered.Load(),
+		Dropped:   s.dropped.Load(),
+		InFlight:  s.inFlight.Load(),
+		Panics:    s.panics.Load(),
+	}
+	if s.mailbox != nil {
+		info.Pending = len(s.mailbox.ch)
+	}
+	if t := s.lastCall.Load(); t != 0 {
+		info.LastDelivery = time.Unix(0, t)
+	}
+	return info
+}
+
 // Represents an individual option using the "functional options" pattern
 type SubOption func(*SubOptions)
 
@@ -183,6 +715,35 @@ func WithID(id string) SubOption {
 	}
 }
 
+// WithRetained retains the last message published to each subject matching any of the
+// filters, or to every subject if no filters are given, so that subscribers created with
+// WithReplayRetained receive the current state when they subscribe, like MQTT retained messages.
+func WithRetained(filters ...string) PubSubOption {
+	return func(o *PubSubOptions) {
+		o.Retain = true
+		o.RetainFilters = filters
+	}
+}
+
+// WithReplayRetained delivers every retained message matching the subscription's subject
+// before any live messages. Has no effect unless the PubSub was created WithRetained.
+func WithReplayRetained() SubOption {
+	return func(s *SubOptions) {
+		s.Replay = true
+	}
+}
+
+// WithAsync delivers messages to the handler on a dedicated goroutine for this subscription,
+// so that a slow handler does not stall publishers. Up to bufSize messages are held in the
+// subscription's mailbox, and the policy determines what happens when the mailbox is full.
+func WithAsync(bufSize int, policy OverflowPolicy) SubOption {
+	return func(s *SubOptions) {
+		s.Async = true
+		s.BufSize = bufSize
+		s.Overflow = policy
+	}
+}
+
 // IsValidSubject returns whether `subject` is a valid literal NATS subject
 // suitable for publishing to.
 func IsValidPubSubject(subject string) bool {
@@ -194,6 +755,3 @@ func IsValidPubSubject(subject string) bool {
 func IsValidPubToken(token string) bool {
 	return IsValidPubSubject(token) && !strings.ContainsRune(token, '.')
 }
-
-// Ideas:
-// - Explore the idea of making a "SubSeq" function to treat a subscription as a Seq of messages.
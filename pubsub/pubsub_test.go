@@ -0,0 +1,562 @@
+package pubsub
+
+import (
+	"context"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/yurivish/toolkit/assert"
+	"github.com/yurivish/toolkit/sublist"
+)
+
+func TestPubSub(t *testing.T) {
+	ps := NewPubSub()
+	var got []string
+	cancel := Sub(ps, "a.*", func(subj string, msg string) {
+		got = append(got, subj+"="+msg)
+	})
+	Pub(ps, "a.b", "one")
+	Pub(ps, "b.c", "two")
+	cancel()
+	Pub(ps, "a.c", "three")
+	assert.Equal(t, got, []string{"a.b=one"})
+}
+
+func TestQueueGroup(t *testing.T) {
+	ps := NewPubSub()
+	var n1, n2 int
+	Sub(ps, "q", func(string, int) { n1++ }, WithQueueGroup("g"))
+	Sub(ps, "q", func(string, int) { n2++ }, WithQueueGroup("g"))
+	for i := range 100 {
+		Pub(ps, "q", i)
+	}
+	assert.Equal(t, n1+n2, 100)
+}
+
+func TestSubChan(t *testing.T) {
+	ps := NewPubSub()
+	ctx, cancel := context.WithCancel(context.Background())
+	ch := SubChan[int](ps, ctx, "nums", 2)
+	Pub(ps, "nums", 1)
+	Pub(ps, "nums", 2)
+	assert.Equal(t, <-ch, 1)
+	assert.Equal(t, <-ch, 2)
+	cancel()
+	_, ok := <-ch
+	assert.False(t, ok)
+}
+
+func TestSubscriptions(t *testing.T) {
+	ps := NewPubSub()
+	cancel := Sub(ps, "info", func(string, int) {}, WithID("info-sub"))
+	Pub(ps, "info", 1)
+	Pub(ps, "info", 2)
+	infos := ps.Subscriptions()
+	assert.Equal(t, len(infos), 1)
+	assert.Equal(t, infos[0].ID, "info-sub")
+	assert.Equal(t, infos[0].Subject, "info")
+	assert.Equal(t, infos[0].Delivered, uint64(2))
+	assert.MatchesRegexp(t, infos[0].File, `pubsub_test\.go$`)
+	cancel()
+	assert.Equal(t, len(ps.Subscriptions()), 0)
+}
+
+func TestAsyncDoesNotBlockPublisher(t *testing.T) {
+	ps := NewPubSub()
+	release := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(3)
+	cancel := Sub(ps, "slow", func(string, int) {
+		<-release
+		wg.Done()
+	}, WithAsync(3, Block))
+	defer cancel()
+
+	// With a synchronous handler, the first Pub would never return.
+	for i := range 3 {
+		Pub(ps, "slow", i)
+	}
+	close(release)
+	wg.Wait()
+}
+
+// blockedAsyncSub subscribes an async handler that blocks on its first message
+// until release is closed, and returns the messages it received.
+func blockedAsyncSub(t *testing.T, ps *PubSub, bufSize int, policy OverflowPolicy) (release chan struct{}, received <-chan int) {
+	t.Helper()
+	release = make(chan struct{})
+	started := make(chan struct{})
+	out := make(chan int, 100)
+	var once sync.Once
+	cancel := Sub(ps, "x", func(_ string, msg int) {
+		once.Do(func() {
+			close(started)
+			<-release
+		})
+		out <- msg
+	}, WithAsync(bufSize, policy))
+	t.Cleanup(cancel)
+	Pub(ps, "x", 0)
+	<-started
+	return release, out
+}
+
+func collect(ch <-chan int, n int) []int {
+	var got []int
+	for range n {
+		select {
+		case v := <-ch:
+			got = append(got, v)
+		case <-time.After(time.Second):
+			return got
+		}
+	}
+	return got
+}
+
+func TestAsyncDropNewest(t *testing.T) {
+	ps := NewPubSub()
+	release, received := blockedAsyncSub(t, ps, 2, DropNewest)
+	for i := 1; i <= 4; i++ {
+		Pub(ps, "x", i)
+	}
+	close(release)
+	assert.Equal(t, collect(received, 3), []int{0, 1, 2})
+	assert.Equal(t, ps.Dropped(), uint64(2))
+	assert.Equal(t, ps.Subscriptions()[0].Dropped, uint64(2))
+}
+
+func TestAsyncDropOldest(t *testing.T) {
+	ps := NewPubSub()
+	release, received := blockedAsyncSub(t, ps, 2, DropOldest)
+	for i := 1; i <= 4; i++ {
+		Pub(ps, "x", i)
+	}
+	close(release)
+	assert.Equal(t, collect(received, 3), []int{0, 3, 4})
+	assert.Equal(t, ps.Dropped(), uint64(2))
+}
+
+func TestAsyncDisconnect(t *testing.T) {
+	ps := NewPubSub()
+	release, _ := blockedAsyncSub(t, ps, 1, Disconnect)
+	defer close(release)
+	Pub(ps, "x", 1)
+	assert.Equal(t, len(ps.Subscriptions()), 1)
+	Pub(ps, "x", 2)
+	assert.Equal(t, len(ps.Subscriptions()), 0)
+	assert.Equal(t, ps.Dropped(), uint64(1))
+}
+
+func TestRequestRespond(t *testing.T) {
+	ps := NewPubSub()
+	cancel := Respond(ps, "double", func(_ string, n int) int { return 2 * n })
+	resp, err := Request[int, int](context.Background(), ps, "double", 21)
+	assert.Nil(t, err)
+	assert.Equal(t, resp, 42)
+	cancel()
+
+	_, err = Request[int, int](context.Background(), ps, "double", 21)
+	assert.ErrorIs(t, err, ErrNoResponders)
+}
+
+func TestRequestInternalSubscriptions(t *testing.T) {
+	ps := NewPubSub()
+	// Neither a stream capturing everything nor a transform to a subject without subscribers responds
+	_, err := ps.AddStream("all", []string{">"}, StreamLimits{})
+	assert.Nil(t, err)
+	_, err = ps.AddTransform("v1.double", "double")
+	assert.Nil(t, err)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	_, err = Request[int, int](ctx, ps, "v1.double", 21)
+	assert.ErrorIs(t, err, ErrNoResponders)
+
+	// Once the destination has a responder, requests go through the transform
+	defer Respond(ps, "double", func(_ string, n int) int { return 2 * n })()
+	resp, err := Request[int, int](context.Background(), ps, "v1.double", 21)
+	assert.Nil(t, err)
+	assert.Equal(t, resp, 42)
+}
+
+func TestRequestTimeout(t *testing.T) {
+	ps := NewPubSub()
+	// A subscriber that never responds
+	defer Sub(ps, "void", func(string, int) {})()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err := Request[int, int](ctx, ps, "void", 1)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+}
+
+func TestRespondReplyError(t *testing.T) {
+	m := NewMetrics()
+	ps := NewPubSub(WithObserver(m))
+	// Replies must be strings, but the responder replies with ints
+	_, err := Register[string](ps, "_INBOX.>")
+	assert.Nil(t, err)
+	defer Respond(ps, "double", func(_ string, n int) int { return 2 * n }, WithID("doubler"))()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err = Request[int, int](ctx, ps, "double", 21)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+
+	var b strings.Builder
+	assert.Nil(t, m.WritePrometheus(&b))
+	assert.MatchesRegexp(t, b.String(), `pubsub_subscription_errors_total\{subscription="double",queue="",id="doubler",site="[^"]*"\} 1\n`)
+}
+
+func TestRespondQueueGroup(t *testing.T) {
+	ps := NewPubSub()
+	counts := map[string]int{}
+	for _, name := range []string{"a", "b", "c"} {
+		Respond(ps, "svc", func(string, int) string { return name }, WithQueueGroup("workers"))
+	}
+	for range 300 {
+		name, err := Request[int, string](context.Background(), ps, "svc", 0)
+		assert.Nil(t, err)
+		counts[name]++
+	}
+	// Each request is handled by exactly one responder
+	assert.Equal(t, counts["a"]+counts["b"]+counts["c"], 300)
+	assert.Equal(t, len(counts), 3)
+}
+
+func TestNewInbox(t *testing.T) {
+	a, b := NewInbox(), NewInbox()
+	assert.NotEqual(t, a, b)
+	assert.True(t, IsValidPubSubject(a))
+	assert.MatchesRegexp(t, a, `^_INBOX\.`)
+}
+
+func TestPubMsgSubMsg(t *testing.T) {
+	ps := NewPubSub()
+	var got *Msg[string]
+	var plain string
+	SubMsg(ps, "env.>", func(msg *Msg[string]) { got = msg })
+	Sub(ps, "env.>", func(_ string, msg string) { plain = msg })
+
+	header := Header{}
+	header.Set("Trace-Id", "abc")
+	header.Add("Trace-Id", "def")
+	PubMsg(ps, &Msg[string]{Subject: "env.a", Reply: "inbox", Header: header, Data: "hi"})
+
+	assert.Equal(t, got.Subject, "env.a")
+	assert.Equal(t, got.Reply, "inbox")
+	assert.Equal(t, got.Data, "hi")
+	assert.Equal(t, got.Header.Get("Trace-Id"), "abc")
+	assert.Equal(t, got.Header.Values("Trace-Id"), []string{"abc", "def"})
+	assert.Equal(t, got.Header.Get("trace-id"), "")
+	assert.False(t, got.Time.IsZero())
+	assert.Equal(t, plain, "hi")
+
+	// Plain publishes arrive with an envelope too
+	Pub(ps, "env.b", "there")
+	assert.Equal(t, got.Subject, "env.b")
+	assert.Equal(t, got.Data, "there")
+	assert.Nil(t, got.Header)
+}
+
+// queueCounts publishes n messages to a queue group of size k and returns the
+// number of messages received by each member.
+func queueCounts(ps *PubSub, k, n int, key func(int) string) []int {
+	counts := make([]int, k)
+	for i := range k {
+		Sub(ps, "work", func(string, int) { counts[i]++ }, WithQueueGroup("g"))
+	}
+	for i := range n {
+		PubMsg(ps, &Msg[int]{Subject: "work", Header: Header{"Key": {key(i)}}, Data: i})
+	}
+	return counts
+}
+
+func TestQueueRoundRobin(t *testing.T) {
+	ps := NewPubSub(WithQueueStrategy(QueueRoundRobin()))
+	counts := queueCounts(ps, 3, 30, func(int) string { return "" })
+	assert.Equal(t, counts, []int{10, 10, 10})
+}
+
+func TestQueueRoundRobinPerSubject(t *testing.T) {
+	ps := NewPubSub(WithQueueStrategy(QueueRoundRobin()))
+	counts := map[string]int{}
+	var cancels []context.CancelFunc
+	for _, subj := range []string{"a", "b"} {
+		for i := range 2 {
+			name := subj + strconv.Itoa(i)
+			cancels = append(cancels, Sub(ps, subj, func(string, int) { counts[name]++ }, WithQueueGroup("workers")))
+		}
+	}
+	// Interleaved publishes don't share a counter, which would send each subject's
+	// messages to the same member every time.
+	for i := range 10 {
+		Pub(ps, "a", i)
+		Pub(ps, "b", i)
+	}
+	assert.Equal(t, counts, map[string]int{"a0": 5, "a1": 5, "b0": 5, "b1": 5})
+
+	assert.Equal(t, len(ps.queueGroups), 2)
+	for _, cancel := range cancels {
+		cancel()
+		cancel()
+	}
+	assert.Equal(t, len(ps.queueGroups), 0)
+}
+
+func TestQueueLeastDelivered(t *testing.T) {
+	ps := NewPubSub(WithQueueStrategy(QueueLeastDelivered()))
+	counts := queueCounts(ps, 2, 100, func(int) string { return "" })
+	// With two members, the less loaded member is always chosen
+	assert.Equal(t, counts, []int{50, 50})
+	for _, info := range ps.Subscriptions() {
+		assert.Equal(t, info.Delivered, uint64(50))
+		assert.Equal(t, info.InFlight, int64(0))
+	}
+}
+
+func TestQueueLeastInFlight(t *testing.T) {
+	ps := NewPubSub(WithQueueStrategy(QueueLeastInFlight()))
+	started, release := make(chan struct{}), make(chan struct{})
+	defer close(release)
+	idle := 0
+	Sub(ps, "work", func(string, int) { close(started); <-release }, WithQueueGroup("g"), WithAsync(10, Block))
+	Pub(ps, "work", 0)
+	<-started
+	Sub(ps, "work", func(string, int) { idle++ }, WithQueueGroup("g"))
+	// The first subscriber now has a message in flight, so the idle one gets the rest.
+	for i := range 10 {
+		Pub(ps, "work", i)
+	}
+	assert.Equal(t, idle, 10)
+}
+
+func TestQueueHash(t *testing.T) {
+	ps := NewPubSub(WithQueueStrategy(QueueHash(func(msg *Msg[any]) string { return msg.Header.Get("Key") })))
+	counts := queueCounts(ps, 4, 100, func(int) string { return "same" })
+	assert.True(t, slices.Contains(counts, 100))
+
+	ps = NewPubSub(WithQueueStrategy(QueueHash(func(msg *Msg[any]) string { return msg.Header.Get("Key") })))
+	counts = queueCounts(ps, 4, 1000, func(i int) string { return strconv.Itoa(i) })
+	for _, c := range counts {
+		assert.True(t, c > 100)
+	}
+}
+
+func TestSubChanDropNewest(t *testing.T) {
+	ps := NewPubSub()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ch := SubChan[int](ps, ctx, "nums", 2, WithAsync(0, DropNewest))
+	for i := range 5 {
+		Pub(ps, "nums", i)
+	}
+	assert.Equal(t, <-ch, 0)
+	assert.Equal(t, <-ch, 1)
+	assert.Equal(t, ps.Dropped(), uint64(3))
+	assert.Equal(t, ps.Subscriptions()[0].Dropped, uint64(3))
+}
+
+func TestSubSeq(t *testing.T) {
+	ps := NewPubSub()
+	done := make(chan []string)
+	go func() {
+		var got []string
+		for subj, msg := range SubSeq[int](context.Background(), ps, "seq.*") {
+			got = append(got, subj+"="+strconv.Itoa(msg))
+			if len(got) == 3 {
+				break
+			}
+		}
+		done <- got
+	}()
+	for len(ps.Subscriptions()) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	assert.MatchesRegexp(t, ps.Subscriptions()[0].File, `pubsub_test\.go$`)
+	for i := range 3 {
+		Pub(ps, "seq."+strconv.Itoa(i), i)
+	}
+	assert.Equal(t, <-done, []string{"seq.0=0", "seq.1=1", "seq.2=2"})
+	// Breaking out of the loop unsubscribes
+	assert.Equal(t, len(ps.Subscriptions()), 0)
+}
+
+func TestSubSeqContextCancel(t *testing.T) {
+	ps := NewPubSub()
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		for range SubSeq[int](ctx, ps, "seq", WithAsync(1, DropOldest)) {
+		}
+		close(done)
+	}()
+	for len(ps.Subscriptions()) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	cancel()
+	<-done
+	for len(ps.Subscriptions()) > 0 {
+		time.Sleep(time.Millisecond)
+	}
+	// Publishing after the loop has exited is a no-op
+	Pub(ps, "seq", 1)
+}
+
+func TestSubSeqDisconnect(t *testing.T) {
+	ps := NewPubSub()
+	started := make(chan struct{})
+	done := make(chan int)
+	go func() {
+		n := 0
+		for range SubSeq[int](context.Background(), ps, "seq", WithAsync(1, Disconnect)) {
+			if n == 0 {
+				close(started)
+				time.Sleep(10 * time.Millisecond)
+			}
+			n++
+		}
+		done <- n
+	}()
+	for len(ps.Subscriptions()) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	Pub(ps, "seq", 0)
+	<-started
+	Pub(ps, "seq", 1) // Fills the buffer
+	Pub(ps, "seq", 2) // Disconnects the slow consumer, which ends the loop
+	assert.Equal(t, <-done, 2)
+}
+
+func TestRetained(t *testing.T) {
+	ps := NewPubSub(WithRetained("state.>"))
+	Pub(ps, "state.a", 1)
+	Pub(ps, "state.a", 2)
+	Pub(ps, "state.b.c", 3)
+	Pub(ps, "events.x", 4)
+	assert.Equal(t, ps.NumRetained(), 2)
+
+	got := map[string]int{}
+	Sub(ps, ">", func(subj string, msg int) { got[subj] = msg }, WithReplayRetained())
+	assert.Equal(t, got, map[string]int{"state.a": 2, "state.b.c": 3})
+
+	// Subscriptions without the option only see live messages
+	var live []int
+	Sub(ps, "state.*", func(_ string, msg int) { live = append(live, msg) })
+	Pub(ps, "state.a", 5)
+	assert.Equal(t, live, []int{5})
+	assert.Equal(t, got["state.a"], 5)
+
+	// Replay respects the subscription's filter
+	var filtered []int
+	Sub(ps, "state.*", func(_ string, msg int) { filtered = append(filtered, msg) }, WithReplayRetained())
+	assert.Equal(t, filtered, []int{5})
+
+	assert.True(t, ps.ClearRetained("state.a"))
+	assert.False(t, ps.ClearRetained("state.a"))
+	var cleared []int
+	Sub(ps, "state.*", func(_ string, msg int) { cleared = append(cleared, msg) }, WithReplayRetained())
+	assert.Equal(t, len(cleared), 0)
+}
+
+func TestRetainedAsyncReplay(t *testing.T) {
+	ps := NewPubSub(WithRetained())
+	Pub(ps, "a", "x")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ch := SubChan[string](ps, ctx, "a", 1, WithReplayRetained())
+	assert.Equal(t, <-ch, "x")
+}
+
+func TestRetainedReplayRace(t *testing.T) {
+	for range 200 {
+		ps := NewPubSub(WithRetained())
+		Pub(ps, "state", 0)
+		var wg sync.WaitGroup
+		wg.Go(func() { Pub(ps, "state", 1) })
+		var mu sync.Mutex
+		var last []int
+		Sub(ps, "state", func(_ string, n int) {
+			mu.Lock()
+			last = append(last, n)
+			mu.Unlock()
+		}, WithReplayRetained())
+		wg.Wait()
+		// Whether the new value arrives live or by replay, it is never followed by the old one
+		mu.Lock()
+		assert.Equal(t, last[len(last)-1], 1)
+		mu.Unlock()
+	}
+}
+
+func TestRetainedSubSeqReplay(t *testing.T) {
+	ps := NewPubSub(WithRetained())
+	for i := range 3 {
+		Pub(ps, "n."+strconv.Itoa(i), i)
+	}
+	sum := 0
+	for _, msg := range SubSeq[int](context.Background(), ps, "n.*", WithReplayRetained()) {
+		sum += msg
+		if sum == 0+1+2 {
+			break
+		}
+	}
+	assert.Equal(t, sum, 3)
+}
+
+func TestHandlerPanic(t *testing.T) {
+	type report struct {
+		subject, file string
+		err           any
+	}
+	var reports []report
+	ps := NewPubSub(WithOnHandlerError(func(sub *sublist.Subscription, subject string, err any, stack []byte) {
+		reports = append(reports, report{subject, sub.File, err})
+		assert.True(t, len(stack) > 0)
+	}))
+	var got []int
+	Sub(ps, "a", func(_ string, msg int) { panic("boom") })
+	Sub(ps, "a", func(_ string, msg int) { got = append(got, msg) })
+	Pub(ps, "a", 1)
+	Pub(ps, "a", 2)
+	assert.Equal(t, got, []int{1, 2})
+	assert.Equal(t, len(reports), 2)
+	assert.Equal(t, reports[0].subject, "a")
+	assert.Equal(t, reports[0].err, any("boom"))
+	assert.MatchesRegexp(t, reports[0].file, `pubsub_test\.go$`)
+
+	var panics uint64
+	for _, info := range ps.Subscriptions() {
+		panics += info.Panics
+	}
+	assert.Equal(t, panics, uint64(2))
+}
+
+func TestMaxPanics(t *testing.T) {
+	errs := make(chan any, 10)
+	ps := NewPubSub(WithMaxPanics(3), WithOnHandlerError(func(_ *sublist.Subscription, _ string, err any, _ []byte) {
+		errs <- err
+	}))
+	Sub(ps, "a", func(_ string, msg int) {
+		if msg%2 == 0 {
+			panic(msg)
+		}
+	}, WithAsync(10, Block))
+	// Successful deliveries reset the count
+	for _, msg := range []int{0, 2, 1, 4, 6} {
+		Pub(ps, "a", msg)
+	}
+	for range 4 {
+		<-errs
+	}
+	assert.Equal(t, len(ps.Subscriptions()), 1)
+	Pub(ps, "a", 8)
+	assert.Equal(t, <-errs, any(8))
+	// Cancellation happens after the hook returns
+	for len(ps.Subscriptions()) > 0 {
+		time.Sleep(time.Millisecond)
+	}
+}
@@ -0,0 +1,143 @@
+package pubsub
+
+import (
+	"encoding/binary"
+	"hash/maphash"
+	"math/rand/v2"
+	"sync/atomic"
+
+	"github.com/yurivish/toolkit/sublist"
+)
+
+// QueueStrategy picks which member of a queue group receives a message.
+// The group is never empty.
+type QueueStrategy func(group []*sublist.Subscription, msg *Msg[any]) *sublist.Subscription
+
+// Delivered returns the number of messages passed to the handler of a subscription
+// created by this package, for use by custom queue strategies.
+func Delivered(sub *sublist.Subscription) uint64 {
+	return sub.Value.(*subscriber).delivered.Load()
+}
+
+// InFlight returns the number of messages that have been published to a subscription
+// created by this package but not yet fully handled, for use by custom queue strategies.
+func InFlight(sub *sublist.Subscription) int64 {
+	return sub.Value.(*subscriber).inFlight.Load()
+}
+
+// QueueRandom picks a uniformly random member of the group.
+func QueueRandom() QueueStrategy {
+	return func(group []*sublist.Subscription, _ *Msg[any]) *sublist.Subscription {
+		return group[rand.IntN(len(group))]
+	}
+}
+
+// QueueRoundRobin cycles through the members of each queue group in turn.
+// Since group membership can change between publishes, this is best-effort.
+//
+// Each subject and queue name has its own counter, which is discarded once the
+// last member unsubscribes. When a message matches members of the same queue
+// group subscribed to different subjects, one of their counters is used.
+func QueueRoundRobin() QueueStrategy {
+	return func(group []*sublist.Subscription, _ *Msg[any]) *sublist.Subscription {
+		counter := &group[0].Value.(*subscriber).group.next
+		return group[(counter.Add(1)-1)%uint64(len(group))]
+	}
+}
+
+// queueGroup is shared by the subscriptions to a subject with the same queue name,
+// to hold per-group state for queue strategies.
+type queueGroup struct {
+	key  string // Key in ps.queueGroups
+	refs int    // Number of members, guarded by ps.interestMu
+	next atomic.Uint64
+}
+
+// joinQueueGroup returns the group for a new queue subscription. Lock ps.interestMu.
+func (ps *PubSub) joinQueueGroup(subj string, queue []byte) *queueGroup {
+	key := subj + " " + string(queue)
+	g := ps.queueGroups[key]
+	if g == nil {
+		if ps.queueGroups == nil {
+			ps.queueGroups = make(map[string]*queueGroup)
+		}
+		g = &queueGroup{key: key}
+		ps.queueGroups[key] = g
+	}
+	g.refs++
+	return g
+}
+
+// leaveQueueGroup discards the group once its last member leaves. Lock ps.interestMu.
+func (ps *PubSub) leaveQueueGroup(g *queueGroup) {
+	if g.refs--; g.refs == 0 {
+		delete(ps.queueGroups, g.key)
+	}
+}
+
+// QueueLeastInFlight uses the "power of two random choices" to pick the less busy
+// of two random members, as measured by the number of messages in flight to each.
+//
+// > From https://danluu.com/2choices-eviction/ (yao mentioned it too):
+// > The Power of Two Random Choices: A Survey of Techniques and Results by Mitzenmacher, Richa, and Sitaraman
+// > (https://www.eecs.harvard.edu/~michaelm/postscripts/handbook2001.pdf)
+// > has a great explanation. The mathematical intuition is that if we (randomly) throw n balls into n bins,
+// > the maximum number of balls in any bin is O(log n / log log n) with high probability, which is pretty much
+// > just O(log n). But if (instead of choosing randomly) we choose the least loaded of k random bins, the maximum
+// > is O(log log n / log k) with high probability, i.e., even with two random choices, it's basically O(log log n)
+// > and each additional choice only reduces the load by a constant factor.
+func QueueLeastInFlight() QueueStrategy {
+	return twoChoices(func(sub *sublist.Subscription) uint64 {
+		return uint64(max(InFlight(sub), 0))
+	})
+}
+
+// QueueLeastDelivered uses the "power of two random choices" to pick the member
+// with fewer total deliveries of two random members. See QueueLeastInFlight.
+func QueueLeastDelivered() QueueStrategy {
+	return twoChoices(Delivered)
+}
+
+// twoChoices picks the less loaded of two distinct random group members.
+func twoChoices(load func(*sublist.Subscription) uint64) QueueStrategy {
+	return func(group []*sublist.Subscription, _ *Msg[any]) *sublist.Subscription {
+		n := len(group)
+		if n == 1 {
+			return group[0]
+		}
+		i := rand.IntN(n)
+		j := rand.IntN(n - 1)
+		if j >= i {
+			j++ // Ensure the two choices are distinct
+		}
+		a, b := group[i], group[j]
+		if load(b) < load(a) {
+			return b
+		}
+		return a
+	}
+}
+
+// QueueHash consistently sends messages with the same key to the same group member,
+// using rendezvous hashing so that only the keys owned by a departing member move
+// when the group changes.
+func QueueHash(key func(*Msg[any]) string) QueueStrategy {
+	seed := maphash.MakeSeed()
+	return func(group []*sublist.Subscription, msg *Msg[any]) *sublist.Subscription {
+		k := key(msg)
+		var best *sublist.Subscription
+		var bestScore uint64
+		var h maphash.Hash
+		h.SetSeed(seed)
+		var buf [8]byte
+		for _, sub := range group {
+			h.Reset()
+			h.WriteString(k)
+			h.Write(binary.LittleEndian.AppendUint64(buf[:0], sub.Value.(*subscriber).seq))
+			if score := h.Sum64(); best == nil || score > bestScore {
+				best, bestScore = sub, score
+			}
+		}
+		return best
+	}
+}
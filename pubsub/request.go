@@ -0,0 +1,110 @@
+package pubsub
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"slices"
+	"strconv"
+	"sync/atomic"
+
+	"github.com/yurivish/toolkit/sublist"
+)
+
+// ErrNoResponders is returned by Request when nothing is subscribed to the request subject.
+var ErrNoResponders = errors.New("pubsub: no responders")
+
+// Inbox subjects are unique per process: a random prefix chosen at startup
+// followed by a sequence number, eg. _INBOX.Xq3V0d2mPbTL.42
+var (
+	inboxPrefix = "_INBOX." + rand.Text()[:12] + "."
+	inboxSeq    atomic.Uint64
+)
+
+// NewInbox returns a unique subject suitable for receiving replies.
+func NewInbox() string {
+	return inboxPrefix + strconv.FormatUint(inboxSeq.Add(1), 10)
+}
+
+// Request publishes msg onto subj with a unique inbox as the reply subject and waits
+// for the first response, or until the context is done. If there are no subscribers
+// to subj then ErrNoResponders is returned immediately. Subscriptions made by the PubSub
+// itself, such as those of streams and Tap, don't count, while transforms count if their
+// destination has subscribers.
+//
+// Responders in a queue group (see WithQueueGroup) are load-balanced, so that each
+// request is handled by one member of the group, like a NATS service.
+func Request[Req, Resp any](ctx context.Context, ps *PubSub, subj string, msg Req) (Resp, error) {
+	var zero Resp
+	// Buffered so that the response can be delivered synchronously from within Pub
+	ch := make(chan Resp, 1)
+	inbox := NewInbox()
+	cancel := Sub(ps, inbox, func(_ string, resp Resp) {
+		// Keep only the first response
+		select {
+		case ch <- resp:
+		default:
+		}
+	}, WithSkip(1))
+	defer cancel()
+
+	if !ps.hasResponders(subj) {
+		return zero, ErrNoResponders
+	}
+	if err := ps.publishCtx(ctx, &Msg[any]{Subject: subj, Reply: inbox, Data: msg}); err != nil {
+		return zero, err
+	}
+
+	select {
+	case resp := <-ch:
+		return resp, nil
+	case <-ctx.Done():
+		return zero, ctx.Err()
+	}
+}
+
+// hasResponders reports whether a message published to subj reaches a subscription
+// that could reply to it, following transforms to their destinations.
+func (ps *PubSub) hasResponders(subj string) bool {
+	responds := func(sub *sublist.Subscription) bool {
+		s := sub.Value.(*subscriber)
+		if !s.internal {
+			return true
+		}
+		// Transforms can't form cycles, so this terminates
+		if s.forward != nil {
+			out, ok := s.forward(subj)
+			return ok && ps.hasResponders(out)
+		}
+		return false
+	}
+	r := ps.subs.Match(subj)
+	if slices.ContainsFunc(r.Psubs, responds) {
+		return true
+	}
+	for _, qsubs := range r.Qsubs {
+		if slices.ContainsFunc(qsubs, responds) {
+			return true
+		}
+	}
+	return false
+}
+
+// Respond subscribes a responder to subj. Each message is passed to the handler,
+// and the handler's return value is published to the message's reply subject.
+// Messages published without a reply subject are handled, but the response is discarded.
+// Errors publishing the response, such as ErrSchemaMismatch, are reported to the observer
+// (see WithObserver) or logged, since the requester will only see a timeout.
+func Respond[Req, Resp any](ps *PubSub, subj string, handler func(string, Req) Resp, options ...SubOption) context.CancelFunc {
+	var self *subscriber
+	options = append(options, WithSkip(1), func(o *SubOptions) { // Skip this stack frame when recording the subscriber
+		o.onSubscribe = func(s *subscriber) { self = s }
+	})
+	return sub(ps, subj, func(msg *Msg[any]) {
+		resp := handler(msg.Subject, as[Req](msg.Data))
+		if msg.Reply != _EMPTY_ {
+			reply := &Msg[any]{Subject: msg.Reply, Data: resp}
+			ps.publishError(self, reply, ps.publish(reply))
+		}
+	}, options...)
+}
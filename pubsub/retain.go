@@ -0,0 +1,131 @@
+package pubsub
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"github.com/yurivish/toolkit/stree"
+	"github.com/yurivish/toolkit/sublist"
+)
+
+// retained stores the last message published to each retained subject.
+// Storing a message and matching its subscribers happens under the lock, as does
+// inserting a replaying subscription and collecting its retained messages, so that
+// each retained message reaches a replaying subscriber either by replay or live, but not both.
+type retained struct {
+	mu      sync.Mutex
+	msgs    *stree.SubjectTree[*Msg[any]]
+	filters []string
+}
+
+func newRetained(filters []string) *retained {
+	return &retained{msgs: stree.NewSubjectTree[*Msg[any]](), filters: filters}
+}
+
+// retains returns whether messages published to subj are retained.
+func (r *retained) retains(subj string) bool {
+	if len(r.filters) == 0 {
+		return true
+	}
+	for _, filter := range r.filters {
+		if sublist.SubjectMatchesFilter(subj, filter) {
+			return true
+		}
+	}
+	return false
+}
+
+// match stores the message as the last value for its subject and returns its subscribers.
+func (r *retained) match(subs *sublist.Sublist, msg *Msg[any]) *sublist.SublistResult {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.msgs.Insert([]byte(msg.Subject), msg)
+	return subs.Match(msg.Subject)
+}
+
+// insert adds the subscription and returns the retained messages matching its subject.
+func (r *retained) insert(subs *sublist.Sublist, sub *sublist.Subscription) ([]*Msg[any], error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err := subs.Insert(sub); err != nil {
+		return nil, err
+	}
+	var msgs []*Msg[any]
+	r.msgs.Match(sub.Subject, func(_ []byte, msg **Msg[any]) {
+		msgs = append(msgs, *msg)
+	})
+	return msgs, nil
+}
+
+// replayGate holds the messages published to a subscriber while its retained messages are
+// being replayed, and delivers them once the replay is complete, so that a live message
+// racing with the subscription is never followed by an older retained one.
+type replayGate struct {
+	replaying atomic.Bool // Set until the replay and any held messages have been delivered
+
+	mu      sync.Mutex
+	pending []heldMsg
+}
+
+// hold holds onto the message if the replay is in progress, returning whether it did.
+func (g *replayGate) hold(msg *Msg[any], matches *sublist.SublistResult) bool {
+	if !g.replaying.Load() {
+		return false
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if !g.replaying.Load() {
+		return false
+	}
+	g.pending = append(g.pending, heldMsg{msg, matches})
+	return true
+}
+
+// run delivers the retained messages, followed by any that were held in the meantime.
+func (g *replayGate) run(ps *PubSub, s *subscriber, msgs []*Msg[any]) {
+	matches := &sublist.SublistResult{Psubs: []*sublist.Subscription{s.sub}}
+	for _, msg := range msgs {
+		ps.pubCoalesce(s, msg, matches)
+	}
+	for {
+		g.mu.Lock()
+		pending := g.pending
+		g.pending = nil
+		if len(pending) == 0 {
+			g.replaying.Store(false)
+			g.mu.Unlock()
+			return
+		}
+		g.mu.Unlock()
+		for _, held := range pending {
+			ps.pubCoalesce(s, held.msg, held.matches)
+		}
+	}
+}
+
+// delete removes the retained message for subj, returning whether there was one.
+func (r *retained) delete(subj string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	_, found := r.msgs.Delete([]byte(subj))
+	return found
+}
+
+// ClearRetained removes the retained message for a literal subject,
+// returning whether there was one.
+func (ps *PubSub) ClearRetained(subj string) bool {
+	if ps.retained == nil {
+		return false
+	}
+	return ps.retained.delete(subj)
+}
+
+// NumRetained returns the number of subjects with a retained message.
+func (ps *PubSub) NumRetained() int {
+	if ps.retained == nil {
+		return 0
+	}
+	ps.retained.mu.Lock()
+	defer ps.retained.mu.Unlock()
+	return ps.retained.msgs.Size()
+}
@@ -0,0 +1,372 @@
+package pubsub
+
+import (
+	"cmp"
+	"container/heap"
+	"context"
+	"errors"
+	"fmt"
+	"math/bits"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/yurivish/toolkit/sublist"
+)
+
+// ErrInvalidSchedule is returned by PubCron for malformed cron specs, and by PubEvery for
+// intervals that are not positive.
+var ErrInvalidSchedule = errors.New("pubsub: invalid schedule")
+
+// PubAt publishes a message onto the given subject at the given time, or right away if the
+// time has passed. The returned function cancels the publish if it has not happened yet.
+// Scheduled messages are discarded when the PubSub is closed, and are listed by Scheduled.
+func PubAt[M any](ps *PubSub, subj string, message M, at time.Time) (context.CancelFunc, error) {
+	return ps.schedule(&Msg[any]{Subject: subj, Data: message}, at, nil)
+}
+
+// PubAfter publishes a message onto the given subject once the duration has elapsed, like PubAt.
+func PubAfter[M any](ps *PubSub, subj string, message M, d time.Duration) (context.CancelFunc, error) {
+	return ps.schedule(&Msg[any]{Subject: subj, Data: message}, ps.clock.Now().Add(d), nil)
+}
+
+// PubEvery publishes a message onto the given subject at every interval, starting one interval
+// from now, until the returned function is called. Each publish is scheduled relative to the
+// previous one rather than to when it happened, so that the schedule does not drift.
+// If the clock jumps past several intervals, eg. because the system was suspended, only one
+// publish is made to catch up.
+func PubEvery[M any](ps *PubSub, subj string, message M, interval time.Duration) (context.CancelFunc, error) {
+	if interval <= 0 {
+		return nil, fmt.Errorf("%w: interval %v", ErrInvalidSchedule, interval)
+	}
+	next := &recurrence{spec: "@every " + interval.String(), next: func(t time.Time) time.Time { return t.Add(interval) }}
+	return ps.schedule(&Msg[any]{Subject: subj, Data: message}, ps.clock.Now().Add(interval), next)
+}
+
+// PubCron publishes a message onto the given subject on a cron schedule, until the returned
+// function is called. The spec has the five standard fields, minute, hour, day of month, month
+// and day of week, each of which may be *, a number, a range like 1-5, a step like */15 or 1-30/2,
+// or a comma-separated list of these. Day of week 0 or 7 is Sunday, and if both day fields are
+// restricted then either may match, as in cron. The shorthands @hourly, @daily, @weekly,
+// @monthly and @yearly are also accepted. Times are in the location of the clock.
+// As with PubEvery, only one publish is made to catch up if the clock jumps past several times.
+func PubCron[M any](ps *PubSub, subj string, message M, spec string) (context.CancelFunc, error) {
+	c, err := parseCron(spec)
+	if err != nil {
+		return nil, err
+	}
+	next := &recurrence{spec: spec, next: c.next}
+	at := c.next(ps.clock.Now())
+	if at.IsZero() {
+		return nil, fmt.Errorf("%w: %q never matches", ErrInvalidSchedule, spec)
+	}
+	return ps.schedule(&Msg[any]{Subject: subj, Data: message}, at, next)
+}
+
+// ScheduledInfo describes a scheduled publish.
+type ScheduledInfo struct {
+	ID       uint64
+	Subject  string
+	At       time.Time // When the message will next be published
+	Schedule string    // The cron spec or interval of recurring publishes, or empty
+	Data     any
+}
+
+// Scheduled returns the pending scheduled publishes to subjects matching the filter,
+// which may contain wildcards, in the order they will be published.
+func (ps *PubSub) Scheduled(filter string) []ScheduledInfo {
+	s := &ps.scheduler
+	s.mu.Lock()
+	var infos []ScheduledInfo
+	for _, e := range s.heap {
+		if sublist.SubjectMatchesFilter(e.msg.Subject, filter) {
+			info := ScheduledInfo{ID: e.id, Subject: e.msg.Subject, At: e.at, Data: e.msg.Data}
+			if e.recur != nil {
+				info.Schedule = e.recur.spec
+			}
+			infos = append(infos, info)
+		}
+	}
+	s.mu.Unlock()
+	slices.SortFunc(infos, func(a, b ScheduledInfo) int {
+		return cmp.Or(a.At.Compare(b.At), cmp.Compare(a.ID, b.ID))
+	})
+	return infos
+}
+
+// scheduler holds scheduled publishes in a heap ordered by time,
+// with a single timer set for the earliest of them.
+type scheduler struct {
+	mu    sync.Mutex
+	heap  scheduleHeap
+	timer ClockTimer // Nil until the first publish is scheduled
+	seq   uint64
+}
+
+type scheduled struct {
+	id    uint64
+	msg   *Msg[any]
+	at    time.Time
+	recur *recurrence // Nil for one-off publishes
+	index int         // Index in the heap, or -1 once removed
+}
+
+type recurrence struct {
+	spec string
+	next func(time.Time) time.Time // Returns the zero time once there are no more publishes
+}
+
+// schedule adds a publish to the scheduler.
+func (ps *PubSub) schedule(msg *Msg[any], at time.Time, recur *recurrence) (context.CancelFunc, error) {
+	if !IsValidPubSubject(msg.Subject) {
+		return nil, fmt.Errorf("%w: %q", sublist.ErrInvalidSubject, msg.Subject)
+	}
+	if err := ps.schemas.check(msg); err != nil {
+		return nil, err
+	}
+	if ps.Closed() {
+		return nil, ErrClosed
+	}
+	s := &ps.scheduler
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.seq++
+	e := &scheduled{id: s.seq, msg: msg, at: at, recur: recur}
+	heap.Push(&s.heap, e)
+	ps.armScheduler()
+	return func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if e.index >= 0 {
+			heap.Remove(&s.heap, e.index)
+			ps.armScheduler()
+		}
+	}, nil
+}
+
+// armScheduler sets the timer for the earliest scheduled publish. Lock should be held.
+func (ps *PubSub) armScheduler() {
+	s := &ps.scheduler
+	if len(s.heap) == 0 {
+		if s.timer != nil {
+			s.timer.Stop()
+		}
+		return
+	}
+	d := s.heap[0].at.Sub(ps.clock.Now())
+	if s.timer == nil {
+		s.timer = ps.clock.AfterFunc(d, ps.runScheduled)
+	} else {
+		s.timer.Reset(d)
+	}
+}
+
+// runScheduled publishes the messages that are due, and reschedules recurring ones.
+func (ps *PubSub) runScheduled() {
+	s := &ps.scheduler
+	s.mu.Lock()
+	now := ps.clock.Now()
+	var due []*Msg[any]
+	for len(s.heap) > 0 && !s.heap[0].at.After(now) {
+		e := s.heap[0]
+		// Each publish gets its own envelope, timestamped when it is published
+		msg := *e.msg
+		due = append(due, &msg)
+		if e.recur != nil {
+			// If the clock jumped past several occurrences, publish once and skip to the next
+			// one in the future rather than publishing a burst to catch up.
+			next := e.recur.next(e.at)
+			for !next.IsZero() && !next.After(now) {
+				next = e.recur.next(next)
+			}
+			if !next.IsZero() {
+				e.at = next
+				heap.Fix(&s.heap, 0)
+				continue
+			}
+		}
+		heap.Pop(&s.heap)
+	}
+	ps.armScheduler()
+	s.mu.Unlock()
+	for _, msg := range due {
+		ps.publishError(nil, msg, ps.publish(msg))
+	}
+}
+
+// stopScheduler discards all scheduled publishes.
+func (ps *PubSub) stopScheduler() {
+	s := &ps.scheduler
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, e := range s.heap {
+		e.index = -1
+	}
+	s.heap = nil
+	ps.armScheduler()
+}
+
+// scheduleHeap implements heap.Interface, ordered by time and then by scheduling order.
+type scheduleHeap []*scheduled
+
+func (h scheduleHeap) Len() int { return len(h) }
+
+func (h scheduleHeap) Less(i, j int) bool {
+	return cmp.Or(h[i].at.Compare(h[j].at), cmp.Compare(h[i].id, h[j].id)) < 0
+}
+
+func (h scheduleHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *scheduleHeap) Push(x any) {
+	e := x.(*scheduled)
+	e.index = len(*h)
+	*h = append(*h, e)
+}
+
+func (h *scheduleHeap) Pop() any {
+	old := *h
+	e := old[len(old)-1]
+	old[len(old)-1] = nil
+	e.index = -1
+	*h = old[:len(old)-1]
+	return e
+}
+
+// --- Cron schedules ---
+
+// cronSchedule holds the allowed values of each field as bit sets.
+type cronSchedule struct {
+	minute, hour, dom, month, dow uint64
+	domStar, dowStar              bool // Whether the day fields are unrestricted
+}
+
+var cronShorthands = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+func parseCron(spec string) (*cronSchedule, error) {
+	expanded := spec
+	if s, ok := cronShorthands[spec]; ok {
+		expanded = s
+	}
+	fields := strings.Fields(expanded)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("%w: %q does not have five fields", ErrInvalidSchedule, spec)
+	}
+	var c cronSchedule
+	var err error
+	parse := func(field string, lo, hi int) uint64 {
+		if err != nil {
+			return 0
+		}
+		var set uint64
+		set, err = parseCronField(field, lo, hi)
+		if err != nil {
+			err = fmt.Errorf("%w: %q: %v", ErrInvalidSchedule, spec, err)
+		}
+		return set
+	}
+	c.minute = parse(fields[0], 0, 59)
+	c.hour = parse(fields[1], 0, 23)
+	c.dom = parse(fields[2], 1, 31)
+	c.month = parse(fields[3], 1, 12)
+	c.dow = parse(fields[4], 0, 7)
+	if err != nil {
+		return nil, err
+	}
+	// Sunday can be written as 0 or 7
+	if c.dow&(1<<7) != 0 {
+		c.dow |= 1
+	}
+	c.domStar = fields[2] == "*" || strings.HasPrefix(fields[2], "*/")
+	c.dowStar = fields[4] == "*" || strings.HasPrefix(fields[4], "*/")
+	return &c, nil
+}
+
+// parseCronField parses a comma-separated list of values, ranges and steps into a bit set.
+func parseCronField(field string, lo, hi int) (uint64, error) {
+	var set uint64
+	for part := range strings.SplitSeq(field, ",") {
+		rng, stepStr, hasStep := strings.Cut(part, "/")
+		step := 1
+		if hasStep {
+			n, err := strconv.Atoi(stepStr)
+			if err != nil || n < 1 {
+				return 0, fmt.Errorf("bad step %q", part)
+			}
+			step = n
+		}
+		start, end := lo, hi
+		if rng != "*" {
+			first, last, isRange := strings.Cut(rng, "-")
+			var err error
+			if start, err = strconv.Atoi(first); err != nil {
+				return 0, fmt.Errorf("bad value %q", part)
+			}
+			end = start
+			if isRange {
+				if end, err = strconv.Atoi(last); err != nil {
+					return 0, fmt.Errorf("bad value %q", part)
+				}
+			} else if hasStep {
+				end = hi // eg. 5/15 means 5-59/15 for minutes
+			}
+		}
+		if start < lo || end > hi || start > end {
+			return 0, fmt.Errorf("%q is out of range %d-%d", part, lo, hi)
+		}
+		for v := start; v <= end; v += step {
+			set |= 1 << v
+		}
+	}
+	return set, nil
+}
+
+func (c *cronSchedule) dayMatches(t time.Time) bool {
+	dom := c.dom&(1<<t.Day()) != 0
+	dow := c.dow&(1<<int(t.Weekday())) != 0
+	if c.domStar || c.dowStar {
+		return dom && dow
+	}
+	return dom || dow
+}
+
+// next returns the first matching time after t, or the zero time if there is none within five years.
+func (c *cronSchedule) next(t time.Time) time.Time {
+	loc := t.Location()
+	t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute()+1, 0, 0, loc)
+	limit := t.Year() + 5
+	for t.Year() <= limit {
+		switch {
+		case c.month&(1<<int(t.Month())) == 0:
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, loc)
+		case !c.dayMatches(t):
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, loc)
+		case c.hour&(1<<t.Hour()) == 0:
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, loc)
+		case c.minute&(1<<t.Minute()) == 0:
+			// Skip straight to the next allowed minute within this hour, if any
+			rest := c.minute >> t.Minute()
+			if rest == 0 {
+				t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, loc)
+			} else {
+				t = t.Add(time.Duration(bits.TrailingZeros64(rest)) * time.Minute)
+			}
+		default:
+			return t
+		}
+	}
+	return time.Time{}
+}
@@ -0,0 +1,146 @@
+package pubsub
+
+import (
+	"testing"
+	"time"
+
+	"github.com/yurivish/toolkit/assert"
+)
+
+func TestPubAt(t *testing.T) {
+	start := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	clock := NewFakeClock(start)
+	ps := NewPubSub(WithClock(clock))
+	var got []string
+	var times []time.Time
+	SubMsg(ps, "jobs.*", func(msg *Msg[string]) {
+		got = append(got, msg.Data)
+		times = append(times, msg.Time)
+	})
+
+	_, err := PubAfter(ps, "jobs.b", "b", 2*time.Minute)
+	assert.Nil(t, err)
+	_, err = PubAt(ps, "jobs.a", "a", start.Add(time.Minute))
+	assert.Nil(t, err)
+	cancel, err := PubAfter(ps, "jobs.c", "c", 3*time.Minute)
+	assert.Nil(t, err)
+	_, err = PubAfter(ps, "other", "d", time.Minute)
+	assert.Nil(t, err)
+	_, err = PubAt(ps, "jobs.*", "e", start)
+	assert.NotNil(t, err)
+
+	pending := ps.Scheduled("jobs.>")
+	assert.Equal(t, len(pending), 3)
+	assert.Equal(t, pending[0].Subject, "jobs.a")
+	assert.Equal(t, pending[0].At, start.Add(time.Minute))
+	assert.Equal(t, pending[2].Data, any("c"))
+
+	cancel()
+	clock.Advance(90 * time.Second)
+	assert.Equal(t, got, []string{"a"})
+	clock.Advance(time.Hour)
+	assert.Equal(t, got, []string{"a", "b"})
+	assert.Equal(t, times, []time.Time{start.Add(time.Minute), start.Add(2 * time.Minute)})
+	assert.Equal(t, len(ps.Scheduled(">")), 0)
+}
+
+func TestPubEvery(t *testing.T) {
+	start := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	clock := NewFakeClock(start)
+	ps := NewPubSub(WithClock(clock))
+	var times []time.Time
+	SubMsg(ps, "tick", func(msg *Msg[int]) { times = append(times, msg.Time) })
+	cancel, err := PubEvery(ps, "tick", 0, 10*time.Second)
+	assert.Nil(t, err)
+	assert.Equal(t, ps.Scheduled("tick")[0].Schedule, "@every 10s")
+
+	clock.Advance(35 * time.Second)
+	assert.Equal(t, times, []time.Time{start.Add(10 * time.Second), start.Add(20 * time.Second), start.Add(30 * time.Second)})
+	cancel()
+	clock.Advance(time.Minute)
+	assert.Equal(t, len(times), 3)
+
+	_, err = PubEvery(ps, "tick", 0, 0)
+	assert.ErrorIs(t, err, ErrInvalidSchedule)
+}
+
+func TestPubEveryClockJump(t *testing.T) {
+	start := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	clock := NewFakeClock(start)
+	ps := NewPubSub(WithClock(clock))
+	var times []time.Time
+	SubMsg(ps, "tick", func(msg *Msg[int]) { times = append(times, msg.Time) })
+	_, err := PubEvery(ps, "tick", 0, 10*time.Second)
+	assert.Nil(t, err)
+
+	// Jump past several ticks without firing the timer along the way, as after a suspend
+	clock.mu.Lock()
+	clock.now = start.Add(65 * time.Second)
+	clock.mu.Unlock()
+	ps.runScheduled()
+	assert.Equal(t, times, []time.Time{start.Add(65 * time.Second)})
+	assert.Equal(t, ps.Scheduled("tick")[0].At, start.Add(70*time.Second))
+}
+
+func TestPubAtError(t *testing.T) {
+	clock := NewFakeClock(time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC))
+	o := &errorObserver{}
+	ps := NewPubSub(WithClock(clock), WithObserver(o))
+	_, err := PubAfter(ps, "n", "a", time.Minute)
+	assert.Nil(t, err)
+
+	// A schema registered after scheduling rejects the message, which is reported when it's due
+	_, err = Register[int](ps, "n")
+	assert.Nil(t, err)
+	clock.Advance(time.Minute)
+	assert.Equal(t, len(o.errs), 1)
+	assert.ErrorIs(t, o.errs[0], ErrSchemaMismatch)
+	assert.True(t, o.subs[0] == nil)
+}
+
+func TestPubCron(t *testing.T) {
+	// A Friday
+	start := time.Date(2024, 3, 1, 8, 58, 0, 0, time.UTC)
+	clock := NewFakeClock(start)
+	ps := NewPubSub(WithClock(clock))
+	var times []time.Time
+	SubMsg(ps, "report", func(msg *Msg[string]) { times = append(times, msg.Time) })
+	_, err := PubCron(ps, "report", "weekly", "0,30 9 * * 1-5")
+	assert.Nil(t, err)
+
+	clock.Advance(4 * 24 * time.Hour)
+	at := func(day, hour, minute int) time.Time { return time.Date(2024, 3, day, hour, minute, 0, 0, time.UTC) }
+	// Friday, then Monday and Tuesday
+	assert.Equal(t, times, []time.Time{at(1, 9, 0), at(1, 9, 30), at(4, 9, 0), at(4, 9, 30)})
+
+	ps.Close()
+	assert.Equal(t, len(ps.Scheduled(">")), 0)
+	_, err = PubAfter(ps, "report", "late", time.Second)
+	assert.ErrorIs(t, err, ErrClosed)
+}
+
+func TestCronNext(t *testing.T) {
+	from := time.Date(2024, 1, 31, 23, 59, 30, 0, time.UTC)
+	for _, tc := range []struct {
+		spec string
+		want time.Time
+	}{
+		{"* * * * *", time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC)},
+		{"*/15 * * * *", time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC)},
+		{"5/20 3 * * *", time.Date(2024, 2, 1, 3, 5, 0, 0, time.UTC)},
+		{"0 0 29 2 *", time.Date(2024, 2, 29, 0, 0, 0, 0, time.UTC)},
+		{"0 12 13 * 5", time.Date(2024, 2, 2, 12, 0, 0, 0, time.UTC)}, // Either day field matches
+		{"0 0 * * 7", time.Date(2024, 2, 4, 0, 0, 0, 0, time.UTC)},
+		{"@monthly", time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC)},
+		{"@yearly", time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)},
+		{"0 0 31 2 *", time.Time{}},
+	} {
+		c, err := parseCron(tc.spec)
+		assert.Nil(t, err)
+		assert.Equal(t, c.next(from), tc.want)
+	}
+	for _, spec := range []string{"", "* * * *", "60 * * * *", "* * 0 * *", "*/0 * * * *", "5-1 * * * *", "a * * * *"} {
+		_, err := parseCron(spec)
+		assert.ErrorIs(t, err, ErrInvalidSchedule)
+	}
+}
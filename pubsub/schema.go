@@ -0,0 +1,145 @@
+package pubsub
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"runtime"
+	"slices"
+	"sync"
+
+	"github.com/yurivish/toolkit/sublist"
+)
+
+var (
+	// ErrSchemaMismatch is returned when publishing a message whose type differs from
+	// the type registered for its subject.
+	ErrSchemaMismatch = errors.New("pubsub: message type does not match schema")
+	// ErrSchemaConflict is returned when registering a type for a subject pattern that
+	// overlaps a pattern registered with a different type.
+	ErrSchemaConflict = errors.New("pubsub: conflicting schema")
+)
+
+// Schema is a subject pattern registered with a message type, see Register.
+// Publishing and subscribing through it is checked at compile time.
+type Schema[M any] struct {
+	ps      *PubSub
+	pattern string
+}
+
+// SchemaInfo describes a registered schema.
+type SchemaInfo struct {
+	Pattern string
+	Type    string
+	File    string // Where the schema was registered
+	Line    int
+}
+
+// schemas holds the registered schemas, as subscriptions whose values are schemaEntry.
+type schemas struct {
+	mu   sync.Mutex // Serializes registrations, so that conflicts are detected
+	list *sublist.Sublist
+}
+
+type schemaEntry struct {
+	typ  reflect.Type
+	info SchemaInfo
+}
+
+// Register declares that messages published to subjects matching pattern have type M.
+// Publishes of other types to those subjects then fail with ErrSchemaMismatch, rather than
+// panicking in the handlers of subscribers expecting M. If M is an interface type, messages
+// of any type implementing it are accepted, as is nil.
+//
+// Patterns may overlap as long as they are registered with the same type, and registering
+// the same pattern and type twice has no effect. Schemas are listed by Schemas and Handler.
+func Register[M any](ps *PubSub, pattern string) (Schema[M], error) {
+	if !sublist.IsValidSubject(pattern) {
+		return Schema[M]{}, fmt.Errorf("%w: %q", sublist.ErrInvalidSubject, pattern)
+	}
+	typ := reflect.TypeFor[M]()
+	entry := schemaEntry{typ: typ, info: SchemaInfo{Pattern: pattern, Type: typ.String()}}
+	if _, file, line, ok := runtime.Caller(1); ok {
+		entry.info.File, entry.info.Line = file, line
+	}
+
+	ps.schemas.mu.Lock()
+	defer ps.schemas.mu.Unlock()
+	var all []*sublist.Subscription
+	ps.schemas.list.All(&all)
+	for _, sub := range all {
+		existing := sub.Value.(schemaEntry)
+		if !sublist.SubjectsCollide(pattern, existing.info.Pattern) {
+			continue
+		}
+		if existing.typ != typ {
+			return Schema[M]{}, fmt.Errorf("%w: %s for %q overlaps %s for %q",
+				ErrSchemaConflict, typ, pattern, existing.typ, existing.info.Pattern)
+		}
+		if existing.info.Pattern == pattern {
+			return Schema[M]{ps, pattern}, nil
+		}
+	}
+	if err := ps.schemas.list.Insert(&sublist.Subscription{Subject: []byte(pattern), Value: entry}); err != nil {
+		return Schema[M]{}, err
+	}
+	return Schema[M]{ps, pattern}, nil
+}
+
+// Schemas returns the registered schemas, sorted by pattern.
+func (ps *PubSub) Schemas() []SchemaInfo {
+	var all []*sublist.Subscription
+	ps.schemas.list.All(&all)
+	infos := make([]SchemaInfo, len(all))
+	for i, sub := range all {
+		infos[i] = sub.Value.(schemaEntry).info
+	}
+	slices.SortFunc(infos, func(a, b SchemaInfo) int { return cmp.Compare(a.Pattern, b.Pattern) })
+	return infos
+}
+
+// check returns an error if the message does not match the schemas registered for its subject.
+func (s *schemas) check(msg *Msg[any]) error {
+	if s.list.Count() == 0 {
+		return nil
+	}
+	for _, sub := range s.list.Match(msg.Subject).Psubs {
+		entry := sub.Value.(schemaEntry)
+		if !conforms(msg.Data, entry.typ) {
+			return fmt.Errorf("%w: %T published to %q, which has type %s", ErrSchemaMismatch, msg.Data, msg.Subject, entry.typ)
+		}
+	}
+	return nil
+}
+
+// conforms returns whether the value can be asserted to the type.
+func conforms(v any, typ reflect.Type) bool {
+	if typ.Kind() == reflect.Interface {
+		return v == nil || reflect.TypeOf(v).Implements(typ)
+	}
+	return reflect.TypeOf(v) == typ
+}
+
+// Pattern returns the subject pattern of the schema.
+func (s Schema[M]) Pattern() string {
+	return s.pattern
+}
+
+// Pub publishes a message to a subject, which must match the schema's pattern.
+func (s Schema[M]) Pub(subj string, message M) error {
+	if !sublist.SubjectMatchesFilter(subj, s.pattern) {
+		return fmt.Errorf("%w: %q is outside of %q", ErrSchemaMismatch, subj, s.pattern)
+	}
+	return Pub(s.ps, subj, message)
+}
+
+// Sub subscribes to a subject, which must be within the schema's pattern, like Sub.
+func (s Schema[M]) Sub(subj string, handler func(string, M), options ...SubOption) (context.CancelFunc, error) {
+	if !sublist.IsValidSubject(subj) || !sublist.SubjectMatchesFilter(subj, s.pattern) {
+		return nil, fmt.Errorf("%w: %q is outside of %q", ErrSchemaMismatch, subj, s.pattern)
+	}
+	options = append(options, WithSkip(1)) // Skip this stack frame when recording the subscriber
+	return Sub(s.ps, subj, handler, options...), nil
+}
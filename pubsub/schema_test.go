@@ -0,0 +1,64 @@
+package pubsub
+
+import (
+	"fmt"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/yurivish/toolkit"
+	"github.com/yurivish/toolkit/assert"
+)
+
+type order struct {
+	ID int
+}
+
+func TestRegister(t *testing.T) {
+	ps := NewPubSub()
+	orders, err := Register[order](ps, "orders.>")
+	assert.Nil(t, err)
+	_, err = Register[order](ps, "orders.*.new")
+	assert.Nil(t, err)
+	_, err = Register[order](ps, "orders.>")
+	assert.Nil(t, err)
+	_, err = Register[string](ps, "*.eu")
+	assert.ErrorIs(t, err, ErrSchemaConflict)
+	_, err = Register[fmt.Stringer](ps, "names.*")
+	assert.Nil(t, err)
+	_, err = Register[int](ps, "a..b")
+	assert.NotNil(t, err)
+
+	var got []order
+	Sub(ps, "orders.>", func(_ string, msg order) { got = append(got, msg) })
+	assert.Nil(t, Pub(ps, "orders.eu.new", order{1}))
+	assert.ErrorIs(t, Pub(ps, "orders.eu.new", &order{2}), ErrSchemaMismatch)
+	assert.ErrorIs(t, PubMsg(ps, &Msg[any]{Subject: "orders.us", Data: "3"}), ErrSchemaMismatch)
+	assert.Nil(t, orders.Pub("orders.us", order{4}))
+	assert.ErrorIs(t, orders.Pub("users.us", order{5}), ErrSchemaMismatch)
+	assert.Equal(t, got, []order{{1}, {4}})
+	// Other subjects are unaffected
+	assert.Nil(t, Pub(ps, "users.1", 6))
+
+	// Interface types accept implementations and nil
+	assert.Nil(t, Pub[fmt.Stringer](ps, "names.a", nil))
+	assert.Nil(t, Pub(ps, "names.a", time.Second))
+	assert.ErrorIs(t, Pub(ps, "names.a", 7), ErrSchemaMismatch)
+
+	_, err = orders.Sub("orders.eu.*", func(string, order) {})
+	assert.Nil(t, err)
+	_, err = orders.Sub(">", func(string, order) {})
+	assert.ErrorIs(t, err, ErrSchemaMismatch)
+
+	infos := ps.Schemas()
+	assert.Equal(t, len(infos), 3)
+	assert.Equal(t, infos[0], SchemaInfo{Pattern: "names.*", Type: "fmt.Stringer", File: infos[0].File, Line: infos[0].Line})
+	assert.Equal(t, infos[1].Type, "pubsub.order")
+	assert.MatchesRegexp(t, infos[1].File, `schema_test\.go$`)
+
+	w := httptest.NewRecorder()
+	ps.Handler().ServeHTTP(w, httptest.NewRequest("GET", "/?filter=orders.eu.>", nil))
+	page, err := toolkit.FromJSON[Introspection](w.Body.Bytes())
+	assert.Nil(t, err)
+	assert.Equal(t, len(page.Schemas), 2)
+}
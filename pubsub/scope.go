@@ -0,0 +1,179 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/yurivish/toolkit/sublist"
+)
+
+// ErrPermissionDenied is returned when a scope is not allowed to publish or subscribe to a subject.
+var ErrPermissionDenied = errors.New("pubsub: permission denied")
+
+// Scope is a restricted handle onto a PubSub, for sharing a PubSub between modules
+// that should not be able to interfere with one another.
+//
+// Each scope has its own lists of subjects it may publish and subscribe to, and an
+// optional prefix that is transparently added to every subject it uses, in the spirit
+// of NATS accounts. A scope with the prefix "billing" that publishes to "invoices.new"
+// publishes to "billing.invoices.new" on the underlying PubSub, and its handlers see
+// subjects with the prefix removed. Permissions apply to the unprefixed subjects.
+//
+// Unlike the unscoped functions, which panic on invalid subjects, the scoped functions
+// return errors, since a scope's subjects may well come from somewhere less trusted.
+type Scope struct {
+	ps     *PubSub
+	pub    permissions
+	sub    permissions
+	prefix string // Empty, or ending in "."
+}
+
+// permissions are lists of subject filters that are allowed and denied.
+type permissions struct {
+	allow []string // Nil allows everything not denied
+	deny  []string
+}
+
+// Scoped returns a scope that can publish to subjects matching the filters in allowPub and
+// subscribe to subjects matching those in allowSub. Filters starting with "!" deny rather than
+// allow, and take precedence, so []string{"orders.>", "!orders.internal.>"} allows every
+// orders subject except the internal ones. A list without any allow filters allows everything
+// that it does not deny, and []string{"!>"} denies everything.
+//
+// Subscriptions are allowed if their subject is entirely within an allowed filter and not
+// entirely within a denied one. Subscriptions that overlap a denied filter, such as orders.>
+// in the above example, are allowed but do not receive messages on the denied subjects.
+//
+// It panics if any of the filters, or the prefix, is invalid.
+func (ps *PubSub) Scoped(allowPub, allowSub []string, prefix string) *Scope {
+	if prefix != _EMPTY_ {
+		if !IsValidPubSubject(prefix) {
+			panic(fmt.Sprintf("pubsub: invalid scope prefix %q", prefix))
+		}
+		prefix += "."
+	}
+	return &Scope{ps: ps, pub: newPermissions(allowPub), sub: newPermissions(allowSub), prefix: prefix}
+}
+
+func newPermissions(filters []string) permissions {
+	var p permissions
+	for _, filter := range filters {
+		deny, isDeny := strings.CutPrefix(filter, "!")
+		if !sublist.IsValidSubject(deny) {
+			panic(fmt.Sprintf("pubsub: invalid scope filter %q", filter))
+		}
+		if isDeny {
+			p.deny = append(p.deny, deny)
+		} else {
+			p.allow = append(p.allow, filter)
+		}
+	}
+	return p
+}
+
+// allows returns whether the subject, which may contain wildcards, is
+// entirely within an allowed filter and not entirely within a denied one.
+func (p permissions) allows(subj string) bool {
+	for _, filter := range p.deny {
+		if sublist.SubjectMatchesFilter(subj, filter) {
+			return false
+		}
+	}
+	if p.allow == nil {
+		return true
+	}
+	for _, filter := range p.allow {
+		if sublist.SubjectMatchesFilter(subj, filter) {
+			return true
+		}
+	}
+	return false
+}
+
+// overlapsDeny returns whether some subjects matching subj are denied.
+func (p permissions) overlapsDeny(subj string) bool {
+	for _, filter := range p.deny {
+		if sublist.SubjectsCollide(subj, filter) {
+			return true
+		}
+	}
+	return false
+}
+
+// Prefix returns the prefix added to the scope's subjects, without its trailing dot.
+func (sc *Scope) Prefix() string {
+	return strings.TrimSuffix(sc.prefix, ".")
+}
+
+// CanPub returns whether the scope may publish to the subject.
+func (sc *Scope) CanPub(subj string) bool {
+	return IsValidPubSubject(subj) && sc.pub.allows(subj)
+}
+
+// CanSub returns whether the scope may subscribe to the subject.
+func (sc *Scope) CanSub(subj string) bool {
+	return sublist.IsValidSubject(subj) && sc.sub.allows(subj)
+}
+
+// ScopePub publishes a message onto the given subject within the scope.
+func ScopePub[M any](sc *Scope, subj string, message M) error {
+	return sc.publish(&Msg[any]{Subject: subj, Data: message})
+}
+
+// ScopePubMsg publishes a message envelope within the scope. The subject of msg is
+// interpreted within the scope, while the reply subject is used as is.
+func ScopePubMsg[M any](sc *Scope, msg *Msg[M]) error {
+	return sc.publish(&Msg[any]{Subject: msg.Subject, Reply: msg.Reply, Header: msg.Header, Time: msg.Time, Data: msg.Data})
+}
+
+func (sc *Scope) publish(msg *Msg[any]) error {
+	if !IsValidPubSubject(msg.Subject) {
+		return fmt.Errorf("%w: %q", sublist.ErrInvalidSubject, msg.Subject)
+	}
+	if !sc.pub.allows(msg.Subject) {
+		return fmt.Errorf("%w: publish to %q", ErrPermissionDenied, msg.Subject)
+	}
+	msg.Subject = sc.prefix + msg.Subject
+	return sc.ps.publish(msg)
+}
+
+// ScopeSub subscribes to a subject within the scope, like Sub.
+func ScopeSub[M any](sc *Scope, subj string, handler func(string, M), options ...SubOption) (context.CancelFunc, error) {
+	options = append(options, WithSkip(1)) // Skip this stack frame when recording the subscriber
+	return sc.subscribe(subj, func(msg *Msg[any]) {
+		handler(msg.Subject, as[M](msg.Data))
+	}, options...)
+}
+
+// ScopeSubMsg subscribes to a subject within the scope, like SubMsg.
+func ScopeSubMsg[M any](sc *Scope, subj string, handler func(*Msg[M]), options ...SubOption) (context.CancelFunc, error) {
+	options = append(options, WithSkip(1))
+	return sc.subscribe(subj, func(msg *Msg[any]) {
+		handler(msgAs[M](msg))
+	}, options...)
+}
+
+func (sc *Scope) subscribe(subj string, handler func(*Msg[any]), options ...SubOption) (context.CancelFunc, error) {
+	if !sublist.IsValidSubject(subj) {
+		return nil, fmt.Errorf("%w: %q", sublist.ErrInvalidSubject, subj)
+	}
+	if !sc.sub.allows(subj) {
+		return nil, fmt.Errorf("%w: subscribe to %q", ErrPermissionDenied, subj)
+	}
+	filter := sc.sub.overlapsDeny(subj)
+	options = append(options, WithSkip(1))
+	return sub(sc.ps, sc.prefix+subj, func(msg *Msg[any]) {
+		if sc.prefix != _EMPTY_ {
+			// Copy the envelope, since it is shared with other subscribers
+			local := *msg
+			local.Subject = strings.TrimPrefix(msg.Subject, sc.prefix)
+			msg = &local
+		}
+		if filter && !sc.sub.allows(msg.Subject) {
+			return
+		}
+		handler(msg)
+	}, options...), nil
+}
@@ -0,0 +1,63 @@
+package pubsub
+
+import (
+	"testing"
+
+	"github.com/yurivish/toolkit/assert"
+	"github.com/yurivish/toolkit/sublist"
+)
+
+func TestScopePermissions(t *testing.T) {
+	ps := NewPubSub()
+	sc := ps.Scoped([]string{"orders.>", "!orders.internal.>"}, []string{"orders.*", "!orders.secret"}, "")
+
+	assert.Nil(t, ScopePub(sc, "orders.new", 1))
+	assert.ErrorIs(t, ScopePub(sc, "orders.internal.x", 1), ErrPermissionDenied)
+	assert.ErrorIs(t, ScopePub(sc, "users.new", 1), ErrPermissionDenied)
+	assert.ErrorIs(t, ScopePub(sc, "orders.*", 1), sublist.ErrInvalidSubject)
+	assert.True(t, sc.CanPub("orders.a.b"))
+	assert.False(t, sc.CanPub("orders.internal.b"))
+
+	_, err := ScopeSub(sc, "orders.>", func(string, int) {})
+	assert.ErrorIs(t, err, ErrPermissionDenied)
+	_, err = ScopeSub(sc, "orders.secret", func(string, int) {})
+	assert.ErrorIs(t, err, ErrPermissionDenied)
+	_, err = ScopeSub(sc, "orders..x", func(string, int) {})
+	assert.ErrorIs(t, err, sublist.ErrInvalidSubject)
+
+	// Overlapping a denied subject is allowed, but its messages are filtered out
+	var got []string
+	cancel, err := ScopeSub(sc, "orders.*", func(subj string, _ int) { got = append(got, subj) })
+	assert.Nil(t, err)
+	Pub(ps, "orders.new", 1)
+	Pub(ps, "orders.secret", 2)
+	assert.Equal(t, got, []string{"orders.new"})
+	cancel()
+
+	// Publishing is unrestricted without allow filters
+	all := ps.Scoped(nil, []string{"!>"}, "")
+	assert.Nil(t, ScopePub(all, "anything.at.all", 1))
+	assert.False(t, all.CanSub("a"))
+}
+
+func TestScopePrefix(t *testing.T) {
+	ps := NewPubSub()
+	billing := ps.Scoped(nil, nil, "billing")
+	shipping := ps.Scoped(nil, nil, "shipping")
+	assert.Equal(t, billing.Prefix(), "billing")
+
+	var billed, raw []string
+	_, err := ScopeSubMsg(billing, "invoices.*", func(msg *Msg[string]) { billed = append(billed, msg.Subject+"="+msg.Data) })
+	assert.Nil(t, err)
+	Sub(ps, ">", func(subj string, _ string) { raw = append(raw, subj) })
+
+	assert.Nil(t, ScopePub(billing, "invoices.new", "a"))
+	assert.Nil(t, ScopePub(shipping, "invoices.new", "b")) // A different namespace
+	assert.Equal(t, billed, []string{"invoices.new=a"})
+	assert.Equal(t, raw, []string{"billing.invoices.new", "shipping.invoices.new"})
+
+	// Subscriptions record the caller, as with Sub
+	for _, info := range ps.Subscriptions() {
+		assert.MatchesRegexp(t, info.FuncName, `TestScopePrefix$`)
+	}
+}
@@ -0,0 +1,35 @@
+package pubsub
+
+import (
+	"context"
+	"iter"
+	"slices"
+)
+
+// SubSeq returns a sequence of subjects and messages published to subj, for use with range:
+//
+//	for subj, msg := range pubsub.SubSeq[Order](ctx, ps, "orders.>") { ... }
+//
+// The subscription is created when iteration begins and cancelled when the loop exits,
+// either by breaking out of it or because the context is done. Messages that are still
+// buffered when the loop is broken out of are discarded. Like SubChan, publishers
+// block until the loop is ready for the next message unless WithAsync is passed to set
+// a buffer size and overflow policy.
+func SubSeq[M any](ctx context.Context, ps *PubSub, subj string, options ...SubOption) iter.Seq2[string, M] {
+	options = append(slices.Clip(options), WithSkip(1)) // Skip the iterator's stack frame when recording the subscriber
+	return func(yield func(string, M) bool) {
+		ctx, cancel := context.WithCancel(ctx)
+		defer cancel()
+		ch := subChan(ps, ctx, subj, msgAs[M], options...)
+		for msg := range ch {
+			if !yield(msg.Subject, msg.Data) {
+				// Wait for the channel to close, which happens after the subscription is cancelled,
+				// so that we are unsubscribed by the time the loop exits.
+				cancel()
+				for range ch {
+				}
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,635 @@
+package pubsub
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"maps"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/yurivish/toolkit"
+	"github.com/yurivish/toolkit/stree"
+	"github.com/yurivish/toolkit/sublist"
+)
+
+// Stream errors
+var (
+	ErrStreamExists   = errors.New("pubsub: stream already exists")
+	ErrInvalidStream  = errors.New("pubsub: invalid stream name")
+	ErrStreamSubjects = errors.New("pubsub: stream subjects must be valid and must not overlap")
+)
+
+// HeaderSequence holds the stream sequence number of messages delivered from a stream.
+const HeaderSequence = "Nats-Sequence"
+
+// StreamLimits bound the messages held by a stream. Zero means unlimited.
+// Once a limit is exceeded, the oldest messages are discarded.
+type StreamLimits struct {
+	MaxMsgs  int
+	MaxAge   time.Duration
+	MaxBytes int64 // See msgSize for how message sizes are estimated
+}
+
+// Stream is a bounded in-memory log of the messages published to a set of subjects,
+// in the spirit of a NATS JetStream stream. Each stored message is given a sequence
+// number, and subscribers created with SubStream can start from any point in the log.
+type Stream struct {
+	ps       *PubSub
+	name     string
+	subjects []string
+	limits   StreamLimits
+	capture  []context.CancelFunc
+
+	mu        sync.Mutex
+	msgs      fifo[storedMsg] // Stored messages in sequence order
+	firstSeq  uint64          // Sequence number of msgs[head], or lastSeq+1 if empty
+	lastSeq   uint64          // Sequence numbers are increasing, but may have gaps after compaction
+	bytes     int64
+	perSubj   *stree.SubjectTree[subjectState]
+	consumers map[*streamConsumer]struct{}
+	file      *fileStore // Nil for streams kept only in memory
+	err       error      // The most recent error writing to the file store
+}
+
+type storedMsg struct {
+	seq  uint64
+	msg  *Msg[any]
+	size int
+}
+
+// subjectState tracks the stored messages for a single literal subject.
+type subjectState struct {
+	msgs    uint64
+	lastSeq uint64
+}
+
+// StreamInfo describes the current state of a stream.
+type StreamInfo struct {
+	Name        string
+	Subjects    []string
+	Msgs        int
+	Bytes       int64 // Only tracked for streams with a MaxBytes limit
+	FirstSeq    uint64
+	LastSeq     uint64
+	NumSubjects int
+	Consumers   int
+}
+
+// StreamOptions configure how a stream stores its messages.
+type StreamOptions struct {
+	Dir             string // If set, messages are persisted to segment files in this directory
+	Codec           Codec  // Encodes message data for persistence; JSONCodec[any]() by default
+	MaxSegmentBytes int64  // Size at which a new segment file is started
+	Sync            bool   // Whether to fsync after every write
+}
+
+type StreamOption func(*StreamOptions)
+
+// AddStream creates a stream that captures every message published to the given subjects,
+// which may contain wildcards but must not overlap with one another.
+//
+// If the stream is persisted with WithFileStore, any messages already in the directory
+// are recovered and the stream carries on from the last recovered sequence number.
+func (ps *PubSub) AddStream(name string, subjects []string, limits StreamLimits, options ...StreamOption) (*Stream, error) {
+	if !IsValidPubToken(name) {
+		return nil, ErrInvalidStream
+	}
+	if len(subjects) == 0 {
+		return nil, ErrStreamSubjects
+	}
+	for i, subj := range subjects {
+		if !sublist.IsValidSubject(subj) {
+			return nil, ErrStreamSubjects
+		}
+		// Overlapping subjects would capture some messages twice
+		for _, other := range subjects[:i] {
+			if sublist.SubjectsCollide(subj, other) {
+				return nil, ErrStreamSubjects
+			}
+		}
+	}
+
+	var opts StreamOptions
+	for _, opt := range options {
+		opt(&opts)
+	}
+
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	if _, ok := ps.streams[name]; ok {
+		return nil, ErrStreamExists
+	}
+	st := &Stream{
+		ps:        ps,
+		name:      name,
+		subjects:  slices.Clone(subjects),
+		limits:    limits,
+		firstSeq:  1,
+		perSubj:   stree.NewSubjectTree[subjectState](),
+		consumers: make(map[*streamConsumer]struct{}),
+	}
+	if opts.Dir != _EMPTY_ {
+		file, recovered, err := openFileStore(opts)
+		if err != nil {
+			return nil, err
+		}
+		st.file = file
+		for _, sm := range recovered {
+			sm.size = st.size(sm.msg)
+			st.append(sm)
+			st.lastSeq = sm.seq
+		}
+		st.enforceLimits(ps.clock.Now())
+	}
+	for _, subj := range subjects {
+		st.capture = append(st.capture, sub(ps, subj, st.store, WithID("$STREAM."+name), func(o *SubOptions) { o.internal = true }))
+	}
+	if ps.streams == nil {
+		ps.streams = make(map[string]*Stream)
+	}
+	ps.streams[name] = st
+	return st, nil
+}
+
+// Stream returns the stream with the given name, or nil if there is none.
+func (ps *PubSub) Stream(name string) *Stream {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	return ps.streams[name]
+}
+
+// DeleteStream stops capturing messages into the named stream and cancels its consumers.
+// It returns whether the stream existed.
+func (ps *PubSub) DeleteStream(name string) bool {
+	ps.mu.Lock()
+	st, ok := ps.streams[name]
+	delete(ps.streams, name)
+	ps.mu.Unlock()
+	if !ok {
+		return false
+	}
+	for _, cancel := range st.capture {
+		cancel()
+	}
+	st.mu.Lock()
+	consumers := slices.Collect(maps.Keys(st.consumers))
+	if st.file != nil {
+		st.file.close()
+	}
+	st.mu.Unlock()
+	for _, c := range consumers {
+		c.s.cancel()
+	}
+	return true
+}
+
+// WithFileStore persists the stream to segment files in dir, using codec to encode message data.
+// A nil codec means JSONCodec[any](), in which case recovered messages hold generic JSON values
+// such as map[string]any and float64 rather than their original types.
+// Files are left in place when the stream is deleted, so that it can be recovered later.
+func WithFileStore(dir string, codec Codec) StreamOption {
+	return func(opts *StreamOptions) {
+		opts.Dir = dir
+		opts.Codec = codec
+	}
+}
+
+// WithSegmentSize sets the size in bytes at which the file store starts a new segment.
+// Discarded messages are only removed from disk once their whole segment can be deleted.
+func WithSegmentSize(n int64) StreamOption {
+	return func(opts *StreamOptions) {
+		opts.MaxSegmentBytes = n
+	}
+}
+
+// WithSyncWrites makes the file store fsync after every message, trading throughput for durability.
+func WithSyncWrites() StreamOption {
+	return func(opts *StreamOptions) {
+		opts.Sync = true
+	}
+}
+
+// Name returns the name of the stream.
+func (st *Stream) Name() string {
+	return st.name
+}
+
+// store is the capture handler, which appends a published message to the stream.
+func (st *Stream) store(msg *Msg[any]) {
+	// Stored messages carry their sequence number in a header, so we copy
+	// the header rather than modifying the one shared with other subscribers.
+	header := maps.Clone(msg.Header)
+	if header == nil {
+		header = Header{}
+	}
+	stored := &Msg[any]{Subject: msg.Subject, Reply: msg.Reply, Header: header, Time: msg.Time, Data: msg.Data}
+	size := st.size(stored)
+
+	st.mu.Lock()
+	st.lastSeq++
+	seq := st.lastSeq
+	header.Set(HeaderSequence, strconv.FormatUint(seq, 10))
+	sm := storedMsg{seq: seq, msg: stored, size: size}
+	st.append(sm)
+	if st.file != nil {
+		st.setErr(st.file.append(sm))
+	}
+	st.enforceLimits(st.ps.clock.Now())
+	// Messages are queued for each consumer under the lock, so that concurrent
+	// publishers can't hand them over out of sequence order.
+	var consumers []*streamConsumer
+	for c := range st.consumers {
+		if sublist.SubjectMatchesFilter(msg.Subject, c.filter) {
+			c.enqueue(stored)
+			consumers = append(consumers, c)
+		}
+	}
+	st.mu.Unlock()
+
+	for _, c := range consumers {
+		c.flush()
+	}
+}
+
+// append adds a message to the end of the stream. Lock should be held.
+func (st *Stream) append(sm storedMsg) {
+	if st.len() == 0 {
+		st.firstSeq = sm.seq
+	}
+	st.msgs.push(sm)
+	st.bytes += int64(sm.size)
+	subj := []byte(sm.msg.Subject)
+	if ss, ok := st.perSubj.Find(subj); ok {
+		ss.msgs++
+		ss.lastSeq = sm.seq
+	} else {
+		st.perSubj.Insert(subj, subjectState{msgs: 1, lastSeq: sm.seq})
+	}
+}
+
+// enforceLimits discards the oldest messages until the stream is within its limits.
+// Lock should be held.
+func (st *Stream) enforceLimits(now time.Time) {
+	for st.len() > 0 && st.overLimit(now) {
+		st.removeOldest()
+	}
+	if st.file != nil {
+		st.setErr(st.file.removeBefore(st.firstSeq))
+	}
+}
+
+// overLimit reports whether the oldest message should be discarded. Lock should be held.
+func (st *Stream) overLimit(now time.Time) bool {
+	oldest := st.msgs.front()
+	return st.limits.MaxMsgs > 0 && st.len() > st.limits.MaxMsgs ||
+		st.limits.MaxBytes > 0 && st.bytes > st.limits.MaxBytes ||
+		st.limits.MaxAge > 0 && now.Sub(oldest.msg.Time) > st.limits.MaxAge
+}
+
+// setErr records an error from the file store, if there was one. Lock should be held.
+func (st *Stream) setErr(err error) {
+	if err != nil {
+		st.err = err
+	}
+}
+
+// Err returns the most recent error encountered while persisting the stream, if any.
+// Messages are still stored in memory when persistence fails.
+func (st *Stream) Err() error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	return st.err
+}
+
+// Compact discards all but the last message for each subject, both in memory
+// and on disk. Sequence numbers are preserved, so the stream may have gaps afterwards.
+func (st *Stream) Compact() error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.enforceLimits(st.ps.clock.Now())
+	var kept []storedMsg
+	for _, sm := range st.stored() {
+		if ss, _ := st.perSubj.Find([]byte(sm.msg.Subject)); ss.lastSeq == sm.seq {
+			kept = append(kept, sm)
+		}
+	}
+	st.msgs, st.bytes = fifo[storedMsg]{}, 0
+	st.firstSeq = st.lastSeq + 1
+	st.perSubj = stree.NewSubjectTree[subjectState]()
+	for _, sm := range kept {
+		st.append(sm)
+	}
+	if st.file != nil {
+		if err := st.file.compact(kept); err != nil {
+			st.setErr(err)
+			return err
+		}
+	}
+	return nil
+}
+
+// removeOldest discards the oldest message. Lock should be held.
+func (st *Stream) removeOldest() {
+	oldest := st.msgs.pop()
+	if st.len() > 0 {
+		st.firstSeq = st.msgs.front().seq
+	} else {
+		st.firstSeq = st.lastSeq + 1
+	}
+	st.bytes -= int64(oldest.size)
+	subj := []byte(oldest.msg.Subject)
+	if ss, ok := st.perSubj.Find(subj); ok {
+		ss.msgs--
+		if ss.msgs == 0 {
+			st.perSubj.Delete(subj)
+		}
+	}
+}
+
+// len returns the number of stored messages. Lock should be held.
+func (st *Stream) len() int {
+	return st.msgs.len()
+}
+
+// stored returns the stored messages in sequence order. Lock should be held.
+func (st *Stream) stored() []storedMsg {
+	return st.msgs.all()
+}
+
+// index returns the position in stored() of the first message with a sequence
+// number of at least seq. Lock should be held.
+func (st *Stream) index(seq uint64) int {
+	i, _ := slices.BinarySearchFunc(st.stored(), seq, func(sm storedMsg, seq uint64) int {
+		return cmp.Compare(sm.seq, seq)
+	})
+	return i
+}
+
+// get returns the stored message with the given sequence number, if any. Lock should be held.
+func (st *Stream) get(seq uint64) (*Msg[any], bool) {
+	stored := st.stored()
+	if i := st.index(seq); i < len(stored) && stored[i].seq == seq {
+		return stored[i].msg, true
+	}
+	return nil, false
+}
+
+// Get returns the stored message with the given sequence number, if it is still in the stream.
+func (st *Stream) Get(seq uint64) (*Msg[any], bool) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.enforceLimits(st.ps.clock.Now())
+	return st.get(seq)
+}
+
+// NumPending returns the number of stored messages whose subjects match the filter.
+func (st *Stream) NumPending(filter string) uint64 {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.enforceLimits(st.ps.clock.Now())
+	var n uint64
+	st.perSubj.Match([]byte(filter), func(_ []byte, ss *subjectState) {
+		n += ss.msgs
+	})
+	return n
+}
+
+// Info returns the current state of the stream.
+func (st *Stream) Info() StreamInfo {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.enforceLimits(st.ps.clock.Now())
+	return StreamInfo{
+		Name:        st.name,
+		Subjects:    slices.Clone(st.subjects),
+		Msgs:        st.len(),
+		Bytes:       st.bytes,
+		FirstSeq:    st.firstSeq,
+		LastSeq:     st.lastSeq,
+		NumSubjects: st.perSubj.Size(),
+		Consumers:   len(st.consumers),
+	}
+}
+
+// size returns the size of a message as counted towards StreamLimits.MaxBytes.
+// It's zero for streams without a byte limit, since estimating it may mean encoding the data.
+func (st *Stream) size(msg *Msg[any]) int {
+	if st.limits.MaxBytes <= 0 {
+		return 0
+	}
+	return msgSize(msg)
+}
+
+// msgSize estimates the size of a message in bytes, for the purpose of enforcing
+// StreamLimits.MaxBytes. Byte slices and strings count their length, while other
+// data counts the length of its JSON encoding.
+func msgSize(msg *Msg[any]) int {
+	size := len(msg.Subject) + len(msg.Reply)
+	for k, vs := range msg.Header {
+		for _, v := range vs {
+			size += len(k) + len(v)
+		}
+	}
+	switch data := msg.Data.(type) {
+	case nil:
+	case []byte:
+		size += len(data)
+	case string:
+		size += len(data)
+	default:
+		if b, err := toolkit.ToJSON(data); err == nil {
+			size += len(b)
+		}
+	}
+	return size
+}
+
+// StartPosition determines where in a stream a consumer begins receiving messages.
+type StartPosition struct {
+	policy deliverPolicy
+	seq    uint64
+	time   time.Time
+	n      int
+}
+
+type deliverPolicy int
+
+const (
+	deliverAll deliverPolicy = iota
+	deliverNew
+	deliverFromSeq
+	deliverFromTime
+	deliverLast
+	deliverLastPerSubject
+)
+
+// DeliverAll starts from the oldest message in the stream.
+func DeliverAll() StartPosition {
+	return StartPosition{policy: deliverAll}
+}
+
+// DeliverNew starts with messages stored after the consumer is created.
+func DeliverNew() StartPosition {
+	return StartPosition{policy: deliverNew}
+}
+
+// DeliverFromSeq starts from the given sequence number, or the oldest message if that has been discarded.
+func DeliverFromSeq(seq uint64) StartPosition {
+	return StartPosition{policy: deliverFromSeq, seq: seq}
+}
+
+// DeliverFromTime starts from the messages published at or after the given time.
+func DeliverFromTime(t time.Time) StartPosition {
+	return StartPosition{policy: deliverFromTime, time: t}
+}
+
+// DeliverLast starts with the last n messages matching the consumer's filter.
+func DeliverLast(n int) StartPosition {
+	return StartPosition{policy: deliverLast, n: n}
+}
+
+// DeliverLastPerSubject starts with the last message for each subject matching the consumer's filter.
+func DeliverLastPerSubject() StartPosition {
+	return StartPosition{policy: deliverLastPerSubject}
+}
+
+// streamConsumer delivers stored messages to a subscription.
+// Newly stored messages are queued in pending, and delivered in sequence order
+// by one goroutine at a time, after any replay of earlier messages is complete.
+type streamConsumer struct {
+	st      *Stream
+	s       *subscriber
+	matches *sublist.SublistResult
+	filter  string
+
+	mu         sync.Mutex
+	delivering bool
+	pending    []*Msg[any]
+	removed    bool // Set once the subscription is cancelled, guarded by st.mu
+}
+
+// SubStream subscribes to the messages in a stream whose subjects match the filter,
+// starting from the given position. Stored messages are replayed on the calling goroutine
+// before SubStream returns, after which messages are delivered as they are stored.
+// The handler receives each message along with its stream sequence number.
+func SubStream[M any](st *Stream, filter string, start StartPosition, handler func(uint64, *Msg[M]), options ...SubOption) context.CancelFunc {
+	if !sublist.IsValidSubject(filter) {
+		panic(sublist.ErrInvalidSubject) // invalid subjects are programmer error, as with Sub.
+	}
+	c := &streamConsumer{st: st, filter: filter}
+	// Messages are delivered by the stream rather than by publishing, so the subscription is
+	// kept out of the sublist. However it's cancelled, the stream stops delivering to it.
+	options = append(options, WithSkip(1), func(o *SubOptions) { // Skip this stack frame when recording the subscriber
+		o.detached = true
+		o.onCancel = c.remove
+	})
+	c.s = subscribe(st.ps, filter, func(msg *Msg[any]) {
+		seq, _ := strconv.ParseUint(msg.Header.Get(HeaderSequence), 10, 64)
+		handler(seq, msgAs[M](msg))
+	}, options...)
+	c.matches = &sublist.SublistResult{Psubs: []*sublist.Subscription{c.s.sub}}
+	c.replay(st.addConsumer(c, start))
+	return c.s.cancel
+}
+
+// addConsumer registers the consumer and returns the stored messages it should start with.
+func (st *Stream) addConsumer(c *streamConsumer, start StartPosition) []*Msg[any] {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.enforceLimits(st.ps.clock.Now())
+	if c.removed {
+		// Cancelled while subscribing, eg. by Close
+		return nil
+	}
+	c.delivering = true
+	st.consumers[c] = struct{}{}
+
+	var msgs []*Msg[any]
+	matches := func(msg *Msg[any]) bool { return sublist.SubjectMatchesFilter(msg.Subject, c.filter) }
+	stored := st.stored()
+	switch start.policy {
+	case deliverAll, deliverFromSeq, deliverFromTime:
+		if start.policy == deliverFromSeq {
+			stored = stored[st.index(start.seq):]
+		}
+		for _, sm := range stored {
+			if start.policy == deliverFromTime && sm.msg.Time.Before(start.time) {
+				continue
+			}
+			if matches(sm.msg) {
+				msgs = append(msgs, sm.msg)
+			}
+		}
+	case deliverLast:
+		for i := len(stored) - 1; i >= 0 && len(msgs) < start.n; i-- {
+			if matches(stored[i].msg) {
+				msgs = append(msgs, stored[i].msg)
+			}
+		}
+		slices.Reverse(msgs)
+	case deliverLastPerSubject:
+		var seqs []uint64
+		st.perSubj.Match([]byte(c.filter), func(_ []byte, ss *subjectState) {
+			seqs = append(seqs, ss.lastSeq)
+		})
+		slices.Sort(seqs)
+		for _, seq := range seqs {
+			msg, _ := st.get(seq)
+			msgs = append(msgs, msg)
+		}
+	}
+	return msgs
+}
+
+// replay delivers the initial messages, followed by any that were stored in the meantime.
+func (c *streamConsumer) replay(msgs []*Msg[any]) {
+	for {
+		for _, msg := range msgs {
+			c.deliver(msg)
+		}
+		c.mu.Lock()
+		msgs, c.pending = c.pending, nil
+		if len(msgs) == 0 {
+			c.delivering = false
+			c.mu.Unlock()
+			return
+		}
+		c.mu.Unlock()
+	}
+}
+
+// enqueue adds a newly stored message to the pending queue. The stream lock should be held,
+// so that messages are queued in sequence order.
+func (c *streamConsumer) enqueue(msg *Msg[any]) {
+	c.mu.Lock()
+	c.pending = append(c.pending, msg)
+	c.mu.Unlock()
+}
+
+// flush delivers the pending messages, unless another goroutine is already doing so,
+// in which case that goroutine will deliver them once it's done with its own.
+func (c *streamConsumer) flush() {
+	c.mu.Lock()
+	if c.delivering {
+		c.mu.Unlock()
+		return
+	}
+	c.delivering = true
+	c.mu.Unlock()
+	c.replay(nil)
+}
+
+func (c *streamConsumer) deliver(msg *Msg[any]) {
+	c.st.ps.pub(msg, c.s.sub, c.matches)
+}
+
+// remove stops delivery to the consumer once its subscription is cancelled.
+func (c *streamConsumer) remove() {
+	c.st.mu.Lock()
+	c.removed = true
+	delete(c.st.consumers, c)
+	c.st.mu.Unlock()
+}
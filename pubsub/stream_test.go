@@ -0,0 +1,215 @@
+package pubsub
+
+import (
+	"context"
+	"runtime"
+	"slices"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/yurivish/toolkit/assert"
+	"github.com/yurivish/toolkit/sublist"
+)
+
+// streamMsgs collects the sequence numbers and data of the messages delivered by a stream consumer.
+func streamMsgs[M any](st *Stream, filter string, start StartPosition) (seqs *[]uint64, data *[]M, cancel func()) {
+	seqs, data = new([]uint64), new([]M)
+	cancel = SubStream(st, filter, start, func(seq uint64, msg *Msg[M]) {
+		*seqs = append(*seqs, seq)
+		*data = append(*data, msg.Data)
+	})
+	return seqs, data, cancel
+}
+
+func TestAddStream(t *testing.T) {
+	ps := NewPubSub()
+	_, err := ps.AddStream("orders", []string{"orders.>", "orders.eu"}, StreamLimits{})
+	assert.ErrorIs(t, err, ErrStreamSubjects)
+	_, err = ps.AddStream("a.b", []string{"x"}, StreamLimits{})
+	assert.ErrorIs(t, err, ErrInvalidStream)
+	st, err := ps.AddStream("orders", []string{"orders.>"}, StreamLimits{})
+	assert.Nil(t, err)
+	_, err = ps.AddStream("orders", []string{"other"}, StreamLimits{})
+	assert.ErrorIs(t, err, ErrStreamExists)
+	assert.Equal(t, ps.Stream("orders"), st)
+
+	Pub(ps, "orders.eu.1", "a")
+	Pub(ps, "orders.us.1", "b")
+	Pub(ps, "other", "c")
+	info := st.Info()
+	assert.Equal(t, info.Msgs, 2)
+	assert.Equal(t, info.FirstSeq, uint64(1))
+	assert.Equal(t, info.LastSeq, uint64(2))
+	assert.Equal(t, info.NumSubjects, 2)
+	assert.Equal(t, st.NumPending("orders.eu.*"), uint64(1))
+	assert.Equal(t, st.NumPending(">"), uint64(2))
+
+	msg, ok := st.Get(2)
+	assert.True(t, ok)
+	assert.Equal(t, msg.Data, any("b"))
+	assert.Equal(t, msg.Header.Get(HeaderSequence), "2")
+
+	assert.True(t, ps.DeleteStream("orders"))
+	assert.False(t, ps.DeleteStream("orders"))
+	assert.Equal(t, len(ps.Subscriptions()), 0)
+}
+
+func TestStreamLimits(t *testing.T) {
+	ps := NewPubSub()
+	st, _ := ps.AddStream("s", []string{"s.*"}, StreamLimits{MaxMsgs: 3})
+	for i := range 100 {
+		Pub(ps, "s."+strconv.Itoa(i%2), i)
+	}
+	info := st.Info()
+	assert.Equal(t, info.Msgs, 3)
+	assert.Equal(t, info.FirstSeq, uint64(98))
+	assert.Equal(t, info.LastSeq, uint64(100))
+	assert.Equal(t, st.NumPending("s.0"), uint64(1))
+	assert.Equal(t, st.NumPending("s.1"), uint64(2))
+	_, ok := st.Get(97)
+	assert.False(t, ok)
+
+	st, _ = ps.AddStream("bytes", []string{"b"}, StreamLimits{MaxBytes: 10})
+	Pub(ps, "b", []byte("12345678"))
+	Pub(ps, "b", []byte("1234"))
+	assert.Equal(t, st.Info().Msgs, 1)
+	assert.Equal(t, st.Info().Bytes, int64(5))
+
+	st, _ = ps.AddStream("age", []string{"age"}, StreamLimits{MaxAge: time.Minute})
+	PubMsg(ps, &Msg[int]{Subject: "age", Time: time.Now().Add(-time.Hour), Data: 1})
+	PubMsg(ps, &Msg[int]{Subject: "age", Data: 2})
+	assert.Equal(t, st.Info().Msgs, 1)
+	assert.Equal(t, st.Info().FirstSeq, uint64(2))
+}
+
+func TestStreamMaxAgeClock(t *testing.T) {
+	start := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	clock := NewFakeClock(start)
+	ps := NewPubSub(WithClock(clock))
+	st, _ := ps.AddStream("s", []string{"s"}, StreamLimits{MaxAge: time.Minute})
+	Pub(ps, "s", 0)
+	clock.Advance(30 * time.Second)
+	Pub(ps, "s", 1)
+	assert.Equal(t, st.Info().Msgs, 2)
+
+	// Ages are measured by the PubSub's clock rather than the wall clock
+	clock.Advance(45 * time.Second)
+	info := st.Info()
+	assert.Equal(t, info.Msgs, 1)
+	assert.Equal(t, info.FirstSeq, uint64(2))
+	clock.Advance(time.Minute)
+	assert.Equal(t, st.Info().Msgs, 0)
+}
+
+func TestSubStream(t *testing.T) {
+	ps := NewPubSub()
+	st, _ := ps.AddStream("events", []string{"ev.>"}, StreamLimits{})
+	start := time.Now()
+	for i := range 6 {
+		PubMsg(ps, &Msg[int]{Subject: "ev." + strconv.Itoa(i%3), Time: start.Add(time.Duration(i) * time.Second), Data: i})
+	}
+
+	seqs, data, cancel := streamMsgs[int](st, ">", DeliverAll())
+	assert.Equal(t, *seqs, []uint64{1, 2, 3, 4, 5, 6})
+	assert.Equal(t, *data, []int{0, 1, 2, 3, 4, 5})
+	Pub(ps, "ev.9", 6)
+	assert.Equal(t, *data, []int{0, 1, 2, 3, 4, 5, 6})
+	cancel()
+	Pub(ps, "ev.9", 7)
+	assert.Equal(t, len(*data), 7)
+
+	_, data, _ = streamMsgs[int](st, "ev.1", DeliverAll())
+	assert.Equal(t, *data, []int{1, 4})
+
+	_, data, _ = streamMsgs[int](st, ">", DeliverFromSeq(6))
+	assert.Equal(t, *data, []int{5, 6, 7})
+
+	_, data, _ = streamMsgs[int](st, "ev.*", DeliverFromTime(start.Add(4*time.Second)))
+	assert.Equal(t, *data, []int{4, 5})
+
+	_, data, _ = streamMsgs[int](st, "ev.*", DeliverLast(2))
+	assert.Equal(t, *data, []int{6, 7})
+
+	_, data, _ = streamMsgs[int](st, "ev.*", DeliverLastPerSubject())
+	assert.Equal(t, *data, []int{3, 4, 5, 7})
+
+	_, data, _ = streamMsgs[int](st, ">", DeliverNew())
+	assert.Equal(t, len(*data), 0)
+	Pub(ps, "ev.0", 8)
+	assert.Equal(t, *data, []int{8})
+}
+
+func TestSubStreamCancel(t *testing.T) {
+	ps := NewPubSub(WithMaxPanics(1), WithOnHandlerError(func(*sublist.Subscription, string, any, []byte) {}))
+	st, _ := ps.AddStream("s", []string{"s.>"}, StreamLimits{})
+	watch := ps.WatchInterestOverlap(context.Background(), "_INBOX.>")
+	assert.False(t, <-watch)
+
+	calls := 0
+	SubStream(st, "s.*", DeliverNew(), func(uint64, *Msg[int]) {
+		calls++
+		panic("boom")
+	}, WithID("consumer"))
+	// The consumer is listed under its filter, and isn't subscribed to an inbox
+	subs := ps.Subscriptions()
+	assert.Equal(t, len(subs), 2)
+	assert.True(t, slices.ContainsFunc(subs, func(info SubInfo) bool { return info.ID == "consumer" && info.Subject == "s.*" }))
+	select {
+	case <-watch:
+		t.Fatal("unexpected interest change")
+	default:
+	}
+
+	// Auto-cancelling the subscription removes the consumer from the stream
+	Pub(ps, "s.a", 1)
+	Pub(ps, "s.a", 2)
+	assert.Equal(t, calls, 1)
+	assert.Equal(t, len(st.consumers), 0)
+	assert.Equal(t, len(ps.Subscriptions()), 1)
+}
+
+func TestSubStreamLiveDuringReplay(t *testing.T) {
+	ps := NewPubSub()
+	st, _ := ps.AddStream("s", []string{"s"}, StreamLimits{})
+	Pub(ps, "s", 0)
+	Pub(ps, "s", 1)
+	var data []int
+	SubStream(st, "s", DeliverAll(), func(seq uint64, msg *Msg[int]) {
+		data = append(data, msg.Data)
+		// Messages stored during the replay are delivered after it, in order
+		if msg.Data == 0 {
+			Pub(ps, "s", 2)
+		}
+	})
+	assert.Equal(t, data, []int{0, 1, 2})
+}
+
+func TestSubStreamConcurrentOrder(t *testing.T) {
+	// Publishers need to run in parallel for the race to show up
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(max(4, runtime.GOMAXPROCS(0))))
+	ps := NewPubSub()
+	st, _ := ps.AddStream("s", []string{"s.*"}, StreamLimits{})
+	var mu sync.Mutex
+	var seqs []uint64
+	SubStream(st, "s.*", DeliverNew(), func(seq uint64, _ *Msg[int]) {
+		mu.Lock()
+		seqs = append(seqs, seq)
+		mu.Unlock()
+	})
+
+	var wg sync.WaitGroup
+	for i := range 8 {
+		wg.Go(func() {
+			for j := range 500 {
+				Pub(ps, "s."+strconv.Itoa(i), j)
+			}
+		})
+	}
+	wg.Wait()
+	assert.Equal(t, len(seqs), 8*500)
+	for i, seq := range seqs {
+		assert.Equal(t, seq, uint64(i+1))
+	}
+}
@@ -0,0 +1,227 @@
+package pubsub
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// Subject template errors
+var (
+	ErrInvalidParam    = errors.New("pubsub: subject parameter is not a valid token")
+	ErrSubjectMismatch = errors.New("pubsub: subject does not match template")
+)
+
+// Subject is a subject template such as "orders.{region}.{id}.created", whose parameters
+// are filled in from the fields of a struct P. Each {name} refers to the field of P with the
+// tag `subject:"name"`, or failing that, the field whose name matches case-insensitively.
+// Fields may be strings, integers or booleans, or pointers to them.
+//
+// Templates are checked against P when they are created, so a typo in a template panics
+// at startup rather than producing a subject that no one is listening to.
+type Subject[P any] struct {
+	pattern string
+	tokens  []templateToken
+}
+
+// templateToken is either a literal token or a parameter, which is filled in from a field of P.
+type templateToken struct {
+	literal string
+	field   int // Index of the struct field, or -1 for literals
+	name    string
+}
+
+// NewSubject parses a subject template for the parameters P.
+// It panics if the template is invalid or refers to a field that P does not have.
+func NewSubject[P any](pattern string) Subject[P] {
+	t := reflect.TypeFor[P]()
+	if t.Kind() != reflect.Struct {
+		panic(fmt.Sprintf("pubsub: subject template parameters must be a struct, not %v", t))
+	}
+	s := Subject[P]{pattern: pattern}
+	for tok := range strings.SplitSeq(pattern, ".") {
+		name, isParam := strings.CutPrefix(tok, "{")
+		if !isParam {
+			if !IsValidPubToken(tok) {
+				panic(fmt.Sprintf("pubsub: invalid token %q in subject template %q", tok, pattern))
+			}
+			s.tokens = append(s.tokens, templateToken{literal: tok, field: -1})
+			continue
+		}
+		name, ok := strings.CutSuffix(name, "}")
+		if !ok || name == _EMPTY_ {
+			panic(fmt.Sprintf("pubsub: invalid parameter %q in subject template %q", tok, pattern))
+		}
+		field := paramField(t, name)
+		if field < 0 {
+			panic(fmt.Sprintf("pubsub: %v has no field for parameter {%s} in subject template %q", t, name, pattern))
+		}
+		s.tokens = append(s.tokens, templateToken{field: field, name: name})
+	}
+	return s
+}
+
+// paramField returns the index of the field of t for the named parameter, or -1 if there is none.
+func paramField(t reflect.Type, name string) int {
+	for i := range t.NumField() {
+		if tag, ok := t.Field(i).Tag.Lookup("subject"); ok && tag == name {
+			return checkParamType(t.Field(i))
+		}
+	}
+	for i := range t.NumField() {
+		if _, ok := t.Field(i).Tag.Lookup("subject"); !ok && strings.EqualFold(t.Field(i).Name, name) {
+			return checkParamType(t.Field(i))
+		}
+	}
+	return -1
+}
+
+func checkParamType(f reflect.StructField) int {
+	t := f.Type
+	if t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	switch t.Kind() {
+	case reflect.String, reflect.Bool,
+		reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return f.Index[0]
+	}
+	panic(fmt.Sprintf("pubsub: unsupported type %v for subject parameter field %s", f.Type, f.Name))
+}
+
+// String returns the template pattern.
+func (s Subject[P]) String() string {
+	return s.pattern
+}
+
+// Render returns the literal subject for the given parameters.
+// Every parameter must render as a valid token, so empty strings and
+// values containing dots, wildcards or whitespace are rejected with ErrInvalidParam.
+func (s Subject[P]) Render(p P) (string, error) {
+	return s.render(p, false)
+}
+
+// MustRender is like Render, but panics on error.
+func (s Subject[P]) MustRender(p P) string {
+	subj, err := s.Render(p)
+	if err != nil {
+		panic(err)
+	}
+	return subj
+}
+
+// Filter returns a subscription subject in which parameters that are left as zero values
+// (or nil pointers) are replaced by the * wildcard, so the zero value of P matches every
+// subject the template can render.
+func (s Subject[P]) Filter(p P) (string, error) {
+	return s.render(p, true)
+}
+
+func (s Subject[P]) render(p P, wildcards bool) (string, error) {
+	v := reflect.ValueOf(p)
+	var b strings.Builder
+	for i, tok := range s.tokens {
+		if i > 0 {
+			b.WriteByte('.')
+		}
+		if tok.field < 0 {
+			b.WriteString(tok.literal)
+			continue
+		}
+		fv := v.Field(tok.field)
+		if wildcards && fv.IsZero() {
+			b.WriteByte('*')
+			continue
+		}
+		param := formatParam(fv)
+		if !IsValidPubToken(param) {
+			return _EMPTY_, fmt.Errorf("%w: {%s} is %q", ErrInvalidParam, tok.name, param)
+		}
+		b.WriteString(param)
+	}
+	return b.String(), nil
+}
+
+func formatParam(v reflect.Value) string {
+	if v.Kind() == reflect.Pointer {
+		if v.IsNil() {
+			return _EMPTY_
+		}
+		v = v.Elem()
+	}
+	switch v.Kind() {
+	case reflect.String:
+		return v.String()
+	case reflect.Bool:
+		return strconv.FormatBool(v.Bool())
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return strconv.FormatInt(v.Int(), 10)
+	default:
+		return strconv.FormatUint(v.Uint(), 10)
+	}
+}
+
+// Parse extracts the parameters from a subject rendered by this template,
+// such as the subject passed to a handler subscribed to its Filter.
+func (s Subject[P]) Parse(subj string) (P, error) {
+	var p P
+	v := reflect.ValueOf(&p).Elem()
+	rest := subj
+	for i, tok := range s.tokens {
+		var part string
+		if i == len(s.tokens)-1 {
+			part, rest = rest, _EMPTY_
+			if strings.ContainsRune(part, '.') {
+				return p, fmt.Errorf("%w: %q", ErrSubjectMismatch, subj)
+			}
+		} else {
+			var ok bool
+			if part, rest, ok = strings.Cut(rest, "."); !ok {
+				return p, fmt.Errorf("%w: %q", ErrSubjectMismatch, subj)
+			}
+		}
+		if tok.field < 0 {
+			if part != tok.literal {
+				return p, fmt.Errorf("%w: %q", ErrSubjectMismatch, subj)
+			}
+			continue
+		}
+		if err := parseParam(v.Field(tok.field), part); err != nil {
+			return p, fmt.Errorf("%w: {%s} in %q: %w", ErrSubjectMismatch, tok.name, subj, err)
+		}
+	}
+	return p, nil
+}
+
+func parseParam(v reflect.Value, s string) error {
+	if v.Kind() == reflect.Pointer {
+		v.Set(reflect.New(v.Type().Elem()))
+		v = v.Elem()
+	}
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(s)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return err
+		}
+		v.SetBool(b)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, err := strconv.ParseInt(s, 10, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetInt(n)
+	default:
+		n, err := strconv.ParseUint(s, 10, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetUint(n)
+	}
+	return nil
+}
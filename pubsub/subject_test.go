@@ -0,0 +1,75 @@
+package pubsub
+
+import (
+	"testing"
+
+	"github.com/yurivish/toolkit/assert"
+)
+
+type orderParams struct {
+	Region string
+	ID     int `subject:"id"`
+	Rush   *bool
+}
+
+var orderCreated = NewSubject[orderParams]("orders.{region}.{id}.created.{rush}")
+
+func TestSubjectRender(t *testing.T) {
+	rush := true
+	subj, err := orderCreated.Render(orderParams{Region: "eu", ID: 42, Rush: &rush})
+	assert.Nil(t, err)
+	assert.Equal(t, subj, "orders.eu.42.created.true")
+
+	_, err = orderCreated.Render(orderParams{Region: "eu.west", Rush: &rush})
+	assert.ErrorIs(t, err, ErrInvalidParam)
+	_, err = orderCreated.Render(orderParams{Region: "*", Rush: &rush})
+	assert.ErrorIs(t, err, ErrInvalidParam)
+	_, err = orderCreated.Render(orderParams{Region: "eu"}) // Nil pointer
+	assert.ErrorIs(t, err, ErrInvalidParam)
+}
+
+func TestSubjectFilter(t *testing.T) {
+	filter, err := orderCreated.Filter(orderParams{Region: "eu"})
+	assert.Nil(t, err)
+	assert.Equal(t, filter, "orders.eu.*.created.*")
+	filter, _ = orderCreated.Filter(orderParams{})
+	assert.Equal(t, filter, "orders.*.*.created.*")
+	_, err = orderCreated.Filter(orderParams{Region: "a b"})
+	assert.ErrorIs(t, err, ErrInvalidParam)
+}
+
+func TestSubjectParse(t *testing.T) {
+	p, err := orderCreated.Parse("orders.us.7.created.false")
+	assert.Nil(t, err)
+	assert.Equal(t, p.Region, "us")
+	assert.Equal(t, p.ID, 7)
+	assert.False(t, *p.Rush)
+
+	for _, subj := range []string{"orders.us.x.created.false", "orders.us.7.deleted.false", "orders.us.7.created", "orders.us.7.created.true.x"} {
+		_, err = orderCreated.Parse(subj)
+		assert.ErrorIs(t, err, ErrSubjectMismatch)
+	}
+
+	ps := NewPubSub()
+	var got []orderParams
+	filter, _ := orderCreated.Filter(orderParams{Region: "eu"})
+	Sub(ps, filter, func(subj string, _ string) {
+		p, err := orderCreated.Parse(subj)
+		assert.Nil(t, err)
+		got = append(got, p)
+	})
+	rush := false
+	Pub(ps, orderCreated.MustRender(orderParams{Region: "eu", ID: 1, Rush: &rush}), "x")
+	Pub(ps, orderCreated.MustRender(orderParams{Region: "us", ID: 2, Rush: &rush}), "x")
+	assert.Equal(t, len(got), 1)
+	assert.Equal(t, got[0].ID, 1)
+}
+
+func TestNewSubjectPanics(t *testing.T) {
+	for _, pattern := range []string{"orders.{missing}", "orders.{region", "orders..{id}", "orders.*.{id}", "orders.{}"} {
+		func() {
+			defer func() { assert.NotNil(t, recover()) }()
+			NewSubject[orderParams](pattern)
+		}()
+	}
+}
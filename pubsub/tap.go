@@ -0,0 +1,268 @@
+package pubsub
+
+import (
+	"html/template"
+	"math/rand/v2"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/starfederation/datastar-go/datastar"
+	"github.com/yurivish/toolkit"
+	"github.com/yurivish/toolkit/req"
+	"github.com/yurivish/toolkit/sublist"
+)
+
+// TapOptions configure the TapHandler.
+type TapOptions struct {
+	MaxRate   float64 // Maximum events per second streamed to each client
+	BufSize   int     // Events buffered per client; more are dropped while the client catches up
+	MaxData   int     // Longest JSON rendering of a message shown before it is truncated
+	ScriptURL string  // Where the page loads the Datastar client from
+}
+
+type TapOption func(*TapOptions)
+
+// WithTapMaxRate caps the number of events per second streamed to each client.
+// Clients may ask for a lower rate, but not a higher one.
+func WithTapMaxRate(perSecond float64) TapOption {
+	return func(o *TapOptions) {
+		o.MaxRate = perSecond
+	}
+}
+
+// WithTapBufSize sets the number of events buffered for each client,
+// beyond which events are dropped until the client catches up.
+func WithTapBufSize(n int) TapOption {
+	return func(o *TapOptions) {
+		o.BufSize = n
+	}
+}
+
+// WithTapMaxData sets the length at which the JSON rendering of a message is truncated.
+func WithTapMaxData(n int) TapOption {
+	return func(o *TapOptions) {
+		o.MaxData = n
+	}
+}
+
+// WithTapScriptURL sets the URL of the Datastar client script, eg. to serve it locally.
+func WithTapScriptURL(url string) TapOption {
+	return func(o *TapOptions) {
+		o.ScriptURL = url
+	}
+}
+
+// TapEvent describes a single message seen by the tap.
+type TapEvent struct {
+	Time        time.Time
+	Subject     string
+	Data        string   // The message rendered as JSON
+	Subscribers []string // The subscriptions that matched the message, see describeSub
+}
+
+// TapHandler returns an http.Handler that streams the messages published to subjects
+// matching a filter. Browsers get a page that renders the stream, which it receives from
+// the same URL as Datastar server-sent events.
+//
+// Clients choose the filter, the fraction of messages to sample, and the maximum number of
+// events per second using the filter, sample and rate parameters (as query parameters or
+// Datastar signals). Messages are sampled and rate limited on the publishing goroutine before
+// they are rendered, so a busy subject costs little more than a counter increment.
+func (ps *PubSub) TapHandler(options ...TapOption) http.Handler {
+	opts := TapOptions{
+		MaxRate:   50,
+		BufSize:   256,
+		MaxData:   4096,
+		ScriptURL: "https://cdn.jsdelivr.net/gh/starfederation/datastar@1.0.0/bundles/datastar.js",
+	}
+	for _, opt := range options {
+		opt(&opts)
+	}
+	return req.Handle(func(r *req.Req, in struct {
+		Filter *string  `query:"filter" signal:"filter"`
+		Sample *float64 `query:"sample" signal:"sample"`
+		Rate   *float64 `query:"rate" signal:"rate"`
+	}) error {
+		if r.HasErrors() {
+			return req.HTTPError(http.StatusBadRequest, r.Error())
+		}
+		filter, sample, rate := ">", 1.0, opts.MaxRate
+		if in.Filter != nil && *in.Filter != _EMPTY_ {
+			filter = *in.Filter
+		}
+		if in.Sample != nil {
+			sample = min(max(*in.Sample, 0), 1)
+		}
+		if in.Rate != nil && *in.Rate > 0 {
+			rate = min(*in.Rate, rate)
+		}
+		if !sublist.IsValidSubject(filter) {
+			return req.HTTPError(http.StatusBadRequest, "invalid filter subject")
+		}
+		if r.R.Header.Get("Datastar-Request") == _EMPTY_ {
+			signals, err := toolkit.ToJSON(map[string]any{"filter": filter, "sample": sample, "rate": rate, "dropped": 0})
+			if err != nil {
+				return err
+			}
+			var b strings.Builder
+			if err := tapPage.Execute(&b, map[string]any{"Signals": string(signals), "ScriptURL": opts.ScriptURL}); err != nil {
+				return err
+			}
+			return r.HTML(b.String())
+		}
+		ps.tap(r.W, r.R, filter, sample, rate, opts)
+		return nil
+	})
+}
+
+// tap streams events to the client until it disconnects.
+func (ps *PubSub) tap(w http.ResponseWriter, r *http.Request, filter string, sample, rate float64, opts TapOptions) {
+	events := make(chan TapEvent, opts.BufSize)
+	var dropped atomic.Uint64
+	limiter := newRateLimiter(rate)
+
+	var self atomic.Pointer[sublist.Subscription] // Excluded from the subscribers we report
+	handler := func(subj string, data any, matches *sublist.SublistResult) {
+		if sample < 1 && rand.Float64() >= sample {
+			return
+		}
+		now := time.Now()
+		if !limiter.allow(now) {
+			dropped.Add(1)
+			return
+		}
+		ev := TapEvent{Time: now, Subject: subj, Data: tapData(data, opts.MaxData)}
+		for _, sub := range matches.Psubs {
+			if sub != self.Load() {
+				ev.Subscribers = append(ev.Subscribers, describeSub(sub))
+			}
+		}
+		for _, group := range matches.Qsubs {
+			if len(group) > 0 {
+				ev.Subscribers = append(ev.Subscribers, "queue "+string(group[0].Queue)+" ("+strconv.Itoa(len(group))+" members): "+describeSub(group[0]))
+			}
+		}
+		select {
+		case events <- ev:
+		default:
+			dropped.Add(1)
+		}
+	}
+	s := subscribe(ps, filter, handler, WithDebug(), WithID("$TAP"), func(o *SubOptions) { o.internal = true })
+	self.Store(s.sub)
+	defer s.cancel()
+
+	sse := datastar.NewSSE(w, r)
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	var reported uint64
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case ev := <-events:
+			var b strings.Builder
+			if err := tapRow.Execute(&b, ev); err != nil {
+				return
+			}
+			if sse.PatchElements(b.String(), datastar.WithSelector("#tap-events"), datastar.WithModePrepend()) != nil {
+				return
+			}
+		case <-ticker.C:
+			if n := dropped.Load(); n != reported {
+				reported = n
+				if sse.MarshalAndPatchSignals(map[string]any{"dropped": n}) != nil {
+					return
+				}
+			}
+		}
+	}
+}
+
+// tapData renders message data as JSON, truncated to at most max bytes.
+func tapData(data any, max int) string {
+	b, err := toolkit.ToJSON(data)
+	if err != nil {
+		return "error: " + err.Error()
+	}
+	if len(b) > max {
+		return string(b[:max]) + "…"
+	}
+	return string(b)
+}
+
+// describeSub identifies a subscription by its subject and call site.
+func describeSub(sub *sublist.Subscription) string {
+	var b strings.Builder
+	b.Write(sub.Subject)
+	if sub.ID != _EMPTY_ {
+		b.WriteString(" [" + sub.ID + "]")
+	}
+	if sub.FuncName != _EMPTY_ {
+		b.WriteString(" " + sub.FuncName)
+	}
+	if sub.File != _EMPTY_ {
+		b.WriteString(" " + sub.File + ":" + strconv.Itoa(sub.Line))
+	}
+	return b.String()
+}
+
+// rateLimiter is a token bucket that allows bursts of up to one second's worth of events.
+type rateLimiter struct {
+	mu     sync.Mutex
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(perSecond float64) *rateLimiter {
+	return &rateLimiter{rate: perSecond, tokens: perSecond}
+}
+
+func (l *rateLimiter) allow(now time.Time) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if !l.last.IsZero() {
+		l.tokens = min(l.tokens+now.Sub(l.last).Seconds()*l.rate, max(l.rate, 1))
+	}
+	l.last = now
+	if l.tokens < 1 {
+		return false
+	}
+	l.tokens--
+	return true
+}
+
+var tapRow = template.Must(template.New("row").Parse(`<tr>
+<td>{{.Time.Format "15:04:05.000"}}</td>
+<td>{{.Subject}}</td>
+<td><pre>{{.Data}}</pre></td>
+<td>{{range .Subscribers}}<div><code>{{.}}</code></div>{{end}}</td>
+</tr>`))
+
+var tapPage = template.Must(template.New("tap").Parse(`<!doctype html>
+<title>Tap</title>
+<script type="module" src="{{.ScriptURL}}"></script>
+<style>
+body { font: 14px system-ui, sans-serif; margin: 1em; }
+table { border-collapse: collapse; }
+th, td { padding: 2px 8px; text-align: left; vertical-align: top; border-bottom: 1px solid #ddd; }
+pre { margin: 0; white-space: pre-wrap; max-width: 60em; }
+code { font-size: 12px; }
+</style>
+<div data-signals="{{.Signals}}">
+	<label>Filter <input data-bind:filter></label>
+	<label>Sample <input type="number" min="0" max="1" step="0.01" data-bind:sample></label>
+	<label>Rate <input type="number" min="1" data-bind:rate> per second</label>
+	<button data-on:click="document.getElementById('tap-events').replaceChildren(); $dropped = 0; @get(location.pathname)">Tap</button>
+	<span data-show="$dropped > 0"><span data-text="$dropped"></span> dropped</span>
+</div>
+<table>
+<thead><tr><th>Time</th><th>Subject</th><th>Message</th><th>Subscribers</th></tr></thead>
+<tbody id="tap-events"></tbody>
+</table>
+`))
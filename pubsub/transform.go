@@ -0,0 +1,237 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"strconv"
+	"strings"
+
+	"github.com/yurivish/toolkit/sublist"
+)
+
+// Transform errors
+var (
+	ErrTransformSource      = errors.New("pubsub: invalid transform source")
+	ErrTransformDestination = errors.New("pubsub: invalid transform destination")
+	ErrTransformCycle       = errors.New("pubsub: transform destination overlaps its source")
+)
+
+// Transform maps subjects matching a source pattern to destination subjects,
+// following NATS subject mapping. The destination may contain these functions,
+// which refer to the wildcards in the source by their one-based position:
+//
+//   - {{wildcard(i)}} (or $i) is replaced by the token matching the ith * wildcard.
+//   - {{partition(n,i,j,...)}} is replaced by a bucket number from 0 to n-1, chosen by
+//     hashing the tokens matching the given wildcards (or all of them, if none are given).
+//     As in NATS, the bucket is the FNV-1a hash of the concatenated tokens modulo n.
+//   - A trailing > is replaced by the tokens matching a trailing > in the source.
+//
+// For example, the transform from "orders.*.*" to "orders.{{wildcard(2)}}.{{wildcard(1)}}"
+// swaps the second and third tokens, and "orders.*.>" to "shard.{{partition(4,1)}}.>"
+// partitions orders into four shards by their second token.
+type Transform struct {
+	src      string
+	srcLen   int     // Number of tokens in the source
+	srcWilds []uint8 // One-based positions of the * wildcards in the source
+	srcFwc   bool    // Whether the source ends in >
+	dest     []transformToken
+}
+
+type transformToken struct {
+	literal   string
+	wildcard  int   // Index into srcWilds for {{wildcard(i)}}, or -1
+	buckets   int   // Number of buckets for {{partition(n,...)}}, or zero
+	wildcards []int // Indexes into srcWilds hashed by partition
+	fwc       bool
+}
+
+// NewTransform creates a transform from subjects matching src to subjects of the form dest.
+func NewTransform(src, dest string) (*Transform, error) {
+	if !sublist.IsValidSubject(src) {
+		return nil, fmt.Errorf("%w: %q", ErrTransformSource, src)
+	}
+	t := &Transform{src: src}
+	srcTokens := sublist.TokenizeSubjectIntoSlice(nil, src)
+	t.srcLen = len(srcTokens)
+	if t.srcLen > 255 {
+		return nil, fmt.Errorf("%w: %q has too many tokens", ErrTransformSource, src)
+	}
+	for i, tok := range srcTokens {
+		switch tok {
+		case "*":
+			t.srcWilds = append(t.srcWilds, uint8(i+1))
+		case ">":
+			t.srcFwc = true
+		}
+	}
+
+	destTokens := sublist.TokenizeSubjectIntoSlice(nil, dest)
+	for i, tok := range destTokens {
+		dt, err := t.parseToken(tok, i == len(destTokens)-1)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %q: %w", ErrTransformDestination, dest, err)
+		}
+		t.dest = append(t.dest, dt)
+	}
+	return t, nil
+}
+
+// parseToken parses a single destination token, which may be a function call.
+func (t *Transform) parseToken(tok string, last bool) (transformToken, error) {
+	dt := transformToken{wildcard: -1}
+	switch {
+	case tok == ">":
+		if !last || !t.srcFwc {
+			return dt, errors.New("> must be the last token and requires a > in the source")
+		}
+		dt.fwc = true
+		return dt, nil
+	case strings.HasPrefix(tok, "$"):
+		i, err := t.wildcardIndex(tok[1:])
+		dt.wildcard = i
+		return dt, err
+	case strings.HasPrefix(tok, "{{") && strings.HasSuffix(tok, "}}"):
+		call := strings.TrimSpace(tok[2 : len(tok)-2])
+		name, args, ok := strings.Cut(call, "(")
+		args, ok2 := strings.CutSuffix(args, ")")
+		if !ok || !ok2 {
+			return dt, fmt.Errorf("invalid function %q", tok)
+		}
+		var params []string
+		for arg := range strings.SplitSeq(args, ",") {
+			params = append(params, strings.TrimSpace(arg))
+		}
+		switch strings.ToLower(strings.TrimSpace(name)) {
+		case "wildcard":
+			if len(params) != 1 {
+				return dt, fmt.Errorf("wildcard takes one argument: %q", tok)
+			}
+			i, err := t.wildcardIndex(params[0])
+			dt.wildcard = i
+			return dt, err
+		case "partition":
+			n, err := strconv.Atoi(params[0])
+			if err != nil || n <= 0 {
+				return dt, fmt.Errorf("invalid number of partitions: %q", tok)
+			}
+			dt.buckets = n
+			for _, param := range params[1:] {
+				i, err := t.wildcardIndex(param)
+				if err != nil {
+					return dt, err
+				}
+				dt.wildcards = append(dt.wildcards, i)
+			}
+			if len(params) == 1 {
+				for i := range t.srcWilds {
+					dt.wildcards = append(dt.wildcards, i)
+				}
+			}
+			return dt, nil
+		}
+		return dt, fmt.Errorf("unknown function %q", tok)
+	case tok == "*" || tok == _EMPTY_ || strings.ContainsAny(tok, "\t\n\f\r "):
+		return dt, fmt.Errorf("invalid token %q", tok)
+	}
+	dt.literal = tok
+	return dt, nil
+}
+
+// wildcardIndex parses a one-based wildcard position into an index into srcWilds.
+func (t *Transform) wildcardIndex(s string) (int, error) {
+	i, err := strconv.Atoi(s)
+	if err != nil || i < 1 || i > len(t.srcWilds) {
+		return 0, fmt.Errorf("no wildcard %q in the source", s)
+	}
+	return i - 1, nil
+}
+
+// String returns the transform as "src -> dest".
+func (t *Transform) String() string {
+	return t.src + " -> " + t.destPattern(true)
+}
+
+// destPattern returns the destination, with functions written out or replaced by *.
+func (t *Transform) destPattern(functions bool) string {
+	tokens := make([]string, len(t.dest))
+	for i, dt := range t.dest {
+		switch {
+		case dt.fwc:
+			tokens[i] = ">"
+		case !functions && (dt.wildcard >= 0 || dt.buckets > 0):
+			tokens[i] = "*"
+		case dt.wildcard >= 0:
+			tokens[i] = fmt.Sprintf("{{wildcard(%d)}}", dt.wildcard+1)
+		case dt.buckets > 0:
+			args := []string{strconv.Itoa(dt.buckets)}
+			for _, w := range dt.wildcards {
+				args = append(args, strconv.Itoa(w+1))
+			}
+			tokens[i] = "{{partition(" + strings.Join(args, ",") + ")}}"
+		default:
+			tokens[i] = dt.literal
+		}
+	}
+	return strings.Join(tokens, ".")
+}
+
+// Apply transforms a literal subject, returning false if it does not match the source.
+func (t *Transform) Apply(subj string) (string, bool) {
+	if !sublist.SubjectMatchesFilter(subj, t.src) {
+		return _EMPTY_, false
+	}
+	var b strings.Builder
+	for i, dt := range t.dest {
+		if i > 0 {
+			b.WriteByte('.')
+		}
+		switch {
+		case dt.fwc:
+			var buf [32]string
+			tokens := sublist.TokenizeSubjectIntoSlice(buf[:0], subj)
+			b.WriteString(strings.Join(tokens[t.srcLen-1:], "."))
+		case dt.wildcard >= 0:
+			b.WriteString(sublist.TokenAt(subj, t.srcWilds[dt.wildcard]))
+		case dt.buckets > 0:
+			h := fnv.New32a()
+			for _, w := range dt.wildcards {
+				h.Write([]byte(sublist.TokenAt(subj, t.srcWilds[w])))
+			}
+			b.WriteString(strconv.Itoa(int(h.Sum32() % uint32(dt.buckets))))
+		default:
+			b.WriteString(dt.literal)
+		}
+	}
+	return b.String(), true
+}
+
+// AddTransform republishes every message published to subjects matching src onto the
+// subject given by transforming it according to dest (see Transform), so that subject
+// namespaces can be restructured without touching publishers. The republished message
+// shares the original's data, headers and reply subject.
+//
+// Transforms whose destination overlaps their source are rejected, since they would
+// republish their own output. Cycles formed by several transforms are not detected.
+// Errors republishing a message, such as ErrSchemaMismatch, are reported to the observer
+// (see WithObserver) or logged.
+func (ps *PubSub) AddTransform(src, dest string) (context.CancelFunc, error) {
+	t, err := NewTransform(src, dest)
+	if err != nil {
+		return nil, err
+	}
+	if sublist.SubjectsCollide(src, t.destPattern(false)) {
+		return nil, fmt.Errorf("%w: %s", ErrTransformCycle, t)
+	}
+	var self *subscriber
+	return sub(ps, src, func(msg *Msg[any]) {
+		if subj, ok := t.Apply(msg.Subject); ok {
+			out := &Msg[any]{Subject: subj, Reply: msg.Reply, Header: msg.Header, Time: msg.Time, Data: msg.Data}
+			ps.publishError(self, out, ps.publish(out))
+		}
+	}, WithID("$TRANSFORM "+t.String()), func(o *SubOptions) {
+		o.onSubscribe = func(s *subscriber) { self = s }
+		o.forward = t.Apply
+	}), nil
+}
@@ -0,0 +1,102 @@
+package pubsub
+
+import (
+	"context"
+	"hash/fnv"
+	"strconv"
+	"testing"
+
+	"github.com/yurivish/toolkit/assert"
+	"github.com/yurivish/toolkit/sublist"
+)
+
+func TestTransform(t *testing.T) {
+	apply := func(src, dest, subj string) string {
+		t.Helper()
+		tr, err := NewTransform(src, dest)
+		assert.Nil(t, err)
+		out, ok := tr.Apply(subj)
+		assert.True(t, ok)
+		return out
+	}
+	assert.Equal(t, apply("orders.*.created", "audit.{{wildcard(1)}}", "orders.eu.created"), "audit.eu")
+	assert.Equal(t, apply("orders.*.*", "orders.{{ wildcard(2) }}.$1", "orders.eu.42"), "orders.42.eu")
+	assert.Equal(t, apply("a.*.>", "b.$1.>", "a.1.2.3"), "b.1.2.3")
+
+	// Partitions hash the concatenated tokens with FNV-1a
+	partition := func(key string, n uint32) string {
+		h := fnv.New32a()
+		h.Write([]byte(key))
+		return strconv.Itoa(int(h.Sum32() % n))
+	}
+	assert.Equal(t, apply("*.*", "p.{{partition(10)}}", "foo.bar"), "p."+partition("foobar", 10))
+	assert.Equal(t, apply("*.*", "p.{{partition(10,2,1)}}", "foo.bar"), "p."+partition("barfoo", 10))
+	assert.Equal(t, apply("*.*", "p.{{partition(7, 2)}}", "foo.bar"), "p."+partition("bar", 7))
+	counts := map[string]int{}
+	tr, _ := NewTransform("orders.*", "shard.{{partition(4,1)}}")
+	for i := range 1000 {
+		shard, _ := tr.Apply("orders." + strconv.Itoa(i))
+		counts[shard]++
+	}
+	assert.Equal(t, len(counts), 4)
+
+	tr, _ = NewTransform("a.*", "b.$1")
+	_, ok := tr.Apply("c.d")
+	assert.False(t, ok)
+	assert.Equal(t, tr.String(), "a.* -> b.{{wildcard(1)}}")
+
+	for _, dest := range []string{"b.$2", "b.{{wildcard(0)}}", "b.{{unknown(1)}}", "b.>", "b.*", "b..c", "b.{{partition(0)}}"} {
+		_, err := NewTransform("a.*", dest)
+		assert.ErrorIs(t, err, ErrTransformDestination)
+	}
+	_, err := NewTransform("a..b", "c")
+	assert.ErrorIs(t, err, ErrTransformSource)
+}
+
+func TestAddTransform(t *testing.T) {
+	ps := NewPubSub()
+	_, err := ps.AddTransform("orders.*", "orders.{{partition(2,1)}}")
+	assert.ErrorIs(t, err, ErrTransformCycle)
+
+	cancel, err := ps.AddTransform("orders.*.created", "audit.{{wildcard(1)}}")
+	assert.Nil(t, err)
+	var got []string
+	Sub(ps, "audit.*", func(subj string, msg string) { got = append(got, subj+"="+msg) })
+	Pub(ps, "orders.eu.created", "a")
+	Pub(ps, "orders.eu.deleted", "b")
+	cancel()
+	Pub(ps, "orders.us.created", "c")
+	assert.Equal(t, got, []string{"audit.eu=a"})
+}
+
+// errorObserver records the errors reported to it.
+type errorObserver struct {
+	errs []error
+	subs []*sublist.Subscription
+}
+
+func (o *errorObserver) Publish(context.Context, *Msg[any], int) {}
+
+func (o *errorObserver) Deliver(ctx context.Context, _ *sublist.Subscription, _ *Msg[any]) (context.Context, func()) {
+	return ctx, func() {}
+}
+
+func (o *errorObserver) Error(sub *sublist.Subscription, _ *Msg[any], err error) {
+	o.errs = append(o.errs, err)
+	o.subs = append(o.subs, sub)
+}
+
+func TestAddTransformError(t *testing.T) {
+	o := &errorObserver{}
+	ps := NewPubSub(WithObserver(o))
+	_, err := Register[int](ps, "audit.>")
+	assert.Nil(t, err)
+	_, err = ps.AddTransform("orders.*.created", "audit.{{wildcard(1)}}")
+	assert.Nil(t, err)
+
+	// The original publish succeeds, but the transformed message doesn't match the schema
+	assert.Nil(t, Pub(ps, "orders.eu.created", "a"))
+	assert.Equal(t, len(o.errs), 1)
+	assert.ErrorIs(t, o.errs[0], ErrSchemaMismatch)
+	assert.Equal(t, o.subs[0].ID, "$TRANSFORM orders.*.created -> audit.{{wildcard(1)}}")
+}
@@ -0,0 +1,248 @@
+package sublist
+
+import (
+	"maps"
+	"slices"
+	"strings"
+	"sync/atomic"
+)
+
+// NewSublistCopyOnWrite creates a sublist whose readers never take a lock.
+//
+// The trie is treated as immutable: writers serialize on the sublist's mutex, copy
+// the levels and nodes along the path to the subscription they are changing, and then
+// atomically swap in the new root. Match and HasInterest load the current root and walk
+// it without synchronization, so reads scale with cores regardless of concurrent writes.
+//
+// There is no result cache, since a read is already a lock-free walk of the trie.
+// The tradeoff is that writes allocate in proportion to the width of the levels along
+// the path and the number of subscriptions on the node being changed, so this suits
+// workloads where matches vastly outnumber inserts and removes.
+func NewSublistCopyOnWrite() *Sublist {
+	s := &Sublist{root: newLevel(), cow: true}
+	s.croot.Store(s.root)
+	return s
+}
+
+// CopyOnWrite returns whether the sublist was created by NewSublistCopyOnWrite.
+func (s *Sublist) CopyOnWrite() bool {
+	return s.cow
+}
+
+// setRoot publishes a new root to readers. The write lock must be held.
+func (s *Sublist) setRoot(root *level) {
+	s.root = root
+	s.croot.Store(root)
+}
+
+func (s *Sublist) matchCOW(subject string) *SublistResult {
+	atomic.AddUint64(&s.matches, 1)
+	tsa := [32]string{}
+	tokens, ok := literalTokens(tsa[:0], subject)
+	if !ok {
+		return emptyResult
+	}
+	result := &SublistResult{}
+	matchLevel(s.croot.Load(), tokens, result)
+	if len(result.Psubs) == 0 && len(result.Qsubs) == 0 {
+		return emptyResult
+	}
+	return result
+}
+
+func (s *Sublist) hasInterestCOW(subject string, np, nq *int) bool {
+	tsa := [32]string{}
+	tokens, ok := literalTokens(tsa[:0], subject)
+	return ok && matchLevelForAny(s.croot.Load(), tokens, np, nq)
+}
+
+func (s *Sublist) insertCOW(sub *Subscription) error {
+	subject := string(sub.Subject)
+	tokens, haswc, ok := patternTokens(subject)
+	if !ok {
+		return ErrInvalidSubject
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	root, isnew := s.root.withInsert(tokens, sub)
+	s.setRoot(root)
+	s.count++
+	s.inserts++
+	atomic.AddUint64(&s.genid, 1)
+
+	if s.notify != nil && isnew && !haswc && len(s.notify.insert) > 0 {
+		s.chkForInsertNotification(subject, string(sub.Queue))
+	}
+	return nil
+}
+
+// removeCOW is the copy-on-write counterpart to remove. The write lock must be held.
+func (s *Sublist) removeCOW(sub *Subscription, doCacheUpdates bool) error {
+	subject := string(sub.Subject)
+	tokens, haswc, ok := patternTokens(subject)
+	if !ok {
+		return ErrInvalidSubject
+	}
+
+	root, found, last := s.root.withRemove(tokens, sub)
+	if !found {
+		return ErrNotFound
+	}
+	s.setRoot(root)
+	s.count--
+	s.removes++
+	if doCacheUpdates {
+		atomic.AddUint64(&s.genid, 1)
+	}
+
+	if s.notify != nil && last && !haswc && len(s.notify.remove) > 0 {
+		s.chkForRemoveNotification(subject, string(sub.Queue))
+	}
+	return nil
+}
+
+// patternTokens splits a subscription subject into tokens, reporting whether it
+// contains wildcards and whether it is valid.
+func patternTokens(subject string) (tokens []string, haswc, ok bool) {
+	tokens = strings.Split(subject, tsep)
+	for i, t := range tokens {
+		if len(t) == 0 {
+			return nil, false, false
+		}
+		switch t {
+		case pwcs:
+			haswc = true
+		case fwcs:
+			if i != len(tokens)-1 {
+				return nil, false, false
+			}
+			haswc = true
+		}
+	}
+	return tokens, haswc, true
+}
+
+// The functions below never modify the receiver. They return a copy with the change
+// applied, sharing everything off the changed path with the original.
+
+func (l *level) child(t string) *node {
+	switch t {
+	case pwcs:
+		return l.pwc
+	case fwcs:
+		return l.fwc
+	}
+	return l.nodes[t]
+}
+
+// withChild returns a copy of the level with the child for t replaced, or pruned if n is nil.
+func (l *level) withChild(t string, n *node) *level {
+	c := &level{nodes: l.nodes, pwc: l.pwc, fwc: l.fwc}
+	switch t {
+	case pwcs:
+		c.pwc = n
+	case fwcs:
+		c.fwc = n
+	default:
+		c.nodes = maps.Clone(l.nodes)
+		if n == nil {
+			delete(c.nodes, t)
+		} else {
+			c.nodes[t] = n
+		}
+	}
+	return c
+}
+
+func (l *level) withInsert(tokens []string, sub *Subscription) (*level, bool) {
+	t := tokens[0]
+	var n node
+	if old := l.child(t); old != nil {
+		n = *old
+	}
+	var isnew bool
+	if len(tokens) > 1 {
+		next := n.next
+		if next == nil {
+			next = newLevel()
+		}
+		n.next, isnew = next.withInsert(tokens[1:], sub)
+	} else if sub.Queue == nil {
+		n.psubs = maps.Clone(n.psubs)
+		if n.psubs == nil {
+			n.psubs = make(map[*Subscription]struct{})
+		}
+		n.psubs[sub] = struct{}{}
+		isnew = len(n.psubs) == 1
+		n.plist = cowPlist(n.psubs)
+	} else {
+		qname := string(sub.Queue)
+		subs := maps.Clone(n.qsubs[qname])
+		if subs == nil {
+			subs = make(map[*Subscription]struct{})
+			isnew = true
+		}
+		subs[sub] = struct{}{}
+		n.qsubs = maps.Clone(n.qsubs)
+		if n.qsubs == nil {
+			n.qsubs = make(map[string]map[*Subscription]struct{})
+		}
+		n.qsubs[qname] = subs
+	}
+	return l.withChild(t, &n), isnew
+}
+
+func (l *level) withRemove(tokens []string, sub *Subscription) (nl *level, found, last bool) {
+	t := tokens[0]
+	old := l.child(t)
+	if old == nil {
+		return l, false, false
+	}
+	n := *old
+	if len(tokens) > 1 {
+		if n.next == nil {
+			return l, false, false
+		}
+		if n.next, found, last = n.next.withRemove(tokens[1:], sub); !found {
+			return l, false, false
+		}
+	} else if sub.Queue == nil {
+		if _, found = n.psubs[sub]; !found {
+			return l, false, false
+		}
+		n.psubs = maps.Clone(n.psubs)
+		delete(n.psubs, sub)
+		n.plist = cowPlist(n.psubs)
+		last = len(n.psubs) == 0
+	} else {
+		qname := string(sub.Queue)
+		if _, found = n.qsubs[qname][sub]; !found {
+			return l, false, false
+		}
+		n.qsubs = maps.Clone(n.qsubs)
+		if len(n.qsubs[qname]) == 1 {
+			// This is the last queue subscription interest, as in removeFromNode.
+			delete(n.qsubs, qname)
+			last = true
+		} else {
+			subs := maps.Clone(n.qsubs[qname])
+			delete(subs, sub)
+			n.qsubs[qname] = subs
+		}
+	}
+	if n.isEmpty() {
+		return l.withChild(t, nil), found, last
+	}
+	return l.withChild(t, &n), found, last
+}
+
+// cowPlist returns the fast plist for a node's psubs, if it has enough to warrant one.
+// Unlike the mutable trie, the plist is rebuilt on every change since it can't be shared.
+func cowPlist(psubs map[*Subscription]struct{}) []*Subscription {
+	if len(psubs) <= plistMin {
+		return nil
+	}
+	return slices.Collect(maps.Keys(psubs))
+}
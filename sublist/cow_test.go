@@ -0,0 +1,190 @@
+package sublist
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/yurivish/toolkit/assert"
+)
+
+func TestSublistCopyOnWrite(t *testing.T) {
+	// Run the shared sublist tests against the copy-on-write trie
+	tests := map[string]func(*testing.T, *Sublist){
+		"InsertCount":                  testSublistInsertCount,
+		"Simple":                       testSublistSimple,
+		"SimpleMultiTokens":            testSublistSimpleMultiTokens,
+		"PartialWildcard":              testSublistPartialWildcard,
+		"PartialWildcardAtEnd":         testSublistPartialWildcardAtEnd,
+		"FullWildcard":                 testSublistFullWildcard,
+		"Remove":                       testSublistRemove,
+		"RemoveWildcard":               testSublistRemoveWildcard,
+		"RemoveCleanup":                testSublistRemoveCleanup,
+		"RemoveCleanupWildcards":       testSublistRemoveCleanupWildcards,
+		"RemoveWithLargeSubs":          testSublistRemoveWithLargeSubs,
+		"InvalidSubjectsInsert":        testSublistInvalidSubjectsInsert,
+		"BasicQueueResults":            testSublistBasicQueueResults,
+		"BadSubjectOnRemove":           testSublistBadSubjectOnRemove,
+		"TwoTokenPubMatchSingleToken":  testSublistTwoTokenPubMatchSingleTokenSub,
+		"InsertWithWildcardsAsLiteral": testSublistInsertWithWildcardsAsLiterals,
+		"RemoveWithWildcardsAsLiteral": testSublistRemoveWithWildcardsAsLiterals,
+		"RaceOnRemove":                 testSublistRaceOnRemove,
+		"RaceOnInsert":                 testSublistRaceOnInsert,
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			s := NewSublistCopyOnWrite()
+			assert.True(t, s.CopyOnWrite())
+			assert.False(t, s.CacheEnabled())
+			test(t, s)
+		})
+	}
+}
+
+// sortedResult flattens a result into a canonical form for comparison.
+func sortedResult(r *SublistResult) []string {
+	var out []string
+	for _, sub := range r.Psubs {
+		out = append(out, sub.ID)
+	}
+	for _, qsubs := range r.Qsubs {
+		for _, sub := range qsubs {
+			out = append(out, string(sub.Queue)+"/"+sub.ID)
+		}
+	}
+	slices.Sort(out)
+	return out
+}
+
+func TestSublistCopyOnWriteMatchesMutable(t *testing.T) {
+	rng := rand.New(rand.NewPCG(1, 2))
+	toks := []string{"a", "b", "c", "*", ">"}
+	randomSubject := func(literal bool) string {
+		n := 1 + rng.IntN(4)
+		parts := make([]string, n)
+		for i := range parts {
+			tok := toks[rng.IntN(len(toks))]
+			if literal && (tok == "*" || tok == ">") || tok == ">" && i < n-1 {
+				tok = "d"
+			}
+			parts[i] = tok
+		}
+		return strings.Join(parts, ".")
+	}
+
+	cow, mut := NewSublistCopyOnWrite(), NewSublistNoCache()
+	var subs []*Subscription
+	for i := range 2000 {
+		if len(subs) > 0 && rng.IntN(3) == 0 {
+			j := rng.IntN(len(subs))
+			sub := subs[j]
+			subs = slices.Delete(subs, j, j+1)
+			assert.Nil(t, cow.Remove(sub))
+			assert.Nil(t, mut.Remove(sub))
+			assert.ErrorIs(t, cow.Remove(sub), ErrNotFound)
+		} else {
+			sub := &Subscription{Subject: []byte(randomSubject(false)), ID: fmt.Sprint(i)}
+			if rng.IntN(4) == 0 {
+				sub.Queue = []byte(toks[rng.IntN(3)])
+			}
+			subs = append(subs, sub)
+			assert.Nil(t, cow.Insert(sub))
+			assert.Nil(t, mut.Insert(sub))
+		}
+		subject := randomSubject(true)
+		assert.Equal(t, sortedResult(cow.Match(subject)), sortedResult(mut.Match(subject)))
+		assert.Equal(t, cow.HasInterest(subject), mut.HasInterest(subject))
+		assert.Equal(t, cow.Count(), mut.Count())
+	}
+
+	// Snapshots share the trie, and agree with the mutable sublist
+	added, removed := cow.Snapshot().Diff(mut.Snapshot())
+	assert.Equal(t, len(added)+len(removed), 0)
+
+	// Removing everything leaves an empty root
+	assert.Nil(t, cow.RemoveBatch(subs))
+	assert.Equal(t, cow.Count(), uint32(0))
+	assert.Equal(t, cow.root.numNodes(), 0)
+}
+
+func TestSublistCopyOnWriteConcurrent(t *testing.T) {
+	s := NewSublistCopyOnWrite()
+	stable := newSub("foo.*")
+	assert.Nil(t, s.Insert(stable))
+
+	var stop atomic.Bool
+	var wg sync.WaitGroup
+	for range 4 {
+		wg.Go(func() {
+			for !stop.Load() {
+				r := s.Match("foo.bar")
+				if !slices.Contains(r.Psubs, stable) {
+					t.Error("missing stable subscription")
+					return
+				}
+			}
+		})
+	}
+	for i := range 1000 {
+		sub := newSub(fmt.Sprintf("foo.%d", i%10))
+		assert.Nil(t, s.Insert(sub))
+		assert.Nil(t, s.Remove(sub))
+	}
+	stop.Store(true)
+	wg.Wait()
+	assert.Equal(t, s.Count(), uint32(1))
+}
+
+// benchmarkSublistMix measures parallel matches against a sublist of 10k subscriptions,
+// with the given fraction of operations instead inserting and removing a subscription.
+func benchmarkSublistMix(b *testing.B, newSublist func() *Sublist, writeFraction float64) {
+	s := newSublist()
+	var subjects []string
+	for i := range 100 {
+		for j := range 100 {
+			subject := fmt.Sprintf("tenant%d.device%d.events", i, j)
+			subjects = append(subjects, subject)
+			s.Insert(newSub(subject))
+		}
+		s.Insert(newSub(fmt.Sprintf("tenant%d.*.events", i)))
+	}
+	s.Insert(newSub(">"))
+
+	var seed atomic.Uint64
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		rng := rand.New(rand.NewPCG(seed.Add(1), 0))
+		for pb.Next() {
+			subject := subjects[rng.IntN(len(subjects))]
+			if rng.Float64() < writeFraction {
+				sub := newSub(subject)
+				s.Insert(sub)
+				s.Remove(sub)
+			} else {
+				s.Match(subject)
+			}
+		}
+	})
+}
+
+func BenchmarkSublistReadWriteMix(b *testing.B) {
+	impls := []struct {
+		name string
+		new  func() *Sublist
+	}{
+		{"Cache", NewSublistWithCache},
+		{"NoCache", NewSublistNoCache},
+		{"CopyOnWrite", NewSublistCopyOnWrite},
+	}
+	for _, writes := range []float64{0, 0.001, 0.01, 0.1, 0.5} {
+		for _, impl := range impls {
+			b.Run(fmt.Sprintf("writes=%g/%s", writes, impl.name), func(b *testing.B) {
+				benchmarkSublistMix(b, impl.new, writes)
+			})
+		}
+	}
+}
@@ -0,0 +1,356 @@
+package sublist
+
+import (
+	"bytes"
+	"cmp"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+)
+
+// Snapshot is an immutable point-in-time view of a Sublist. Since it never changes,
+// it can be matched against from many goroutines without any locking.
+//
+// Snapshots can be serialized with MarshalBinary and UnmarshalBinary, which record the
+// subject, queue and metadata of each subscription, and its value if a ValueCodec is set
+// with WithCodec. Subscriptions are shared with the Sublist, and should not be modified.
+type Snapshot struct {
+	root  *level
+	subs  []*Subscription // Sorted by subscriptionKey
+	codec ValueCodec
+}
+
+// ValueCodec encodes and decodes the Value field of subscriptions for serialization.
+type ValueCodec interface {
+	EncodeValue(v any) ([]byte, error)
+	DecodeValue(b []byte) (any, error)
+}
+
+// ErrInvalidSnapshot is returned by UnmarshalBinary for malformed data.
+var ErrInvalidSnapshot = errors.New("sublist: invalid snapshot")
+
+// Snapshot returns an immutable copy of the current subscriptions.
+func (s *Sublist) Snapshot() *Snapshot {
+	var root *level
+	if s.cow {
+		// Copy-on-write tries are never modified, so there's nothing to copy
+		root = s.croot.Load()
+	} else {
+		s.RLock()
+		root = s.root.clone()
+		s.RUnlock()
+	}
+	ss := &Snapshot{root: root}
+	ss.collect(root)
+	slices.SortFunc(ss.subs, compareSubscriptions)
+	return ss
+}
+
+// clone returns a deep copy of the level, sharing only the subscriptions.
+func (l *level) clone() *level {
+	if l == nil {
+		return nil
+	}
+	c := &level{nodes: make(map[string]*node, len(l.nodes)), pwc: l.pwc.clone(), fwc: l.fwc.clone()}
+	for t, n := range l.nodes {
+		c.nodes[t] = n.clone()
+	}
+	return c
+}
+
+func (n *node) clone() *node {
+	if n == nil {
+		return nil
+	}
+	c := &node{next: n.next.clone(), psubs: maps.Clone(n.psubs), plist: slices.Clone(n.plist)}
+	if c.psubs == nil {
+		// Copy-on-write tries leave psubs nil on nodes without them
+		c.psubs = make(map[*Subscription]struct{})
+	}
+	if n.qsubs != nil {
+		c.qsubs = make(map[string]map[*Subscription]struct{}, len(n.qsubs))
+		for queue, subs := range n.qsubs {
+			c.qsubs[queue] = maps.Clone(subs)
+		}
+	}
+	return c
+}
+
+func (ss *Snapshot) collect(l *level) {
+	add := func(n *node) {
+		for sub := range n.psubs {
+			ss.subs = append(ss.subs, sub)
+		}
+		for _, qr := range n.qsubs {
+			for sub := range qr {
+				ss.subs = append(ss.subs, sub)
+			}
+		}
+		ss.collect(n.next)
+	}
+	if l == nil {
+		return
+	}
+	for _, n := range l.nodes {
+		add(n)
+	}
+	if l.pwc != nil {
+		add(l.pwc)
+	}
+	if l.fwc != nil {
+		add(l.fwc)
+	}
+}
+
+// compareSubscriptions orders subscriptions by subject, queue and ID, then by call site.
+func compareSubscriptions(a, b *Subscription) int {
+	return cmp.Or(
+		bytes.Compare(a.Subject, b.Subject),
+		bytes.Compare(a.Queue, b.Queue),
+		cmp.Compare(a.ID, b.ID),
+		cmp.Compare(a.File, b.File),
+		cmp.Compare(a.Line, b.Line),
+	)
+}
+
+// WithCodec returns a snapshot sharing the same subscriptions, which serializes their values
+// with the codec. To unmarshal a snapshot with values, call UnmarshalBinary on the result
+// of new(Snapshot).WithCodec(codec).
+func (ss *Snapshot) WithCodec(codec ValueCodec) *Snapshot {
+	c := *ss
+	c.codec = codec
+	return &c
+}
+
+// Match returns the subscriptions matching a literal subject, like Sublist.Match.
+func (ss *Snapshot) Match(subject string) *SublistResult {
+	tsa := [32]string{}
+	tokens, ok := literalTokens(tsa[:0], subject)
+	if !ok || ss.root == nil {
+		return emptyResult
+	}
+	result := &SublistResult{}
+	matchLevel(ss.root, tokens, result)
+	if len(result.Psubs) == 0 && len(result.Qsubs) == 0 {
+		return emptyResult
+	}
+	return result
+}
+
+// HasInterest returns whether there are any subscriptions matching the subject.
+func (ss *Snapshot) HasInterest(subject string) bool {
+	tsa := [32]string{}
+	tokens, ok := literalTokens(tsa[:0], subject)
+	return ok && ss.root != nil && matchLevelForAny(ss.root, tokens, nil, nil)
+}
+
+// literalTokens appends the tokens of a published subject to tokens, reporting
+// whether the subject is valid.
+func literalTokens(tokens []string, subject string) ([]string, bool) {
+	start := 0
+	for i := 0; i < len(subject); i++ {
+		if subject[i] == btsep {
+			if i-start == 0 {
+				return nil, false
+			}
+			tokens = append(tokens, subject[start:i])
+			start = i + 1
+		}
+	}
+	if start >= len(subject) {
+		return nil, false
+	}
+	return append(tokens, subject[start:]), true
+}
+
+// Count returns the number of subscriptions.
+func (ss *Snapshot) Count() uint32 {
+	return uint32(len(ss.subs))
+}
+
+// All returns all subscriptions, ordered by subject, queue and ID.
+func (ss *Snapshot) All() []*Subscription {
+	return slices.Clone(ss.subs)
+}
+
+// Restore returns a new Sublist holding the snapshot's subscriptions.
+func (ss *Snapshot) Restore(enableCache bool) *Sublist {
+	s := NewSublist(enableCache)
+	s.root = ss.root.clone()
+	if s.root == nil {
+		s.root = newLevel()
+	}
+	s.count = uint32(len(ss.subs))
+	return s
+}
+
+// Diff returns the subscriptions that were added and removed going from ss to other.
+// Subscriptions are compared by subject, queue and ID, and by call site, rather than by
+// identity or value, so that snapshots from different processes can be compared.
+func (ss *Snapshot) Diff(other *Snapshot) (added, removed []*Subscription) {
+	// Both lists are sorted, so we can merge them
+	a, b := ss.subs, other.subs
+	for len(a) > 0 && len(b) > 0 {
+		switch c := compareSubscriptions(a[0], b[0]); {
+		case c < 0:
+			removed = append(removed, a[0])
+			a = a[1:]
+		case c > 0:
+			added = append(added, b[0])
+			b = b[1:]
+		default:
+			a, b = a[1:], b[1:]
+		}
+	}
+	removed = append(removed, a...)
+	added = append(added, b...)
+	return added, removed
+}
+
+// Serialization format, with all integers as uvarints and strings prefixed by their length:
+//
+//	"SUBL" version count
+//	count × (subject queue id file line funcName flags [value])
+//
+// The value is present if bit 1 of the flags is set; bit 0 marks debug subscriptions.
+const (
+	snapshotMagic   = "SUBL"
+	snapshotVersion = 1
+
+	snapshotDebug    = 1 << 0
+	snapshotHasValue = 1 << 1
+)
+
+// MarshalBinary encodes the subscriptions, along with their values if there is a codec.
+func (ss *Snapshot) MarshalBinary() ([]byte, error) {
+	b := append([]byte(snapshotMagic), snapshotVersion)
+	b = binary.AppendUvarint(b, uint64(len(ss.subs)))
+	appendBytes := func(v []byte) {
+		b = binary.AppendUvarint(b, uint64(len(v)))
+		b = append(b, v...)
+	}
+	for _, sub := range ss.subs {
+		appendBytes(sub.Subject)
+		appendBytes(sub.Queue)
+		appendBytes([]byte(sub.ID))
+		appendBytes([]byte(sub.File))
+		b = binary.AppendUvarint(b, uint64(sub.Line))
+		appendBytes([]byte(sub.FuncName))
+		var flags byte
+		if sub.Debug {
+			flags |= snapshotDebug
+		}
+		if ss.codec != nil {
+			flags |= snapshotHasValue
+		}
+		b = append(b, flags)
+		if ss.codec != nil {
+			v, err := ss.codec.EncodeValue(sub.Value)
+			if err != nil {
+				return nil, fmt.Errorf("sublist: encoding value of %q: %w", sub.Subject, err)
+			}
+			appendBytes(v)
+		}
+	}
+	return b, nil
+}
+
+// UnmarshalBinary replaces the snapshot with the decoded one. Values are decoded with the
+// codec if there is one, and are nil otherwise.
+func (ss *Snapshot) UnmarshalBinary(data []byte) error {
+	d := snapshotDecoder{b: data}
+	if string(d.next(len(snapshotMagic))) != snapshotMagic || d.byte() != snapshotVersion {
+		return ErrInvalidSnapshot
+	}
+	n := d.uvarint()
+	if n > uint64(len(data)) {
+		return ErrInvalidSnapshot
+	}
+	s := NewSublistNoCache()
+	subs := make([]*Subscription, 0, n)
+	for range n {
+		sub := &Subscription{
+			Subject:  d.bytes(),
+			Queue:    d.bytes(),
+			ID:       string(d.bytes()),
+			File:     string(d.bytes()),
+			Line:     int(d.uvarint()),
+			FuncName: string(d.bytes()),
+		}
+		flags := d.byte()
+		sub.Debug = flags&snapshotDebug != 0
+		if flags&snapshotHasValue != 0 {
+			v := d.bytes()
+			if d.err == nil && ss.codec != nil {
+				value, err := ss.codec.DecodeValue(v)
+				if err != nil {
+					return fmt.Errorf("sublist: decoding value of %q: %w", sub.Subject, err)
+				}
+				sub.Value = value
+			}
+		}
+		if d.err != nil {
+			return d.err
+		}
+		if len(sub.Queue) == 0 {
+			sub.Queue = nil
+		}
+		if err := s.Insert(sub); err != nil {
+			return fmt.Errorf("%w: %w", ErrInvalidSnapshot, err)
+		}
+		subs = append(subs, sub)
+	}
+	if len(d.b) > 0 {
+		return ErrInvalidSnapshot
+	}
+	slices.SortFunc(subs, compareSubscriptions)
+	ss.root, ss.subs = s.root, subs
+	return nil
+}
+
+// snapshotDecoder reads the serialization format, recording the first error.
+type snapshotDecoder struct {
+	b   []byte
+	err error
+}
+
+func (d *snapshotDecoder) next(n int) []byte {
+	if d.err != nil || n > len(d.b) {
+		d.err = ErrInvalidSnapshot
+		return nil
+	}
+	v := d.b[:n:n]
+	d.b = d.b[n:]
+	return v
+}
+
+func (d *snapshotDecoder) byte() byte {
+	if v := d.next(1); v != nil {
+		return v[0]
+	}
+	return 0
+}
+
+func (d *snapshotDecoder) uvarint() uint64 {
+	if d.err != nil {
+		return 0
+	}
+	v, n := binary.Uvarint(d.b)
+	if n <= 0 {
+		d.err = ErrInvalidSnapshot
+		return 0
+	}
+	d.b = d.b[n:]
+	return v
+}
+
+func (d *snapshotDecoder) bytes() []byte {
+	n := d.uvarint()
+	if n > uint64(len(d.b)) {
+		d.err = ErrInvalidSnapshot
+		return nil
+	}
+	return bytes.Clone(d.next(int(n)))
+}
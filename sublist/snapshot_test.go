@@ -0,0 +1,153 @@
+package sublist
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/yurivish/toolkit/assert"
+)
+
+type intCodec struct{}
+
+func (intCodec) EncodeValue(v any) ([]byte, error) {
+	n, ok := v.(int)
+	if !ok {
+		return nil, fmt.Errorf("not an int: %v", v)
+	}
+	return strconv.AppendInt(nil, int64(n), 10), nil
+}
+
+func (intCodec) DecodeValue(b []byte) (any, error) {
+	return strconv.Atoi(string(b))
+}
+
+func snapshotSub(subject, queue string, value int) *Subscription {
+	sub := &Subscription{Subject: []byte(subject), Value: value, ID: strconv.Itoa(value)}
+	if queue != "" {
+		sub.Queue = []byte(queue)
+	}
+	return sub
+}
+
+func TestSnapshotIsolation(t *testing.T) {
+	s := NewSublistWithCache()
+	a, b := snapshotSub("foo.bar", "", 1), snapshotSub("foo.*", "", 2)
+	assert.Nil(t, s.Insert(a))
+	assert.Nil(t, s.Insert(b))
+
+	ss := s.Snapshot()
+	assert.Nil(t, s.Remove(a))
+	assert.Nil(t, s.Insert(snapshotSub("foo.>", "", 3)))
+
+	assert.Equal(t, ss.Count(), uint32(2))
+	assert.Equal(t, len(ss.Match("foo.bar").Psubs), 2)
+	assert.Equal(t, len(s.Match("foo.bar").Psubs), 2)
+	assert.True(t, ss.HasInterest("foo.baz"))
+	assert.False(t, ss.HasInterest("foo.baz.qux"))
+	assert.True(t, s.HasInterest("foo.baz.qux"))
+	assert.Equal(t, ss.Match("foo..bar"), emptyResult)
+
+	r := ss.Restore(false)
+	assert.Equal(t, r.Count(), uint32(2))
+	assert.Nil(t, r.Remove(a))
+	assert.Equal(t, len(ss.Match("foo.bar").Psubs), 2)
+}
+
+func TestSnapshotConcurrentMatch(t *testing.T) {
+	s := NewSublistNoCache()
+	for i := range 100 {
+		assert.Nil(t, s.Insert(snapshotSub(fmt.Sprintf("foo.%d", i), "", i)))
+	}
+	assert.Nil(t, s.Insert(snapshotSub("foo.*", "q", 100)))
+	ss := s.Snapshot()
+
+	var wg sync.WaitGroup
+	for g := range 8 {
+		wg.Go(func() {
+			for i := range 100 {
+				r := ss.Match(fmt.Sprintf("foo.%d", (i+g)%100))
+				if len(r.Psubs) != 1 || len(r.Qsubs) != 1 {
+					t.Errorf("unexpected match result: %+v", r)
+				}
+			}
+		})
+		// Mutating the sublist doesn't affect the snapshot
+		assert.Nil(t, s.Insert(snapshotSub(fmt.Sprintf("foo.%d", g), "", 200+g)))
+	}
+	wg.Wait()
+}
+
+func TestSnapshotMarshal(t *testing.T) {
+	s := NewSublistNoCache()
+	subs := []*Subscription{
+		snapshotSub("foo.bar", "", 1),
+		snapshotSub("foo.*", "workers", 2),
+		snapshotSub("foo.*", "workers", 3),
+		snapshotSub(">", "", 4),
+	}
+	subs[0].File, subs[0].Line, subs[0].FuncName, subs[0].Debug = "main.go", 12, "main.main", true
+	for _, sub := range subs {
+		assert.Nil(t, s.Insert(sub))
+	}
+
+	data, err := s.Snapshot().WithCodec(intCodec{}).MarshalBinary()
+	assert.Nil(t, err)
+	ss := new(Snapshot).WithCodec(intCodec{})
+	assert.Nil(t, ss.UnmarshalBinary(data))
+	assert.Equal(t, ss.Count(), uint32(4))
+	assert.Equal(t, ss.All(), s.Snapshot().All())
+
+	r := ss.Match("foo.bar")
+	assert.Equal(t, len(r.Psubs), 2)
+	assert.Equal(t, len(r.Qsubs), 1)
+	assert.Equal(t, len(r.Qsubs[0]), 2)
+
+	// Without a codec, values are dropped
+	data, err = s.Snapshot().MarshalBinary()
+	assert.Nil(t, err)
+	ss = new(Snapshot)
+	assert.Nil(t, ss.UnmarshalBinary(data))
+	for _, sub := range ss.All() {
+		assert.Nil(t, sub.Value)
+	}
+	added, removed := ss.Diff(s.Snapshot())
+	assert.Equal(t, len(added)+len(removed), 0)
+
+	// Encoding errors are reported
+	assert.Nil(t, s.Insert(&Subscription{Subject: []byte("bad"), Value: "x"}))
+	_, err = s.Snapshot().WithCodec(intCodec{}).MarshalBinary()
+	assert.NotNil(t, err)
+}
+
+func TestSnapshotUnmarshalInvalid(t *testing.T) {
+	s := NewSublistNoCache()
+	assert.Nil(t, s.Insert(snapshotSub("foo.bar", "q", 1)))
+	data, err := s.Snapshot().MarshalBinary()
+	assert.Nil(t, err)
+
+	for _, bad := range [][]byte{nil, []byte("SUBL"), []byte("SUBL\x02\x00"), data[:len(data)-1], append(data, 0)} {
+		err := new(Snapshot).UnmarshalBinary(bad)
+		assert.ErrorIs(t, err, ErrInvalidSnapshot)
+	}
+}
+
+func TestSnapshotDiff(t *testing.T) {
+	s := NewSublistNoCache()
+	a, b, c := snapshotSub("a", "", 1), snapshotSub("b", "", 2), snapshotSub("c", "", 3)
+	assert.Nil(t, s.Insert(a))
+	assert.Nil(t, s.Insert(b))
+	before := s.Snapshot()
+	assert.Nil(t, s.Remove(a))
+	assert.Nil(t, s.Insert(c))
+	after := s.Snapshot()
+
+	added, removed := before.Diff(after)
+	assert.Equal(t, added, []*Subscription{c})
+	assert.Equal(t, removed, []*Subscription{a})
+
+	added, removed = after.Diff(before)
+	assert.Equal(t, added, []*Subscription{a})
+	assert.Equal(t, removed, []*Subscription{c})
+}
@@ -79,6 +79,11 @@ type Sublist struct {
 	ccSweep   int32
 	notify    *notifyMaps
 	count     uint32
+
+	// For copy-on-write sublists, croot is the current root for lock-free readers.
+	// See NewSublistCopyOnWrite.
+	cow   bool
+	croot atomic.Pointer[level]
 }
 
 // notifyMaps holds maps of arrays of channels for notifications
@@ -359,6 +364,10 @@ func (s *Sublist) chkForRemoveNotification(subject, queue string) {
 
 // Insert adds a subscription into the sublist
 func (s *Sublist) Insert(sub *Subscription) error {
+	if s.cow {
+		return s.insertCOW(sub)
+	}
+
 	// copy the subject since we hold this and this might be part of a large byte slice.
 	subject := string(sub.Subject)
 
@@ -550,6 +559,10 @@ func (s *Sublist) matchNoLock(subject string) *SublistResult {
 }
 
 func (s *Sublist) match(subject string, doLock bool, doCopyOnCache bool) *SublistResult {
+	if s.cow {
+		return s.matchCOW(subject)
+	}
+
 	atomic.AddUint64(&s.matches, 1)
 
 	// Check cache first.
@@ -627,6 +640,10 @@ func (s *Sublist) match(subject string, doLock bool, doCopyOnCache bool) *Sublis
 }
 
 func (s *Sublist) hasInterest(subject string, doLock bool, np, nq *int) bool {
+	if s.cow {
+		return s.hasInterestCOW(subject, np, nq)
+	}
+
 	// Check cache first.
 	if doLock {
 		s.RLock()
@@ -827,6 +844,9 @@ func (s *Sublist) remove(sub *Subscription, shouldLock bool, doCacheUpdates bool
 		s.Lock()
 		defer s.Unlock()
 	}
+	if s.cow {
+		return s.removeCOW(sub, doCacheUpdates)
+	}
 
 	var sfwc, haswc bool
 	var n *node
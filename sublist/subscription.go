@@ -31,3 +31,8 @@ type Subscription struct {
 func TokenizeSubjectIntoSlice(tts []string, subject string) []string {
 	return tokenizeSubjectIntoSlice(tts, subject)
 }
+
+// TokenAt returns the token at the given one-based index, or "" if there is none.
+func TokenAt(subject string, index uint8) string {
+	return tokenAt(subject, index)
+}